@@ -1,20 +1,48 @@
 package database
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"sync/atomic"
 	"time"
 
 	"link-shortener/models"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
 )
 
 // DB is the global database connection
 var DB *gorm.DB
 
+// migratedModels are the models whose tables are managed by Migrate
+var migratedModels = []interface{}{
+	&models.User{},
+	&models.APIKey{},
+	&models.RecoveryCode{},
+	&models.RefreshToken{},
+	&models.RevokedToken{},
+	&models.StreamTicket{},
+	&models.OIDCLoginState{},
+	&models.Link{},
+	&models.Click{},
+	&models.IPHashSalt{},
+	&models.LoginAttempt{},
+	&models.LoginLockout{},
+	&models.ClickHourlyRollup{},
+	&models.ClickDailyRollup{},
+	&models.RollupState{},
+	&models.VisitorSketch{},
+	&models.WebhookSubscription{},
+	&models.WebhookDelivery{},
+	&models.WebhookQueuedClick{},
+}
+
+// migrated is set once Migrate has completed
+var migrated atomic.Bool
+
 // Connect establishes connection to the PostgreSQL database
 func Connect(databaseURL string) error {
 	var err error
@@ -22,12 +50,12 @@ func Connect(databaseURL string) error {
 	// Retry connection with backoff
 	for i := 0; i < 5; i++ {
 		DB, err = gorm.Open(postgres.Open(databaseURL), &gorm.Config{
-			Logger: logger.Default.LogMode(logger.Info),
+			Logger: gormLogger{},
 		})
 		if err == nil {
 			break
 		}
-		log.Printf("Failed to connect to database, attempt %d/5: %v", i+1, err)
+		slog.Warn("failed to connect to database", "attempt", i+1, "max_attempts", 5, "error", err)
 		time.Sleep(time.Duration(i+1) * 2 * time.Second)
 	}
 
@@ -45,18 +73,42 @@ func Connect(databaseURL string) error {
 	sqlDB.SetMaxOpenConns(100)
 	sqlDB.SetConnMaxLifetime(time.Hour)
 
-	log.Println("Connected to database successfully")
+	slog.Info("connected to database")
 	return nil
 }
 
 // Migrate runs database migrations
 func Migrate() error {
-	log.Println("Running database migrations...")
-	err := DB.AutoMigrate(&models.Link{}, &models.Click{}, &models.LoginAttempt{})
-	if err != nil {
+	slog.Info("running database migrations")
+	if err := DB.AutoMigrate(migratedModels...); err != nil {
 		return fmt.Errorf("failed to run migrations: %w", err)
 	}
-	log.Println("Database migrations completed")
+	migrated.Store(true)
+	slog.Info("database migrations completed")
+	return nil
+}
+
+// Ping checks that the database is reachable
+func Ping(ctx context.Context) error {
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+// CheckMigrations reports whether migrations have completed and all
+// migrated tables exist
+func CheckMigrations(ctx context.Context) error {
+	if !migrated.Load() {
+		return errors.New("migrations have not completed")
+	}
+	migrator := DB.WithContext(ctx).Migrator()
+	for _, model := range migratedModels {
+		if !migrator.HasTable(model) {
+			return fmt.Errorf("table for %T is missing", model)
+		}
+	}
 	return nil
 }
 
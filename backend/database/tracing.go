@@ -0,0 +1,82 @@
+package database
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// tracer creates spans for database queries
+var tracer = otel.Tracer("link-shortener/database")
+
+// gormSpanKey stores the active span on a GORM statement
+const gormSpanKey = "otel:span"
+
+// EnableTracing adds a span for every GORM operation run with a context
+// that already carries a span (see DB.WithContext). Queries of background
+// jobs without a traced context do not start traces of their own.
+func EnableTracing() error {
+	cb := DB.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:create").Register("otel:before_create", startSpan("create")),
+		cb.Create().After("gorm:create").Register("otel:after_create", endSpan),
+		cb.Query().Before("gorm:query").Register("otel:before_query", startSpan("query")),
+		cb.Query().After("gorm:query").Register("otel:after_query", endSpan),
+		cb.Update().Before("gorm:update").Register("otel:before_update", startSpan("update")),
+		cb.Update().After("gorm:update").Register("otel:after_update", endSpan),
+		cb.Delete().Before("gorm:delete").Register("otel:before_delete", startSpan("delete")),
+		cb.Delete().After("gorm:delete").Register("otel:after_delete", endSpan),
+		cb.Row().Before("gorm:row").Register("otel:before_row", startSpan("row")),
+		cb.Row().After("gorm:row").Register("otel:after_row", endSpan),
+		cb.Raw().Before("gorm:raw").Register("otel:before_raw", startSpan("raw")),
+		cb.Raw().After("gorm:raw").Register("otel:after_raw", endSpan),
+	)
+}
+
+// startSpan returns a callback that starts a span for operation
+func startSpan(operation string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		ctx := tx.Statement.Context
+		if ctx == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+			return
+		}
+
+		_, span := tracer.Start(ctx, "db."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemPostgreSQL,
+				semconv.DBOperationName(operation),
+				semconv.DBCollectionName(tx.Statement.Table),
+			),
+		)
+		tx.InstanceSet(gormSpanKey, span)
+	}
+}
+
+// endSpan ends the span started for a statement, recording its SQL and outcome
+func endSpan(tx *gorm.DB) {
+	value, ok := tx.InstanceGet(gormSpanKey)
+	if !ok {
+		return
+	}
+	span, ok := value.(trace.Span)
+	if !ok {
+		return
+	}
+	defer span.End()
+
+	// Bound parameters are not recorded, only the statement with placeholders
+	span.SetAttributes(
+		semconv.DBQueryText(tx.Statement.SQL.String()),
+		attribute.Int64("db.rows_affected", tx.Statement.RowsAffected),
+	)
+	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		span.RecordError(tx.Error)
+		span.SetStatus(codes.Error, tx.Error.Error())
+	}
+}
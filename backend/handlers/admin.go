@@ -1,28 +1,51 @@
 package handlers
 
 import (
-	"log"
-	"strings"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
 	"time"
 
 	"link-shortener/config"
 	"link-shortener/database"
 	"link-shortener/middleware"
 	"link-shortener/models"
+	"link-shortener/services"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
 )
 
 // AdminHandler handles admin-related HTTP requests
 type AdminHandler struct {
-	config *config.Config
+	config         *config.Config
+	geoService     *services.GeoService
+	uniqueVisitors *services.UniqueVisitorService
+	clickBroker    *services.ClickBroker
+	webhooks       *services.WebhookService
+	loginGuard     *services.LoginGuard
+	tokens         *services.TokenService
+	oidc           *services.OIDCService
 }
 
-// NewAdminHandler creates a new AdminHandler instance
-func NewAdminHandler(cfg *config.Config) *AdminHandler {
+// NewAdminHandler creates a new AdminHandler instance. oidc is nil when
+// single sign-on is not configured.
+func NewAdminHandler(cfg *config.Config, geoService *services.GeoService, uniqueVisitors *services.UniqueVisitorService, clickBroker *services.ClickBroker, webhooks *services.WebhookService, loginGuard *services.LoginGuard, tokens *services.TokenService, oidc *services.OIDCService) *AdminHandler {
 	return &AdminHandler{
-		config: cfg,
+		config:         cfg,
+		geoService:     geoService,
+		uniqueVisitors: uniqueVisitors,
+		clickBroker:    clickBroker,
+		webhooks:       webhooks,
+		loginGuard:     loginGuard,
+		tokens:         tokens,
+		oidc:           oidc,
 	}
 }
 
@@ -32,13 +55,58 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
-// LoginResponse represents the login response body
+// LoginResponse represents the login and refresh response body. Token is
+// a short-lived access token; RefreshToken renews it once through Refresh.
 type LoginResponse struct {
-	Token     string `json:"token"`
-	ExpiresAt int64  `json:"expires_at"`
+	Token            string   `json:"token"`
+	ExpiresAt        int64    `json:"expires_at"`
+	RefreshToken     string   `json:"refresh_token"`
+	RefreshExpiresAt int64    `json:"refresh_expires_at"`
+	Roles            []string `json:"roles"`
 }
 
-// Login authenticates admin and returns JWT
+// TwoFactorChallengeResponse is returned by Login instead of a token when
+// the account has two-factor authentication enabled
+type TwoFactorChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	PreAuthToken      string `json:"pre_auth_token"`
+	ExpiresAt         int64  `json:"expires_at"`
+}
+
+// LoginTwoFactorRequest represents the second login step request body
+type LoginTwoFactorRequest struct {
+	PreAuthToken string `json:"pre_auth_token"`
+	// Code is a TOTP code or an unused recovery code
+	Code string `json:"code"`
+}
+
+// OIDCLoginRequest represents the single sign-on completion request body,
+// with the parameters the identity provider redirected back with
+type OIDCLoginRequest struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+}
+
+// Pre-auth tokens carry a correct password to the second login step. They
+// are signed with a key derived from the JWT secret, so they are never
+// accepted as sign-in tokens.
+const (
+	preAuthTTL      = 5 * time.Minute
+	preAuthAudience = "kintercut-2fa"
+)
+
+// preAuthClaims are the claims of a pre-auth token. The password
+// fingerprint invalidates the token when the password changes before the
+// second step.
+type preAuthClaims struct {
+	jwt.RegisteredClaims
+	PasswordFingerprint string `json:"pwf"`
+}
+
+// Login authenticates a user and returns JWT. Accounts with two-factor
+// authentication get a pre-auth token for LoginTwoFactor instead. Attempts
+// are refused with 429 while the username or IP address is throttled or
+// locked out after earlier failures.
 func (h *AdminHandler) Login(c *fiber.Ctx) error {
 	var req LoginRequest
 	if err := c.BodyParser(&req); err != nil {
@@ -47,71 +115,470 @@ func (h *AdminHandler) Login(c *fiber.Ctx) error {
 		})
 	}
 
-	// Get client IP
-	ip := c.IP()
-	if forwardedFor := c.Get("X-Forwarded-For"); forwardedFor != "" {
-		ips := strings.Split(forwardedFor, ",")
-		ip = strings.TrimSpace(ips[0])
+	// Usernames longer than the column cannot exist, but the attempt must
+	// still be recorded so it counts towards the IP address's lockout
+	username := req.Username
+	if len(username) > 100 {
+		username = username[:100]
 	}
-	userAgent := c.Get("User-Agent")
-	if len(userAgent) > 512 {
-		userAgent = userAgent[:512]
+	attempt := newLoginAttempt(c, username)
+
+	// Refuse guesses while throttled or locked out, without checking the password
+	release, refused, err := beginLoginCheck(c, h.loginGuard, &attempt)
+	if refused {
+		return err
 	}
+	defer release()
 
 	// Validate credentials
-	success := req.Username == h.config.AdminUsername && req.Password == h.config.AdminPassword
-
-	// Record login attempt
-	attempt := models.LoginAttempt{
-		Username:  req.Username,
-		IPAddress: ip,
-		UserAgent: userAgent,
-		Success:   success,
-		CreatedAt: time.Now(),
+	user, err := services.Authenticate(req.Username, req.Password)
+	if err != nil && !errors.Is(err, services.ErrInvalidCredentials) {
+		slog.ErrorContext(c.UserContext(), "login failed", "username", username, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify credentials",
+		})
 	}
-	database.DB.Create(&attempt)
-
-	if !success {
-		log.Printf("FAILED LOGIN ATTEMPT: username=%s, ip=%s", req.Username, ip)
+	if user == nil {
+		attempt.FailureReason = models.LoginFailureCredentials
+		recordLoginAttempt(c, h.loginGuard, &attempt)
+		services.LoginAttempts.WithLabelValues("failure").Inc()
+		slog.WarnContext(c.UserContext(), "login failed", "username", username, "ip", attempt.IPAddress)
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "Invalid credentials",
 		})
 	}
 
-	log.Printf("SUCCESSFUL LOGIN: username=%s, ip=%s", req.Username, ip)
+	// The attempt is recorded once the second factor has been checked
+	if user.TOTPEnabled {
+		expiresAt := time.Now().Add(preAuthTTL)
+		claims := preAuthClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   strconv.FormatUint(uint64(user.ID), 10),
+				Audience:  jwt.ClaimStrings{preAuthAudience},
+				ExpiresAt: jwt.NewNumericDate(expiresAt),
+				IssuedAt:  jwt.NewNumericDate(time.Now()),
+				Issuer:    "kintercut",
+			},
+			PasswordFingerprint: h.passwordFingerprint(user),
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(h.preAuthKey())
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to generate token",
+			})
+		}
 
-	// Generate JWT
-	expiresAt := time.Now().Add(24 * time.Hour)
-	claims := middleware.Claims{
-		Username: req.Username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expiresAt),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			Issuer:    "kintercut",
-		},
+		slog.InfoContext(c.UserContext(), "login awaiting second factor", "username", username, "ip", attempt.IPAddress)
+		return c.JSON(TwoFactorChallengeResponse{
+			TwoFactorRequired: true,
+			PreAuthToken:      token,
+			ExpiresAt:         expiresAt.Unix(),
+		})
+	}
+
+	attempt.Success = true
+	recordLoginAttempt(c, h.loginGuard, &attempt)
+	return h.completeLogin(c, user)
+}
+
+// LoginTwoFactor completes the login of an account with two-factor
+// authentication, given the pre-auth token from Login and a TOTP or
+// recovery code. Failed codes count towards lockouts like wrong passwords.
+func (h *AdminHandler) LoginTwoFactor(c *fiber.Ctx) error {
+	var req LoginTwoFactorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(h.config.JWTSecret))
+	var claims preAuthClaims
+	token, err := jwt.ParseWithClaims(req.PreAuthToken, &claims, func(token *jwt.Token) (interface{}, error) {
+		return h.preAuthKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}), jwt.WithAudience(preAuthAudience))
+	var user *models.User
+	if err == nil && token.Valid {
+		if id, err := strconv.ParseUint(claims.Subject, 10, 64); err == nil {
+			user, _ = services.ActiveUser(uint(id))
+		}
+	}
+	if user != nil && !hmac.Equal([]byte(claims.PasswordFingerprint), []byte(h.passwordFingerprint(user))) {
+		user = nil
+	}
+	if user == nil || !user.TOTPEnabled {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Sign-in has expired, please sign in again",
+		})
+	}
+
+	attempt := newLoginAttempt(c, user.Username)
+	release, refused, err := beginLoginCheck(c, h.loginGuard, &attempt)
+	if refused {
+		return err
+	}
+	defer release()
+
+	ok, err := services.UseTwoFactorCode(user, req.Code)
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "two-factor check failed", "username", user.Username, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify code",
+		})
+	}
+	if !ok {
+		attempt.FailureReason = models.LoginFailureTwoFactor
+		recordLoginAttempt(c, h.loginGuard, &attempt)
+		services.LoginAttempts.WithLabelValues("failure").Inc()
+		slog.WarnContext(c.UserContext(), "login second factor failed", "username", user.Username, "ip", attempt.IPAddress)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid two-factor code",
+		})
+	}
+
+	attempt.Success = true
+	recordLoginAttempt(c, h.loginGuard, &attempt)
+	return h.completeLogin(c, user)
+}
+
+// GetOIDCStatus tells the login page whether single sign-on is available
+func (h *AdminHandler) GetOIDCStatus(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"enabled":       h.oidc != nil,
+		"provider_name": h.config.OIDCProviderName,
+	})
+}
+
+// oidcStateCookie binds a started single sign-on to the browser that
+// started it, so a login begun by someone else cannot be completed in it
+const oidcStateCookie = "kintercut_oidc_state"
+
+// StartOIDCLogin begins single sign-on and returns the identity provider
+// URL to send the browser to. The state is also set in an HttpOnly cookie
+// that LoginOIDC requires. The browser should keep the returned state and
+// only complete the login with LoginOIDC if the provider redirects back
+// with the same state.
+func (h *AdminHandler) StartOIDCLogin(c *fiber.Ctx) error {
+	if h.oidc == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Single sign-on is not configured",
+		})
+	}
+
+	authURL, state, err := h.oidc.StartLogin(c.UserContext())
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "failed to start single sign-on", "error", err)
+		if errors.Is(err, services.ErrOIDCUnavailable) {
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+				"error": "Identity provider is unavailable",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start single sign-on",
+		})
+	}
+
+	setOIDCStateCookie(c, state, services.OIDCStateTTL)
+	return c.JSON(fiber.Map{
+		"authorization_url": authURL,
+		"state":             state,
+	})
+}
+
+// setOIDCStateCookie sets the single sign-on state cookie, or deletes it
+// with a zero maxAge
+func setOIDCStateCookie(c *fiber.Ctx, state string, maxAge time.Duration) {
+	cookie := &fiber.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/admin",
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   c.Protocol() == "https",
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	}
+	if maxAge <= 0 {
+		cookie.MaxAge = -1
+		cookie.Expires = time.Unix(0, 0)
+	}
+	c.Cookie(cookie)
+}
+
+// LoginOIDC completes single sign-on with the authorization code and state
+// from the identity provider's redirect and returns tokens like Login. The
+// state must match the cookie set by StartOIDCLogin. The account is created on the first sign-in and its roles are set from the
+// identity's mapped claims every time.
+func (h *AdminHandler) LoginOIDC(c *fiber.Ctx) error {
+	if h.oidc == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Single sign-on is not configured",
+		})
+	}
+
+	var req OIDCLoginRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// A state from another browser's login is refused before it is used up
+	cookie := c.Cookies(oidcStateCookie)
+	setOIDCStateCookie(c, "", 0)
+	if cookie == "" || !hmac.Equal([]byte(cookie), []byte(req.State)) {
+		slog.WarnContext(c.UserContext(), "single sign-on state does not match the browser", "ip", middleware.ClientIP(c))
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Sign-in has expired, please sign in again",
+		})
+	}
+
+	identity, err := h.oidc.CompleteLogin(c.UserContext(), req.State, req.Code)
+	switch {
+	case errors.Is(err, services.ErrOIDCInvalidState):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Sign-in has expired, please sign in again",
+		})
+	case errors.Is(err, services.ErrOIDCUnavailable):
+		slog.ErrorContext(c.UserContext(), "single sign-on failed", "error", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Identity provider is unavailable",
+		})
+	case errors.Is(err, services.ErrOIDCFailed):
+		slog.WarnContext(c.UserContext(), "single sign-on failed", "ip", middleware.ClientIP(c), "error", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Single sign-on failed",
+		})
+	case err != nil:
+		slog.ErrorContext(c.UserContext(), "single sign-on failed", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to complete single sign-on",
+		})
+	}
+
+	username := identity.Username
+	if len(username) > 100 {
+		username = username[:100]
+	}
+	attempt := newLoginAttempt(c, username)
+
+	user, err := h.oidc.SignIn(identity)
+	switch {
+	case errors.Is(err, services.ErrOIDCNoAccess), errors.Is(err, services.ErrOIDCAccountDisabled):
+		attempt.FailureReason = models.LoginFailureNoAccess
+		recordLoginAttempt(c, h.loginGuard, &attempt)
+		services.LoginAttempts.WithLabelValues("failure").Inc()
+		slog.WarnContext(c.UserContext(), "single sign-on denied", "username", username, "subject", identity.Subject, "error", err)
+		message := "Your account has no access to KinterCut"
+		if errors.Is(err, services.ErrOIDCAccountDisabled) {
+			message = "Your account is disabled"
+		}
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": message,
+		})
+	case errors.Is(err, services.ErrOIDCInvalidUsername):
+		slog.WarnContext(c.UserContext(), "single sign-on without usable username", "subject", identity.Subject, "claim", h.config.OIDCUsernameClaim)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The identity provider did not send a usable username",
+		})
+	case errors.Is(err, services.ErrOIDCUsernameTaken):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": fmt.Sprintf("An account named %q already exists. Ask an owner to rename or delete it", identity.Username),
+		})
+	case err != nil:
+		slog.ErrorContext(c.UserContext(), "single sign-on failed", "username", username, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to complete single sign-on",
+		})
+	}
+
+	// The account keeps its first username if the provider's changes
+	attempt.Username = user.Username
+	attempt.Success = true
+	recordLoginAttempt(c, h.loginGuard, &attempt)
+	return h.completeLogin(c, user)
+}
+
+// completeLogin starts a session for a user who passed all login steps
+func (h *AdminHandler) completeLogin(c *fiber.Ctx, user *models.User) error {
+	services.LoginAttempts.WithLabelValues("success").Inc()
+	slog.InfoContext(c.UserContext(), "login succeeded", "username", user.Username, "ip", middleware.ClientIP(c))
+
+	pair, err := h.tokens.IssueTokens(user, middleware.ClientIP(c), truncateUserAgent(c.Get("User-Agent")))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate token",
 		})
 	}
 
-	return c.JSON(LoginResponse{
-		Token:     tokenString,
-		ExpiresAt: expiresAt.Unix(),
+	return c.JSON(newLoginResponse(user, pair))
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh
+// token. Reusing a refresh token revokes its whole session.
+func (h *AdminHandler) Refresh(c *fiber.Ctx) error {
+	var req models.RefreshRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	user, pair, err := h.tokens.Refresh(req.RefreshToken, middleware.ClientIP(c), truncateUserAgent(c.Get("User-Agent")))
+	if errors.Is(err, services.ErrInvalidRefreshToken) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid or expired refresh token",
+		})
+	}
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "token refresh failed", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to refresh token",
+		})
+	}
+
+	return c.JSON(newLoginResponse(user, pair))
+}
+
+// Logout ends the current session, revoking its refresh token and access
+// tokens
+func (h *AdminHandler) Logout(c *fiber.Ctx) error {
+	claims := middleware.CurrentClaims(c)
+	if claims == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Only sign-in sessions can log out; revoke API keys instead",
+		})
+	}
+
+	if err := h.tokens.RevokeSession(claims.UserID, claims.SessionID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log out",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Logged out",
+	})
+}
+
+// LogoutEverywhere ends all sessions of the signed-in account, on every
+// device
+func (h *AdminHandler) LogoutEverywhere(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+	if err := h.tokens.RevokeAllSessions(user.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log out",
+		})
+	}
+
+	slog.InfoContext(c.UserContext(), "logged out everywhere", "username", user.Username)
+	return c.JSON(fiber.Map{
+		"message": "Logged out of all sessions",
 	})
 }
 
-// GetMyStats returns admin-created links with statistics
+// newLoginResponse builds the response carrying a user's new tokens
+func newLoginResponse(user *models.User, pair *services.TokenPair) LoginResponse {
+	return LoginResponse{
+		Token:            pair.AccessToken,
+		ExpiresAt:        pair.AccessExpiresAt.Unix(),
+		RefreshToken:     pair.RefreshToken,
+		RefreshExpiresAt: pair.RefreshExpiresAt.Unix(),
+		Roles:            user.RoleList(),
+	}
+}
+
+// truncateUserAgent limits a User-Agent header to its column size
+func truncateUserAgent(userAgent string) string {
+	if len(userAgent) > 512 {
+		return userAgent[:512]
+	}
+	return userAgent
+}
+
+// preAuthKey derives the signing key of pre-auth tokens from the JWT secret
+func (h *AdminHandler) preAuthKey() []byte {
+	mac := hmac.New(sha256.New, []byte(h.config.JWTSecret))
+	mac.Write([]byte(preAuthAudience))
+	return mac.Sum(nil)
+}
+
+// passwordFingerprint identifies the user's current password hash in
+// pre-auth tokens without revealing it
+func (h *AdminHandler) passwordFingerprint(user *models.User) string {
+	mac := hmac.New(sha256.New, h.preAuthKey())
+	mac.Write([]byte(user.PasswordHash))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// newLoginAttempt starts the audit record of a login step
+func newLoginAttempt(c *fiber.Ctx, username string) models.LoginAttempt {
+	return models.LoginAttempt{
+		Username: username,
+		// Proxy headers are only trusted from configured proxies
+		IPAddress: middleware.ClientIP(c),
+		UserAgent: truncateUserAgent(c.Get("User-Agent")),
+		CreatedAt: time.Now(),
+	}
+}
+
+// beginLoginCheck reserves a credential check for the attempt's username
+// with guard. It answers 429 and records the attempt when the username or IP
+// address is throttled or locked out, or checks are already running;
+// otherwise the returned function must be called once the attempt has been
+// recorded.
+func beginLoginCheck(c *fiber.Ctx, guard *services.LoginGuard, attempt *models.LoginAttempt) (func(), bool, error) {
+	release, block := guard.Begin(attempt.Username)
+	if block != nil {
+		return nil, true, refuseLogin(c, guard, attempt, block)
+	}
+
+	block, err := guard.Check(attempt.Username, attempt.IPAddress)
+	if err != nil {
+		release()
+		slog.ErrorContext(c.UserContext(), "login guard check failed", "username", attempt.Username, "error", err)
+		return nil, true, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify credentials",
+		})
+	}
+	if block != nil {
+		release()
+		return nil, true, refuseLogin(c, guard, attempt, block)
+	}
+	return release, false, nil
+}
+
+// refuseLogin answers 429 for a blocked attempt and records it
+func refuseLogin(c *fiber.Ctx, guard *services.LoginGuard, attempt *models.LoginAttempt, block *services.LoginBlock) error {
+	attempt.FailureReason = block.Reason
+	recordLoginAttempt(c, guard, attempt)
+	services.LoginAttempts.WithLabelValues(block.Reason).Inc()
+	slog.WarnContext(c.UserContext(), "login refused", "username", attempt.Username, "ip", attempt.IPAddress, "reason", block.Reason)
+
+	retryAfter := int(math.Ceil(block.RetryAfter.Seconds()))
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+	message := fmt.Sprintf("Too many login attempts. Try again in %d seconds", retryAfter)
+	if block.Reason == models.LoginFailureLocked {
+		message = fmt.Sprintf("Too many failed logins. Sign-in is locked for %d minutes", int(math.Ceil(block.RetryAfter.Minutes())))
+	}
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"error": message,
+	})
+}
+
+// recordLoginAttempt stores a login attempt, which may lock out its username
+// or IP address
+func recordLoginAttempt(c *fiber.Ctx, guard *services.LoginGuard, attempt *models.LoginAttempt) {
+	if err := guard.Record(attempt); err != nil {
+		slog.ErrorContext(c.UserContext(), "failed to record login attempt", "username", attempt.Username, "error", err)
+	}
+}
+
+// GetMyStats returns the current user's links with statistics
 func (h *AdminHandler) GetMyStats(c *fiber.Ctx) error {
 	var links []models.Link
 
-	// Get admin-created links ordered by creation date
+	// Get the user's links ordered by creation date
 	err := database.DB.
-		Where("created_by_admin = ?", true).
+		Where("user_id = ?", middleware.CurrentUser(c).ID).
 		Order("created_at DESC").
 		Find(&links).Error
 	if err != nil {
@@ -120,11 +587,10 @@ func (h *AdminHandler) GetMyStats(c *fiber.Ctx) error {
 		})
 	}
 
-	// Get click counts for each link
-	for i := range links {
-		var count int64
-		database.DB.Model(&models.Click{}).Where("link_id = ?", links[i].ID).Count(&count)
-		links[i].ClickCount = count
+	if err := setClickCounts(links); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to count clicks",
+		})
 	}
 
 	return c.JSON(fiber.Map{
@@ -133,13 +599,13 @@ func (h *AdminHandler) GetMyStats(c *fiber.Ctx) error {
 	})
 }
 
-// GetUserLinks returns user-created links (not admin) for admin to manage
+// GetUserLinks returns anonymous public links for admins to manage
 func (h *AdminHandler) GetUserLinks(c *fiber.Ctx) error {
 	var links []models.Link
 
-	// Get user-created links (non-admin) ordered by creation date
+	// Get links created without an account ordered by creation date
 	err := database.DB.
-		Where("created_by_admin = ?", false).
+		Where("user_id IS NULL").
 		Order("created_at DESC").
 		Find(&links).Error
 	if err != nil {
@@ -148,11 +614,10 @@ func (h *AdminHandler) GetUserLinks(c *fiber.Ctx) error {
 		})
 	}
 
-	// Get click counts for each link
-	for i := range links {
-		var count int64
-		database.DB.Model(&models.Click{}).Where("link_id = ?", links[i].ID).Count(&count)
-		links[i].ClickCount = count
+	if err := setClickCounts(links); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to count clicks",
+		})
 	}
 
 	return c.JSON(fiber.Map{
@@ -176,47 +641,145 @@ func (h *AdminHandler) GetLinkDetails(c *fiber.Ctx) error {
 			"error": "Link not found",
 		})
 	}
+	if !canViewLink(c, &link) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You do not have access to this link",
+		})
+	}
 
-	// Get total clicks
-	var totalClicks int64
-	database.DB.Model(&models.Click{}).Where("link_id = ?", link.ID).Count(&totalClicks)
+	// Optional traffic filter: all (default), human or bot
+	traffic := c.Query("traffic", "all")
+	if traffic != "all" && traffic != "human" && traffic != "bot" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid traffic filter. Use all, human or bot",
+		})
+	}
 
-	// Get unique IPs
-	var uniqueIPs int64
-	database.DB.Model(&models.Click{}).
-		Where("link_id = ?", link.ID).
-		Distinct("ip_address").
-		Count(&uniqueIPs)
+	source := newClickSource()
+
+	// Get total and bot clicks. The human/bot split covers all traffic; the
+	// total follows the filter like the other stats.
+	var totals struct {
+		Total int64
+		Bots  int64
+	}
+	source.link(link.ID, "all").
+		Select("COALESCE(sum(clicks), 0) AS total, COALESCE(sum(clicks) FILTER (WHERE is_bot), 0) AS bots").
+		Scan(&totals)
+	totalClicks := totals.Total
+	switch traffic {
+	case "human":
+		totalClicks = totals.Total - totals.Bots
+	case "bot":
+		totalClicks = totals.Bots
+	}
+
+	// Estimate unique visitors from the daily HyperLogLog sketches
+	uniqueVisitors, err := h.uniqueVisitors.Estimate(link.ID, time.Time{}, time.Time{}, traffic)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to estimate unique visitors",
+		})
+	}
 
 	// Get top countries
 	var topCountries []models.CountryStat
-	database.DB.Model(&models.Click{}).
-		Select("country, count(*) as count").
-		Where("link_id = ?", link.ID).
+	source.link(link.ID, traffic).
+		Select("country, sum(clicks) as count").
 		Group("country").
 		Order("count DESC").
 		Limit(10).
 		Scan(&topCountries)
 
+	// Get top browsers
+	var topBrowsers []models.BrowserStat
+	source.link(link.ID, traffic).
+		Select("browser, sum(clicks) as count").
+		Group("browser").
+		Order("count DESC").
+		Limit(10).
+		Scan(&topBrowsers)
+
+	// Get top operating systems
+	var topOS []models.OSStat
+	source.link(link.ID, traffic).
+		Select("os, sum(clicks) as count").
+		Group("os").
+		Order("count DESC").
+		Limit(10).
+		Scan(&topOS)
+
+	// Get device type breakdown
+	var topDevices []models.DeviceStat
+	source.link(link.ID, traffic).
+		Select("device_type, sum(clicks) as count").
+		Group("device_type").
+		Order("count DESC").
+		Limit(10).
+		Scan(&topDevices)
+
+	// Get top referrers (empty referrer counts as direct traffic)
+	var topReferrers []models.ReferrerStat
+	source.link(link.ID, traffic).
+		Select(referrerExpr + " as referrer, sum(clicks) as count").
+		Group(referrerExpr).
+		Order("count DESC").
+		Limit(10).
+		Scan(&topReferrers)
+
 	// Get recent clicks (last 100)
 	var recentClicks []models.Click
-	database.DB.
-		Where("link_id = ?", link.ID).
+	clickQuery(link.ID, traffic).
 		Order("clicked_at DESC").
 		Limit(100).
 		Find(&recentClicks)
 
 	return c.JSON(fiber.Map{
-		"link": link,
+		"link":    link,
+		"traffic": traffic,
 		"stats": models.ClickStats{
 			TotalClicks:  totalClicks,
-			UniqueIPs:    uniqueIPs,
+			HumanClicks:  totals.Total - totals.Bots,
+			BotClicks:    totals.Bots,
+			UniqueIPs:    int64(uniqueVisitors),
 			TopCountries: topCountries,
+			TopBrowsers:  topBrowsers,
+			TopOS:        topOS,
+			TopDevices:   topDevices,
+			TopReferrers: topReferrers,
 			RecentClicks: recentClicks,
 		},
 	})
 }
 
+// clickQuery returns a query over a link's clicks filtered by traffic type
+func clickQuery(linkID uint, traffic string) *gorm.DB {
+	return filterTraffic(database.DB.Model(&models.Click{}).Where("link_id = ?", linkID), traffic)
+}
+
+// setClickCounts sets the click count of each link with one grouped query
+func setClickCounts(links []models.Link) error {
+	ids := make([]uint, len(links))
+	for i, link := range links {
+		ids[i] = link.ID
+	}
+	counts, err := newClickSource().countClicks(ids)
+	if err != nil {
+		return err
+	}
+	for i := range links {
+		links[i].ClickCount = counts[links[i].ID]
+	}
+	return nil
+}
+
+// canViewLink reports whether the current user may see a link's analytics:
+// every link with links:view, otherwise only links they own
+func canViewLink(c *fiber.Ctx, link *models.Link) bool {
+	user := middleware.CurrentUser(c)
+	return user.Can(models.PermLinksView) || (user.Can(models.PermLinksViewOwn) && user.Owns(link))
+}
+
 // DeleteLink deletes a link and its click history
 func (h *AdminHandler) DeleteLink(c *fiber.Ctx) error {
 	id := c.Params("id")
@@ -233,11 +796,29 @@ func (h *AdminHandler) DeleteLink(c *fiber.Ctx) error {
 		})
 	}
 
-	// Delete clicks first (hard delete)
-	database.DB.Unscoped().Where("link_id = ?", link.ID).Delete(&models.Click{})
+	// Editors may only delete their own links
+	user := middleware.CurrentUser(c)
+	if !user.Can(models.PermLinksDelete) && !(user.Can(models.PermLinksDeleteOwn) && user.Owns(&link)) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You can only delete your own links",
+		})
+	}
 
-	// Delete link (hard delete using Unscoped so slug can be reused)
-	if err := database.DB.Unscoped().Delete(&link).Error; err != nil {
+	// Delete clicks, rollups and visitor sketches first (hard delete)
+	database.DB.Unscoped().Where("link_id = ?", link.ID).Delete(&models.Click{})
+	database.DB.Where("link_id = ?", link.ID).Delete(&models.ClickHourlyRollup{})
+	database.DB.Where("link_id = ?", link.ID).Delete(&models.ClickDailyRollup{})
+	database.DB.Where("link_id = ?", link.ID).Delete(&models.VisitorSketch{})
+
+	// Delete link (hard delete using Unscoped so slug can be reused),
+	// queuing the webhook event with it
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Delete(&link).Error; err != nil {
+			return err
+		}
+		return h.webhooks.Emit(tx, models.WebhookLinkDeleted, fiber.Map{"link": link})
+	})
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to delete link",
 		})
@@ -248,7 +829,7 @@ func (h *AdminHandler) DeleteLink(c *fiber.Ctx) error {
 	})
 }
 
-// CreateAdminLink creates a permanent link (for admin use)
+// CreateAdminLink creates a permanent link owned by the current user
 func (h *AdminHandler) CreateAdminLink(c *fiber.Ctx) error {
 	var req models.CreateLinkRequest
 	if err := c.BodyParser(&req); err != nil {
@@ -284,14 +865,20 @@ func (h *AdminHandler) CreateAdminLink(c *fiber.Ctx) error {
 	}
 
 	link := models.Link{
-		Slug:           slug,
-		OriginalURL:    req.URL,
-		CreatedByAdmin: true,
-		CreatedAt:      time.Now(),
-		ExpiresAt:      nil, // Never expires
+		Slug:        slug,
+		OriginalURL: req.URL,
+		UserID:      &middleware.CurrentUser(c).ID,
+		CreatedAt:   time.Now(),
+		ExpiresAt:   nil, // Never expires
 	}
 
-	if err := database.DB.Create(&link).Error; err != nil {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&link).Error; err != nil {
+			return err
+		}
+		return h.webhooks.Emit(tx, models.WebhookLinkCreated, fiber.Map{"link": link})
+	})
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to create short link",
 		})
@@ -331,9 +918,63 @@ func (h *AdminHandler) GetLoginAttempts(c *fiber.Ctx) error {
 		Where("success = ? AND created_at > ?", false, time.Now().Add(-24*time.Hour)).
 		Count(&failedLast24h)
 
+	// Recent lockouts, newest first, including ones still in force
+	var lockouts []models.LoginLockout
+	err = database.DB.
+		Order("created_at DESC").
+		Limit(100).
+		Find(&lockouts).Error
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch login lockouts",
+		})
+	}
+	now := time.Now()
+	activeLockouts := 0
+	for _, lockout := range lockouts {
+		if lockout.IsActive(now) {
+			activeLockouts++
+		}
+	}
+
 	return c.JSON(fiber.Map{
 		"attempts":        attempts,
 		"total":           len(attempts),
 		"failed_last_24h": failedLast24h,
+		"lockouts":        lockouts,
+		"active_lockouts": activeLockouts,
 	})
 }
+
+// UnlockLogin lifts a login lockout before it expires
+func (h *AdminHandler) UnlockLogin(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Lockout not found",
+		})
+	}
+
+	lockout, err := h.loginGuard.Unlock(uint(id), middleware.CurrentUser(c).Username)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Lockout not found",
+		})
+	case errors.Is(err, services.ErrLockoutInactive):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Lockout has already expired or been lifted",
+		})
+	case err != nil:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to unlock",
+		})
+	}
+
+	return c.JSON(lockout)
+}
+
+// GetGeoStats returns geolocation cache and provider metrics
+func (h *AdminHandler) GetGeoStats(c *fiber.Ctx) error {
+	return c.JSON(h.geoService.Stats())
+}
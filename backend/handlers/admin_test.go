@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"link-shortener/config"
+	"link-shortener/database"
+	"link-shortener/internal/testdb"
+	"link-shortener/models"
+	"link-shortener/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// postJSON sends body as JSON to path and decodes the response into out
+func postJSON(t *testing.T, app *fiber.App, path string, body, out interface{}) int {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(fiber.MethodPost, path, bytes.NewReader(data))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+func TestLoginTwoFactorPasswordChange(t *testing.T) {
+	tests := []struct {
+		name           string
+		changePassword bool
+		wantStatus     int
+	}{
+		{"same password", false, fiber.StatusOK},
+		// A pre-auth token from before a password change no longer works
+		{"password changed", true, fiber.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testdb.Open(t, &models.User{}, &models.LoginAttempt{}, &models.LoginLockout{},
+				&models.RefreshToken{}, &models.RevokedToken{}, &models.RecoveryCode{})
+
+			if err := services.InitTwoFactorSecrets("test-secret"); err != nil {
+				t.Fatal(err)
+			}
+			secret, err := services.GenerateTOTPSecret()
+			if err != nil {
+				t.Fatal(err)
+			}
+			encrypted, err := services.EncryptTOTPSecret(secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hash, err := services.HashPassword("correct horse battery")
+			if err != nil {
+				t.Fatal(err)
+			}
+			user := models.User{Username: "alice", PasswordHash: hash, Roles: models.RoleOwner, Active: true, TOTPSecret: encrypted, TOTPEnabled: true}
+			if err := database.DB.Create(&user).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			tokens, err := services.NewTokenService("test", "jwt-secret", "", time.Minute, time.Hour, 24*time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			guard := services.NewLoginGuard(5, 20, time.Hour, time.Hour, 0, 0, 8)
+			h := NewAdminHandler(&config.Config{JWTSecret: "jwt-secret"}, nil, nil, nil, nil, guard, tokens, nil)
+
+			app := fiber.New()
+			app.Post("/login", h.Login)
+			app.Post("/login/2fa", h.LoginTwoFactor)
+
+			var challenge TwoFactorChallengeResponse
+			status := postJSON(t, app, "/login", LoginRequest{Username: "alice", Password: "correct horse battery"}, &challenge)
+			if status != fiber.StatusOK || !challenge.TwoFactorRequired {
+				t.Fatalf("login = %d %+v, want a two-factor challenge", status, challenge)
+			}
+
+			if tt.changePassword {
+				newHash, err := services.HashPassword("another long password")
+				if err != nil {
+					t.Fatal(err)
+				}
+				database.DB.Model(&user).UpdateColumn("password_hash", newHash)
+			}
+
+			code, err := services.TOTPCode(secret, services.TOTPStep(time.Now()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			status = postJSON(t, app, "/login/2fa", LoginTwoFactorRequest{PreAuthToken: challenge.PreAuthToken, Code: code}, nil)
+			if status != tt.wantStatus {
+				t.Errorf("second step = %d, want %d", status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestOIDCStateCookie(t *testing.T) {
+	testdb.Open(t, &models.OIDCLoginState{}, &models.User{}, &models.LoginAttempt{})
+
+	// A provider that can be discovered but rejects every code
+	var provider *httptest.Server
+	provider = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 provider.URL,
+			"authorization_endpoint": provider.URL + "/authorize",
+			"token_endpoint":         provider.URL + "/token",
+			"jwks_uri":               provider.URL + "/jwks",
+		})
+	}))
+	defer provider.Close()
+
+	oidcService, err := services.NewOIDCService(services.OIDCConfig{
+		IssuerURL:   provider.URL,
+		ClientID:    "kintercut",
+		RedirectURL: "https://links.example.com/adminek/sso",
+		RoleMapping: "*=viewer",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewAdminHandler(&config.Config{}, nil, nil, nil, nil, nil, nil, oidcService)
+
+	app := fiber.New()
+	app.Post("/api/admin/oidc/start", h.StartOIDCLogin)
+	app.Post("/api/admin/login/oidc", h.LoginOIDC)
+
+	start := func() (string, *http.Cookie) {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodPost, "/api/admin/oidc/start", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			State string `json:"state"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == oidcStateCookie {
+				return body.State, cookie
+			}
+		}
+		t.Fatalf("start = %d without state cookie", resp.StatusCode)
+		return "", nil
+	}
+	complete := func(state string, cookie *http.Cookie) int {
+		t.Helper()
+		data, _ := json.Marshal(OIDCLoginRequest{Code: "code", State: state})
+		req := httptest.NewRequest(fiber.MethodPost, "/api/admin/login/oidc", bytes.NewReader(data))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		if cookie != nil {
+			req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	stateExists := func(state string) bool {
+		var count int64
+		database.DB.Model(&models.OIDCLoginState{}).Where("state = ?", state).Count(&count)
+		return count > 0
+	}
+
+	state, cookie := start()
+	if cookie.Value != state || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/api/admin" {
+		t.Errorf("state cookie = %+v for state %q", cookie, state)
+	}
+
+	// Login CSRF: another browser's state is refused without using it up
+	_, otherCookie := start()
+	if status := complete(state, nil); status != fiber.StatusBadRequest {
+		t.Errorf("without cookie: status %d, want 400", status)
+	}
+	if status := complete(state, otherCookie); status != fiber.StatusBadRequest {
+		t.Errorf("cookie of another login: status %d, want 400", status)
+	}
+	if !stateExists(state) {
+		t.Fatal("refused completion used up the state")
+	}
+
+	// With its own cookie the login reaches the provider, which rejects the code
+	if status := complete(state, cookie); status != fiber.StatusUnauthorized {
+		t.Errorf("matching cookie: status %d, want 401 from the code exchange", status)
+	}
+	if stateExists(state) {
+		t.Error("state not used up")
+	}
+}
@@ -0,0 +1,458 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/models"
+	"link-shortener/services"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Maximum number of buckets a single timeseries request may return
+const maxTimeseriesBuckets = 5000
+
+// timeseriesIntervals maps interval names to their default lookback window
+var timeseriesIntervals = map[string]func(time.Time) time.Time{
+	"hour":  func(t time.Time) time.Time { return t.Add(-48 * time.Hour) },
+	"day":   func(t time.Time) time.Time { return t.AddDate(0, 0, -30) },
+	"week":  func(t time.Time) time.Time { return t.AddDate(0, 0, -7*26) },
+	"month": func(t time.Time) time.Time { return t.AddDate(-1, 0, 0) },
+}
+
+// referrerExpr buckets clicks without a referrer as direct traffic
+var referrerExpr = "COALESCE(NULLIF(referrer, ''), '" + services.DirectReferrer + "')"
+
+// timeseriesDimensions maps group_by values to SQL column expressions
+var timeseriesDimensions = map[string]string{
+	"country":  "country",
+	"device":   "device_type",
+	"browser":  "browser",
+	"os":       "os",
+	"referrer": referrerExpr,
+}
+
+// GetLinkTimeseries returns click counts per time bucket for a link
+func (h *AdminHandler) GetLinkTimeseries(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if id == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Link ID is required",
+		})
+	}
+
+	var link models.Link
+	if err := database.DB.Where("id = ?", id).First(&link).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Link not found",
+		})
+	}
+	if !canViewLink(c, &link) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You do not have access to this link",
+		})
+	}
+
+	interval := c.Query("interval", "day")
+	defaultFrom, ok := timeseriesIntervals[interval]
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid interval. Use hour, day, week or month",
+		})
+	}
+
+	// LoadLocation also accepts "" and "Local", which name no zone the
+	// database knows
+	tz := c.Query("tz", "UTC")
+	loc, err := time.LoadLocation(tz)
+	if err != nil || tz == "" || tz == "Local" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid timezone",
+		})
+	}
+
+	to := time.Now().In(loc)
+	if value := c.Query("to"); value != "" {
+		if to, err = parseRangeParam(value, loc); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid 'to' date. Use RFC 3339 or YYYY-MM-DD",
+			})
+		}
+	}
+	from := defaultFrom(to)
+	if value := c.Query("from"); value != "" {
+		if from, err = parseRangeParam(value, loc); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid 'from' date. Use RFC 3339 or YYYY-MM-DD",
+			})
+		}
+	}
+	if !from.Before(to) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "'from' must be before 'to'",
+		})
+	}
+
+	buckets := bucketRange(from, to, interval)
+	if len(buckets) > maxTimeseriesBuckets {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Date range too large for interval (max %d buckets)", maxTimeseriesBuckets),
+		})
+	}
+
+	traffic := c.Query("traffic", "all")
+	if traffic != "all" && traffic != "human" && traffic != "bot" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid traffic filter. Use all, human or bot",
+		})
+	}
+
+	groupBy := c.Query("group_by")
+	dimension := ""
+	if groupBy != "" {
+		if dimension, ok = timeseriesDimensions[groupBy]; !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid group_by. Use country, device, browser, os or referrer",
+			})
+		}
+	}
+
+	// Truncate in the requested timezone so day/week/month boundaries are local
+	bucketExpr := "date_trunc(?, clicked_at AT TIME ZONE ?) AT TIME ZONE ?"
+
+	// Daily rollups are in UTC days, so local buckets need the hourly ones
+	source := newClickSource()
+	hourly := interval == "hour" || loc != time.UTC
+
+	var points []models.TimeseriesPoint
+	query := source.query([]uint{link.ID}, traffic, from, to, hourly)
+
+	if dimension == "" {
+		err = query.
+			Select("("+bucketExpr+") AS bucket, sum(clicks) AS count", interval, tz, tz).
+			Group("bucket").
+			Order("bucket").
+			Scan(&points).Error
+	} else {
+		// Keep the series readable: top groups by volume, the rest as "other"
+		limit := c.QueryInt("limit", 10)
+		if limit < 1 || limit > 50 {
+			limit = 10
+		}
+
+		var values []sql.NullString
+		err = source.query([]uint{link.ID}, traffic, from, to, hourly).
+			Select(dimension+" AS value").
+			Group(dimension).
+			Order("sum(clicks) DESC").
+			Limit(limit).
+			Pluck("value", &values).Error
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to fetch timeseries",
+			})
+		}
+		var topGroups []string
+		for _, value := range values {
+			if value.Valid {
+				topGroups = append(topGroups, value.String)
+			}
+		}
+
+		groupExpr := "'other'"
+		args := []interface{}{interval, tz, tz}
+		if len(topGroups) > 0 {
+			groupExpr = "CASE WHEN " + dimension + " IN ? THEN " + dimension + " ELSE 'other' END"
+			args = append(args, topGroups)
+		}
+
+		err = query.
+			Select("("+bucketExpr+") AS bucket, "+groupExpr+" AS \"group\", sum(clicks) AS count", args...).
+			Group("1, 2").
+			Order("1, 3 DESC").
+			Scan(&points).Error
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch timeseries",
+		})
+	}
+
+	if dimension == "" {
+		points = fillTimeseriesGaps(points, buckets)
+	}
+	for i := range points {
+		points[i].Bucket = points[i].Bucket.In(loc)
+	}
+
+	return c.JSON(models.Timeseries{
+		LinkID:   link.ID,
+		Interval: interval,
+		Timezone: tz,
+		From:     from,
+		To:       to,
+		GroupBy:  groupBy,
+		Traffic:  traffic,
+		Points:   points,
+	})
+}
+
+// GetLinkVisitors returns estimated unique visitors of a link for a date range
+func (h *AdminHandler) GetLinkVisitors(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if id == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Link ID is required",
+		})
+	}
+
+	var link models.Link
+	if err := database.DB.Where("id = ?", id).First(&link).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Link not found",
+		})
+	}
+	if !canViewLink(c, &link) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You do not have access to this link",
+		})
+	}
+
+	// Sketches are kept per UTC day, so the range is in whole UTC days
+	var from, to time.Time
+	var err error
+	if value := c.Query("from"); value != "" {
+		if from, err = parseRangeParam(value, time.UTC); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid 'from' date. Use RFC 3339 or YYYY-MM-DD",
+			})
+		}
+	}
+	if value := c.Query("to"); value != "" {
+		if to, err = parseRangeParam(value, time.UTC); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid 'to' date. Use RFC 3339 or YYYY-MM-DD",
+			})
+		}
+	}
+
+	traffic := c.Query("traffic", "all")
+	if traffic != "all" && traffic != "human" && traffic != "bot" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid traffic filter. Use all, human or bot",
+		})
+	}
+
+	estimate, err := h.uniqueVisitors.Estimate(link.ID, from, to, traffic)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to estimate unique visitors",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"link_id":         link.ID,
+		"from":            c.Query("from"),
+		"to":              c.Query("to"),
+		"traffic":         traffic,
+		"unique_visitors": estimate,
+	})
+}
+
+// clickSource builds click queries that read rolled-up days and hours from
+// the rollup tables. The rollup watermark is read once, so all queries of a
+// request agree on where rollups end and raw clicks begin.
+type clickSource struct {
+	progress services.RollupProgress
+	rolledUp bool
+}
+
+// newClickSource reads the current rollup watermark
+func newClickSource() clickSource {
+	progress, ok := services.RollupWatermark()
+	return clickSource{progress: progress, rolledUp: ok}
+}
+
+// query returns clicks of links as rows of (link_id, clicked_at,
+// dimensions, clicks). Whole UTC days before the rollup watermark are read
+// from the daily rollups unless hourly is set, other rolled-up hours from
+// the hourly rollups and newer or late-inserted clicks from the raw table
+// with a weight of one, so aggregate with sum(clicks) rather than count(*).
+// Rolled-up data has day or hour precision. Zero from/to leave the range
+// unbounded.
+func (s clickSource) query(linkIDs []uint, traffic string, from, to time.Time, hourly bool) *gorm.DB {
+	raw := filterTraffic(database.DB.Model(&models.Click{}), traffic).
+		Select("link_id, clicked_at, country, device_type, browser, os, referrer, is_bot, 1 AS clicks").
+		Where("link_id IN ?", linkIDs)
+	hours := rollupQuery(&models.ClickHourlyRollup{}, linkIDs, traffic)
+	var days *gorm.DB
+
+	if s.rolledUp {
+		watermark := s.progress.ClickedUntil
+		if s.progress.InsertedUntil.IsZero() {
+			raw = raw.Where("clicked_at >= ?", watermark)
+		} else {
+			raw = raw.Where("clicked_at >= ? OR inserted_at >= ?", watermark, s.progress.InsertedUntil)
+		}
+		hours = hours.Where("bucket_start < ?", watermark)
+
+		// Daily rollups only cover whole UTC days inside the range
+		dayEnd := watermark
+		if !to.IsZero() && to.Before(dayEnd) {
+			dayEnd = to
+		}
+		dayEnd = dayEnd.UTC().Truncate(24 * time.Hour)
+		dayStart := from.UTC().Truncate(24 * time.Hour)
+		if dayStart.Before(from) {
+			dayStart = dayStart.Add(24 * time.Hour)
+		}
+
+		if !hourly && dayStart.Before(dayEnd) {
+			days = rollupQuery(&models.ClickDailyRollup{}, linkIDs, traffic).
+				Where("bucket_start < ?", dayEnd)
+			if from.IsZero() {
+				hours = hours.Where("bucket_start >= ?", dayEnd)
+			} else {
+				days = days.Where("bucket_start >= ?", dayStart)
+				hours = hours.Where("bucket_start < ? OR bucket_start >= ?", dayStart, dayEnd)
+			}
+		}
+	} else {
+		hours = hours.Where("1 = 0")
+	}
+
+	if !from.IsZero() {
+		raw = raw.Where("clicked_at >= ?", from)
+		hours = hours.Where("bucket_start >= ?", from)
+	}
+	if !to.IsZero() {
+		raw = raw.Where("clicked_at < ?", to)
+		hours = hours.Where("bucket_start < ?", to)
+	}
+
+	union := database.DB.Raw("? UNION ALL ?", hours, raw)
+	if days != nil {
+		union = database.DB.Raw("? UNION ALL ? UNION ALL ?", days, hours, raw)
+	}
+	return database.DB.Table("(?) AS click_source", union)
+}
+
+// link returns all clicks of one link, see query
+func (s clickSource) link(linkID uint, traffic string) *gorm.DB {
+	return s.query([]uint{linkID}, traffic, time.Time{}, time.Time{}, false)
+}
+
+// countClicks returns the total number of clicks of each link
+func (s clickSource) countClicks(linkIDs []uint) (map[uint]int64, error) {
+	counts := make(map[uint]int64, len(linkIDs))
+	if len(linkIDs) == 0 {
+		return counts, nil
+	}
+
+	var rows []struct {
+		LinkID uint
+		Count  int64
+	}
+	err := s.query(linkIDs, "all", time.Time{}, time.Time{}, false).
+		Select("link_id, sum(clicks) AS count").
+		Group("link_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		counts[row.LinkID] = row.Count
+	}
+	return counts, nil
+}
+
+// rollupQuery selects rollup rows of links in the column layout of
+// clickSource queries
+func rollupQuery(model interface{}, linkIDs []uint, traffic string) *gorm.DB {
+	return filterTraffic(database.DB.Model(model), traffic).
+		Select("link_id, bucket_start AS clicked_at, country, device_type, browser, os, referrer, is_bot, clicks").
+		Where("link_id IN ?", linkIDs)
+}
+
+// filterTraffic restricts a click or rollup query to human or bot traffic
+func filterTraffic(query *gorm.DB, traffic string) *gorm.DB {
+	switch traffic {
+	case "human":
+		return query.Where("is_bot = ?", false)
+	case "bot":
+		return query.Where("is_bot = ?", true)
+	}
+	return query
+}
+
+// parseRangeParam parses an RFC 3339 timestamp or a YYYY-MM-DD date in loc
+func parseRangeParam(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.In(loc), nil
+	}
+	return time.ParseInLocation("2006-01-02", value, loc)
+}
+
+// truncateToBucket returns the start of the bucket containing t, in t's location
+func truncateToBucket(t time.Time, interval string) time.Time {
+	y, m, d := t.Date()
+	switch interval {
+	case "hour":
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+	case "week":
+		// ISO weeks start on Monday, matching Postgres date_trunc('week')
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(y, m, d-offset, 0, 0, 0, 0, t.Location())
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// nextBucket returns the start of the bucket following start
+func nextBucket(start time.Time, interval string) time.Time {
+	switch interval {
+	case "hour":
+		return start.Add(time.Hour)
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// bucketRange lists all bucket starts between from and to
+func bucketRange(from, to time.Time, interval string) []time.Time {
+	var buckets []time.Time
+	for b := truncateToBucket(from, interval); b.Before(to); b = nextBucket(b, interval) {
+		buckets = append(buckets, b)
+		if len(buckets) > maxTimeseriesBuckets {
+			break
+		}
+	}
+	return buckets
+}
+
+// fillTimeseriesGaps adds zero-count points for buckets without clicks
+func fillTimeseriesGaps(points []models.TimeseriesPoint, buckets []time.Time) []models.TimeseriesPoint {
+	counts := make(map[int64]int64, len(points))
+	for _, p := range points {
+		counts[p.Bucket.Unix()] = p.Count
+	}
+
+	filled := make([]models.TimeseriesPoint, 0, len(buckets))
+	for _, b := range buckets {
+		filled = append(filled, models.TimeseriesPoint{
+			Bucket: b,
+			Count:  counts[b.Unix()],
+		})
+	}
+	return filled
+}
@@ -0,0 +1,400 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"link-shortener/config"
+	"link-shortener/database"
+	"link-shortener/internal/testdb"
+	"link-shortener/middleware"
+	"link-shortener/models"
+	"link-shortener/services"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// analyticsModels are the tables read by the analytics handlers
+var analyticsModels = []interface{}{
+	&models.User{}, &models.APIKey{}, &models.Link{}, &models.Click{},
+	&models.ClickHourlyRollup{}, &models.ClickDailyRollup{}, &models.RollupState{},
+}
+
+// Rollup progress of the click fixture: hours before 2026-03-02 10:00 UTC
+// are rolled up, as are clicks inserted before 10:02
+var (
+	fixtureClickedUntil  = time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+	fixtureInsertedUntil = fixtureClickedUntil.Add(2 * time.Minute)
+)
+
+// seedClicks stores six clicks of link around the rollup watermark:
+//
+//	2026-03-01 03:00 x2  rolled up, raw clicks pruned
+//	2026-03-02 09:10     rolled up, raw click kept
+//	2026-03-02 09:40     inserted after its hour was rolled up
+//	2026-03-02 10:15     after the watermark
+//	2026-03-02 11:05     after the watermark
+func seedClicks(t *testing.T, linkID uint) {
+	t.Helper()
+
+	// Names of the RollupState rows kept by services.RollupService
+	states := []models.RollupState{
+		{Name: "clicks", RolledUntil: fixtureClickedUntil},
+		{Name: "clicks_inserted", RolledUntil: fixtureInsertedUntil},
+	}
+	hourly := []models.ClickHourlyRollup{
+		{LinkID: linkID, BucketStart: time.Date(2026, 3, 1, 3, 0, 0, 0, time.UTC), Country: "Germany", Clicks: 2},
+		{LinkID: linkID, BucketStart: time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC), Country: "France", Clicks: 1},
+	}
+	daily := []models.ClickDailyRollup{
+		{LinkID: linkID, BucketStart: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), Country: "Germany", Clicks: 2},
+		// The day of the watermark is incomplete and must not be read
+		{LinkID: linkID, BucketStart: time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), Country: "France", Clicks: 1},
+	}
+	click := func(clickedAt, insertedAt time.Time, country string) models.Click {
+		return models.Click{LinkID: linkID, ClickedAt: clickedAt, InsertedAt: insertedAt, Country: country}
+	}
+	at := func(hour, min int) time.Time { return time.Date(2026, 3, 2, hour, min, 0, 0, time.UTC) }
+	clicks := []models.Click{
+		click(at(9, 10), at(9, 10), "France"),
+		click(at(9, 40), at(10, 30), "France"),
+		click(at(10, 15), at(10, 15), "Germany"),
+		click(at(11, 5), at(11, 5), "Germany"),
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		for _, rows := range []interface{}{&states, &hourly, &daily, &clicks} {
+			if err := tx.Create(rows).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newAnalyticsTest opens a database with open, stores a link with the click
+// fixture and returns an app serving the analytics handlers with an API key
+// of the link's owner
+func newAnalyticsTest(t *testing.T, open func(testing.TB, ...interface{}) *gorm.DB) (*fiber.App, string, models.Link) {
+	t.Helper()
+	open(t, analyticsModels...)
+
+	user := models.User{Username: "alice", PasswordHash: "unused", Roles: models.RoleViewer, Active: true}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	key, prefix, hash, err := services.GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKey := models.APIKey{UserID: user.ID, Name: "test", Prefix: prefix, KeyHash: hash, Scopes: models.ScopeRead}
+	if err := database.DB.Create(&apiKey).Error; err != nil {
+		t.Fatal(err)
+	}
+	link := models.Link{Slug: "stats", OriginalURL: "https://example.com", UserID: &user.ID}
+	if err := database.DB.Create(&link).Error; err != nil {
+		t.Fatal(err)
+	}
+	seedClicks(t, link.ID)
+
+	tokens, err := services.NewTokenService("test", "jwt-secret", "", time.Minute, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewAdminHandler(&config.Config{JWTSecret: "jwt-secret"}, nil, nil, nil, nil, nil, tokens, nil)
+
+	app := fiber.New()
+	app.Get("/links/:id/timeseries", middleware.AuthRequired(tokens), h.GetLinkTimeseries)
+	return app, key, link
+}
+
+// getTimeseries requests the timeseries of link with query
+func getTimeseries(t *testing.T, app *fiber.App, key string, link models.Link, query url.Values) (int, models.Timeseries) {
+	t.Helper()
+
+	req := httptest.NewRequest(fiber.MethodGet, "/links/"+strconv.FormatUint(uint64(link.ID), 10)+"/timeseries?"+query.Encode(), nil)
+	req.Header.Set(middleware.APIKeyHeader, key)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series models.Timeseries
+	if resp.StatusCode == fiber.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&series); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, series
+}
+
+func TestBucketRange(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		interval string
+		from, to time.Time
+		want     []time.Time
+	}{
+		{
+			name:     "hours",
+			interval: "hour",
+			from:     time.Date(2026, 3, 1, 10, 30, 0, 0, time.UTC),
+			to:       time.Date(2026, 3, 1, 13, 0, 0, 0, time.UTC),
+			want: []time.Time{
+				time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC),
+				time.Date(2026, 3, 1, 11, 0, 0, 0, time.UTC),
+				time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			// Local midnights across the start of daylight saving time
+			name:     "days in a timezone",
+			interval: "day",
+			from:     time.Date(2026, 3, 7, 12, 0, 0, 0, newYork),
+			to:       time.Date(2026, 3, 10, 0, 0, 0, 0, newYork),
+			want: []time.Time{
+				time.Date(2026, 3, 7, 0, 0, 0, 0, newYork),
+				time.Date(2026, 3, 8, 0, 0, 0, 0, newYork),
+				time.Date(2026, 3, 9, 0, 0, 0, 0, newYork),
+			},
+		},
+		{
+			// ISO weeks start on Monday
+			name:     "weeks",
+			interval: "week",
+			from:     time.Date(2026, 3, 4, 15, 0, 0, 0, time.UTC),
+			to:       time.Date(2026, 3, 20, 0, 0, 0, 0, time.UTC),
+			want: []time.Time{
+				time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC),
+				time.Date(2026, 3, 9, 0, 0, 0, 0, time.UTC),
+				time.Date(2026, 3, 16, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:     "months",
+			interval: "month",
+			from:     time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC),
+			to:       time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC),
+			want: []time.Time{
+				time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+				time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC),
+				time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := bucketRange(tt.from, tt.to, tt.interval)
+			if len(got) != len(tt.want) {
+				t.Fatalf("buckets = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) {
+					t.Errorf("bucket %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+
+	hours := bucketRange(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), "hour")
+	if len(hours) != maxTimeseriesBuckets+1 {
+		t.Errorf("a year of hours = %d buckets, want the limit plus one", len(hours))
+	}
+}
+
+func TestFillTimeseriesGaps(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 3, d, 0, 0, 0, 0, time.UTC) }
+	buckets := []time.Time{day(1), day(2), day(3), day(4)}
+	points := []models.TimeseriesPoint{
+		{Bucket: day(2), Count: 5},
+		// Same instant in another location
+		{Bucket: day(4).In(time.FixedZone("UTC+2", 2*60*60)), Count: 1},
+	}
+
+	got := fillTimeseriesGaps(points, buckets)
+	want := []int64{0, 5, 0, 1}
+	if len(got) != len(want) {
+		t.Fatalf("points = %+v", got)
+	}
+	for i, point := range got {
+		if !point.Bucket.Equal(buckets[i]) || point.Count != want[i] {
+			t.Errorf("point %d = %v %d, want %v %d", i, point.Bucket, point.Count, buckets[i], want[i])
+		}
+	}
+}
+
+func TestClickSourceAcrossWatermark(t *testing.T) {
+	testdb.Open(t, analyticsModels...)
+	seedClicks(t, 1)
+
+	source := newClickSource()
+	if !source.rolledUp || !source.progress.ClickedUntil.Equal(fixtureClickedUntil) {
+		t.Fatalf("click source = %+v", source)
+	}
+
+	counts, err := source.countClicks([]uint{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[1] != 6 {
+		t.Errorf("total clicks = %d, want 6", counts[1])
+	}
+
+	at := func(day, hour, min int) time.Time { return time.Date(2026, 3, day, hour, min, 0, 0, time.UTC) }
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     int64
+	}{
+		{"unbounded", time.Time{}, time.Time{}, 6},
+		{"whole days", at(1, 0, 0), at(3, 0, 0), 6},
+		{"up to the watermark", at(1, 0, 0), at(2, 10, 0), 4},
+		{"from the watermark", at(2, 10, 0), at(3, 0, 0), 2},
+		{"hour before the watermark", at(2, 9, 0), at(2, 10, 0), 2},
+		{"across the watermark", at(2, 9, 0), at(2, 10, 30), 3},
+		{"from the second day", at(2, 0, 0), time.Time{}, 4},
+	}
+	for _, tt := range tests {
+		for _, hourly := range []bool{false, true} {
+			var total int64
+			err := source.query([]uint{1}, "all", tt.from, tt.to, hourly).
+				Select("COALESCE(sum(clicks), 0)").
+				Scan(&total).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != tt.want {
+				t.Errorf("%s (hourly %v): %d clicks, want %d", tt.name, hourly, total, tt.want)
+			}
+		}
+	}
+
+	// Before the first rollup every click is raw
+	database.DB.Where("1 = 1").Delete(&models.RollupState{})
+	counts, err = newClickSource().countClicks([]uint{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[1] != 4 {
+		t.Errorf("clicks without rollups = %d, want the 4 raw clicks", counts[1])
+	}
+}
+
+func TestGetLinkTimeseriesValidation(t *testing.T) {
+	app, key, link := newAnalyticsTest(t, testdb.Open)
+
+	tests := []struct {
+		name  string
+		query url.Values
+	}{
+		{"interval", url.Values{"interval": {"minute"}}},
+		{"timezone", url.Values{"tz": {"Mars/Olympus"}}},
+		{"local timezone", url.Values{"tz": {"Local"}}},
+		{"from", url.Values{"from": {"yesterday"}}},
+		{"empty range", url.Values{"from": {"2026-03-02"}, "to": {"2026-03-02"}}},
+		{"too many buckets", url.Values{"interval": {"hour"}, "from": {"2020-01-01"}, "to": {"2026-01-01"}}},
+		{"traffic", url.Values{"traffic": {"robots"}}},
+		{"group_by", url.Values{"group_by": {"city"}}},
+	}
+	for _, tt := range tests {
+		if status, _ := getTimeseries(t, app, key, link, tt.query); status != fiber.StatusBadRequest {
+			t.Errorf("invalid %s: status %d, want 400", tt.name, status)
+		}
+	}
+}
+
+// TestGetLinkTimeseries needs Postgres for date_trunc and AT TIME ZONE
+func TestGetLinkTimeseries(t *testing.T) {
+	app, key, link := newAnalyticsTest(t, testdb.OpenPostgres)
+
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := func(day, hour int) time.Time { return time.Date(2026, 3, day, hour, 0, 0, 0, time.UTC) }
+	local := func(month time.Month, day int) time.Time { return time.Date(2026, month, day, 0, 0, 0, 0, newYork) }
+
+	type point struct {
+		bucket time.Time
+		count  int64
+	}
+	tests := []struct {
+		name  string
+		query url.Values
+		want  []point
+	}{
+		{
+			// Rolled-up and late clicks share the hour before the watermark
+			name:  "hours",
+			query: url.Values{"interval": {"hour"}, "from": {"2026-03-02T08:00:00Z"}, "to": {"2026-03-02T12:00:00Z"}},
+			want:  []point{{utc(2, 8), 0}, {utc(2, 9), 2}, {utc(2, 10), 1}, {utc(2, 11), 1}},
+		},
+		{
+			name:  "days",
+			query: url.Values{"interval": {"day"}, "from": {"2026-03-01"}, "to": {"2026-03-04"}},
+			want:  []point{{utc(1, 0), 2}, {utc(2, 0), 4}, {utc(3, 0), 0}},
+		},
+		{
+			// 03:00 UTC on March 1st is still February 28th in New York
+			name:  "days in a timezone",
+			query: url.Values{"interval": {"day"}, "tz": {"America/New_York"}, "from": {"2026-02-28"}, "to": {"2026-03-03"}},
+			want:  []point{{local(2, 28), 2}, {local(3, 1), 0}, {local(3, 2), 4}},
+		},
+		{
+			name:  "weeks",
+			query: url.Values{"interval": {"week"}, "from": {"2026-02-23"}, "to": {"2026-03-09"}},
+			want:  []point{{time.Date(2026, 2, 23, 0, 0, 0, 0, time.UTC), 2}, {utc(2, 0), 4}},
+		},
+		{
+			name:  "months",
+			query: url.Values{"interval": {"month"}, "from": {"2026-02-01"}, "to": {"2026-04-01"}},
+			want:  []point{{time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), 0}, {utc(1, 0), 6}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, series := getTimeseries(t, app, key, link, tt.query)
+			if status != fiber.StatusOK {
+				t.Fatalf("status %d", status)
+			}
+			if len(series.Points) != len(tt.want) {
+				t.Fatalf("points = %+v, want %v", series.Points, tt.want)
+			}
+			for i, p := range series.Points {
+				if !p.Bucket.Equal(tt.want[i].bucket) || p.Count != tt.want[i].count {
+					t.Errorf("point %d = %v %d, want %v %d", i, p.Bucket, p.Count, tt.want[i].bucket, tt.want[i].count)
+				}
+			}
+		})
+	}
+
+	// Totals agree however the range is bucketed
+	for _, interval := range []string{"hour", "day", "week", "month"} {
+		query := url.Values{"interval": {interval}, "from": {"2026-02-28"}, "to": {"2026-03-04"}}
+		status, series := getTimeseries(t, app, key, link, query)
+		if status != fiber.StatusOK {
+			t.Fatalf("%s: status %d", interval, status)
+		}
+		var total int64
+		for _, p := range series.Points {
+			total += p.Count
+		}
+		if total != 6 {
+			t.Errorf("%s: total = %d, want 6", interval, total)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"strings"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/middleware"
+	"link-shortener/models"
+	"link-shortener/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// APIKeyHandler handles personal API keys
+type APIKeyHandler struct{}
+
+// NewAPIKeyHandler creates a new APIKeyHandler instance
+func NewAPIKeyHandler() *APIKeyHandler {
+	return &APIKeyHandler{}
+}
+
+// ListAPIKeys returns the signed-in account's API keys. Users who manage
+// accounts can list every account's keys with ?all=true.
+func (h *APIKeyHandler) ListAPIKeys(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	query := database.DB.Order("created_at DESC")
+	if !(c.QueryBool("all") && user.Can(models.PermUsersManage)) {
+		query = query.Where("user_id = ?", user.ID)
+	}
+
+	var keys []models.APIKey
+	if err := query.Find(&keys).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch API keys",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"api_keys": keys,
+		"total":    len(keys),
+	})
+}
+
+// CreateAPIKey creates an API key for the signed-in account. The key itself
+// is only returned in this response; afterwards only its hash is stored.
+func (h *APIKeyHandler) CreateAPIKey(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	var req models.CreateAPIKeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Name must be 1-100 characters long",
+		})
+	}
+	scopes, err := services.JoinScopes(req.Scopes)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Expiry must be in the future",
+		})
+	}
+
+	key, prefix, hash, err := services.GenerateAPIKey()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate API key",
+		})
+	}
+
+	apiKey := models.APIKey{
+		UserID:    user.ID,
+		Name:      req.Name,
+		Prefix:    prefix,
+		KeyHash:   hash,
+		Scopes:    scopes,
+		ExpiresAt: req.ExpiresAt,
+	}
+	if err := database.DB.Create(&apiKey).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create API key",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(models.APIKeyCreatedResponse{
+		APIKey: apiKey,
+		Key:    key,
+	})
+}
+
+// RevokeAPIKey revokes one of the signed-in account's API keys, or any key
+// for users who manage accounts
+func (h *APIKeyHandler) RevokeAPIKey(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	var apiKey models.APIKey
+	if err := database.DB.Where("id = ?", c.Params("id")).First(&apiKey).Error; err != nil ||
+		(apiKey.UserID != user.ID && !user.Can(models.PermUsersManage)) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "API key not found",
+		})
+	}
+	if apiKey.RevokedAt != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "API key is already revoked",
+		})
+	}
+
+	now := time.Now()
+	if err := database.DB.Model(&apiKey).UpdateColumn("revoked_at", now).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke API key",
+		})
+	}
+	apiKey.RevokedAt = &now
+
+	return c.JSON(apiKey)
+}
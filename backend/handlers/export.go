@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/models"
+	"link-shortener/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ExportLinkClicks streams the raw clicks of one link
+func (h *AdminHandler) ExportLinkClicks(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if id == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Link ID is required",
+		})
+	}
+
+	var link models.Link
+	if err := database.DB.Where("id = ?", id).First(&link).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Link not found",
+		})
+	}
+	if !canViewLink(c, &link) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You do not have access to this link",
+		})
+	}
+
+	return h.exportClicks(c, &link)
+}
+
+// ExportClicks streams the raw clicks of all links
+func (h *AdminHandler) ExportClicks(c *fiber.Ctx) error {
+	return h.exportClicks(c, nil)
+}
+
+// exportClicks streams raw clicks, optionally limited to one link, in the
+// requested format. Only clicks still in the raw table are exported; clicks
+// pruned by retention survive only as rollups.
+func (h *AdminHandler) exportClicks(c *fiber.Ctx, link *models.Link) error {
+	format := c.Query("format", services.ExportFormatCSV)
+	contentType, ok := services.ExportContentTypes[format]
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid format. Use csv, ndjson or parquet",
+		})
+	}
+
+	columns, err := services.ParseExportColumns(c.Query("columns"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid columns: " + err.Error(),
+		})
+	}
+
+	var from, to time.Time
+	if value := c.Query("from"); value != "" {
+		if from, err = parseRangeParam(value, time.UTC); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid 'from' date. Use RFC 3339 or YYYY-MM-DD",
+			})
+		}
+	}
+	if value := c.Query("to"); value != "" {
+		if to, err = parseRangeParam(value, time.UTC); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid 'to' date. Use RFC 3339 or YYYY-MM-DD",
+			})
+		}
+	}
+
+	traffic := c.Query("traffic", "all")
+	if traffic != "all" && traffic != "human" && traffic != "bot" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid traffic filter. Use all, human or bot",
+		})
+	}
+
+	query := database.DB.Table("clicks").
+		Joins("LEFT JOIN links ON links.id = clicks.link_id").
+		Order("clicks.clicked_at, clicks.id")
+	name := "all"
+	if link != nil {
+		query = query.Where("clicks.link_id = ?", link.ID)
+		name = link.Slug
+	}
+	if !from.IsZero() {
+		query = query.Where("clicks.clicked_at >= ?", from)
+	}
+	if !to.IsZero() {
+		query = query.Where("clicks.clicked_at < ?", to)
+	}
+	switch traffic {
+	case "human":
+		query = query.Where("clicks.is_bot = ?", false)
+	case "bot":
+		query = query.Where("clicks.is_bot = ?", true)
+	}
+
+	filename := fmt.Sprintf("clicks-%s-%s.%s", name, time.Now().UTC().Format("20060102"), format)
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+
+	// The body is written after the handler returns, reading the cursor as
+	// the client consumes the response
+	ctx := c.UserContext()
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := services.ExportClicks(w, format, columns, query); err != nil {
+			slog.ErrorContext(ctx, "click export failed", "error", err)
+		}
+		w.Flush()
+	})
+	return nil
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"link-shortener/config"
+	"link-shortener/database"
+	"link-shortener/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Readiness check states
+const (
+	checkOK       = "ok"
+	checkDegraded = "degraded"
+	checkFail     = "fail"
+)
+
+// healthCheck is the result of one readiness check. Only failing critical
+// checks make the node unready; degraded checks are informational.
+type healthCheck struct {
+	Status     string      `json:"status"`
+	Critical   bool        `json:"critical"`
+	DurationMs float64     `json:"duration_ms,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Details    interface{} `json:"details,omitempty"`
+}
+
+// HealthHandler serves liveness and readiness probes
+type HealthHandler struct {
+	config       *config.Config
+	geoService   *services.GeoService
+	clickBacklog func() int64
+	draining     atomic.Bool
+}
+
+// NewHealthHandler creates a new HealthHandler instance. clickBacklog
+// returns the number of clicks waiting to be stored.
+func NewHealthHandler(cfg *config.Config, geoService *services.GeoService, clickBacklog func() int64) *HealthHandler {
+	return &HealthHandler{
+		config:       cfg,
+		geoService:   geoService,
+		clickBacklog: clickBacklog,
+	}
+}
+
+// StartDraining makes readiness fail so load balancers stop sending traffic
+// before the server shuts down
+func (h *HealthHandler) StartDraining() {
+	h.draining.Store(true)
+}
+
+// Livez reports that the process is up and serving requests
+func (h *HealthHandler) Livez(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status": "ok",
+		"name":   "KinterCut API",
+	})
+}
+
+// Readyz reports whether the node can serve traffic, with per-check details
+func (h *HealthHandler) Readyz(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), h.config.ReadinessTimeout)
+	defer cancel()
+
+	checks := map[string]healthCheck{
+		"shutdown":      h.checkShutdown(),
+		"database":      timedCheck(func() error { return database.Ping(ctx) }),
+		"migrations":    timedCheck(func() error { return database.CheckMigrations(ctx) }),
+		"click_backlog": h.checkClickBacklog(),
+		"geo":           h.checkGeo(),
+	}
+
+	ready := true
+	for _, check := range checks {
+		if check.Critical && check.Status == checkFail {
+			ready = false
+		}
+	}
+
+	status, code := "ready", fiber.StatusOK
+	if !ready {
+		status, code = "not_ready", fiber.StatusServiceUnavailable
+	}
+	return c.Status(code).JSON(fiber.Map{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+// checkShutdown fails once graceful shutdown has started
+func (h *HealthHandler) checkShutdown() healthCheck {
+	if h.draining.Load() {
+		return healthCheck{Status: checkFail, Critical: true, Error: "shutting down"}
+	}
+	return healthCheck{Status: checkOK, Critical: true}
+}
+
+// checkClickBacklog fails when too many clicks are waiting to be stored
+func (h *HealthHandler) checkClickBacklog() healthCheck {
+	backlog := h.clickBacklog()
+	check := healthCheck{
+		Status:   checkOK,
+		Critical: true,
+		Details: fiber.Map{
+			"pending": backlog,
+			"max":     h.config.ReadinessMaxClickBacklog,
+		},
+	}
+	if h.config.ReadinessMaxClickBacklog > 0 && backlog > int64(h.config.ReadinessMaxClickBacklog) {
+		check.Status = checkFail
+		check.Error = "click tracking backlog too large"
+	}
+	return check
+}
+
+// checkGeo reports unavailable geolocation providers. Lookups fall back to
+// "Unknown", so this never makes the node unready.
+func (h *HealthHandler) checkGeo() healthCheck {
+	providers := h.geoService.Health()
+	check := healthCheck{Status: checkOK, Details: providers}
+	for _, provider := range providers {
+		if !provider.Healthy {
+			check.Status = checkDegraded
+			check.Error = provider.Name + ": " + provider.Error
+			break
+		}
+	}
+	return check
+}
+
+// timedCheck runs a critical check and records how long it took
+func timedCheck(fn func() error) healthCheck {
+	start := time.Now()
+	err := fn()
+	check := healthCheck{
+		Status:     checkOK,
+		Critical:   true,
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		check.Status = checkFail
+		check.Error = err.Error()
+	}
+	return check
+}
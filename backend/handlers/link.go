@@ -1,19 +1,28 @@
 package handlers
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"log/slog"
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"link-shortener/config"
 	"link-shortener/database"
+	"link-shortener/middleware"
 	"link-shortener/models"
 	"link-shortener/services"
 
 	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
 )
 
 // Reserved slugs that cannot be used by users
@@ -25,6 +34,9 @@ var reservedSlugs = map[string]bool{
 	"api":     true,
 	"health":  true,
 	"expired": true,
+	"metrics": true,
+	"livez":   true,
+	"readyz":  true,
 }
 
 // Slug validation regex (alphanumeric, hyphens, underscores)
@@ -32,15 +44,27 @@ var slugRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
 
 // LinkHandler handles link-related HTTP requests
 type LinkHandler struct {
-	config     *config.Config
-	geoService *services.GeoService
+	config         *config.Config
+	geo            services.Geolocator
+	ipAnonymizer   *services.IPAnonymizer
+	uniqueVisitors *services.UniqueVisitorService
+	clickBroker    *services.ClickBroker
+	webhooks       *services.WebhookService
+	// pendingClicks counts clicks being tracked in the background;
+	// clickTracking lets shutdown wait for them
+	pendingClicks atomic.Int64
+	clickTracking sync.WaitGroup
 }
 
 // NewLinkHandler creates a new LinkHandler instance
-func NewLinkHandler(cfg *config.Config, geoService *services.GeoService) *LinkHandler {
+func NewLinkHandler(cfg *config.Config, geo services.Geolocator, ipAnonymizer *services.IPAnonymizer, uniqueVisitors *services.UniqueVisitorService, clickBroker *services.ClickBroker, webhooks *services.WebhookService) *LinkHandler {
 	return &LinkHandler{
-		config:     cfg,
-		geoService: geoService,
+		config:         cfg,
+		geo:            geo,
+		ipAnonymizer:   ipAnonymizer,
+		uniqueVisitors: uniqueVisitors,
+		clickBroker:    clickBroker,
+		webhooks:       webhooks,
 	}
 }
 
@@ -68,16 +92,21 @@ func (h *LinkHandler) ShortenLink(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check if admin is creating the link
-	isAdmin := c.Locals("isAdmin")
-	createdByAdmin := isAdmin != nil && isAdmin.(bool)
+	// Links of signed-in editors are owned by them and never expire
+	user := middleware.CurrentUser(c)
+	if user != nil && user.APIKeyScopes != nil && !user.Can(models.PermLinksCreate) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "API key lacks the create scope",
+		})
+	}
+	signedIn := user != nil && user.Can(models.PermLinksCreate)
 
 	var slug string
 
 	// Handle custom slug if provided
 	if req.CustomSlug != "" {
 		customSlug := strings.ToLower(strings.TrimSpace(req.CustomSlug))
-		
+
 		// Validate custom slug format
 		if len(customSlug) < 3 || len(customSlug) > 30 {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -91,8 +120,8 @@ func (h *LinkHandler) ShortenLink(c *fiber.Ctx) error {
 			})
 		}
 
-		// Check if slug is reserved (only admin can use reserved slugs)
-		if reservedSlugs[customSlug] && !createdByAdmin {
+		// Check if slug is reserved (only signed-in users can use reserved slugs)
+		if reservedSlugs[customSlug] && !signedIn {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"error": "This slug is reserved",
 			})
@@ -120,20 +149,27 @@ func (h *LinkHandler) ShortenLink(c *fiber.Ctx) error {
 
 	// Create link
 	link := models.Link{
-		Slug:           slug,
-		OriginalURL:    req.URL,
-		CreatedByAdmin: createdByAdmin,
-		CreatedAt:      time.Now(),
+		Slug:        slug,
+		OriginalURL: req.URL,
+		CreatedAt:   time.Now(),
 	}
 
-	// Set expiration for non-admin links
-	if !createdByAdmin {
+	// Set expiration for anonymous links
+	if signedIn {
+		link.UserID = &user.ID
+	} else {
 		expiresAt := time.Now().Add(h.config.PublicLinkTTL)
 		link.ExpiresAt = &expiresAt
 	}
 
-	// Save to database
-	if err := database.DB.Create(&link).Error; err != nil {
+	// Save to database, queuing the webhook event with it
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&link).Error; err != nil {
+			return err
+		}
+		return h.webhooks.Emit(tx, models.WebhookLinkCreated, fiber.Map{"link": link})
+	})
+	if err != nil {
 		if strings.Contains(err.Error(), "duplicate") {
 			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
 				"error": "This slug is already taken",
@@ -153,7 +189,7 @@ func (h *LinkHandler) ShortenLink(c *fiber.Ctx) error {
 		Slug:        link.Slug,
 		OriginalURL: link.OriginalURL,
 		ExpiresAt:   link.ExpiresAt,
-		Permanent:   createdByAdmin,
+		Permanent:   signedIn,
 	})
 }
 
@@ -168,7 +204,8 @@ func (h *LinkHandler) RedirectLink(c *fiber.Ctx) error {
 
 	// Find link
 	var link models.Link
-	if err := database.DB.Where("slug = ?", slug).First(&link).Error; err != nil {
+	if err := database.DB.WithContext(c.UserContext()).Where("slug = ?", slug).First(&link).Error; err != nil {
+		services.Redirects.WithLabelValues("not_found").Inc()
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "Link not found",
 		})
@@ -176,50 +213,198 @@ func (h *LinkHandler) RedirectLink(c *fiber.Ctx) error {
 
 	// Check if link is expired
 	if link.IsExpired() {
+		services.Redirects.WithLabelValues("expired").Inc()
 		return c.Redirect("/expired", fiber.StatusTemporaryRedirect)
 	}
 
 	// IMPORTANT: Extract all data from context BEFORE spawning goroutine
 	// Fiber contexts are pooled and will be reused after the request completes
-	ip := c.IP()
-	if forwardedFor := c.Get("X-Forwarded-For"); forwardedFor != "" {
-		ips := strings.Split(forwardedFor, ",")
-		ip = strings.TrimSpace(ips[0])
-	}
+	ip := middleware.ClientIP(c)
 	userAgent := c.Get("User-Agent")
 	if len(userAgent) > 512 {
 		userAgent = userAgent[:512]
 	}
 
+	purpose := c.Get("Sec-Purpose")
+	if purpose == "" {
+		purpose = c.Get("Purpose")
+	}
+	if purpose == "" {
+		purpose = c.Get("X-Purpose")
+	}
+
+	// Do-Not-Track and Global Privacy Control opt out of personal data storage
+	optOut := h.config.HonorDoNotTrack && (c.Get("DNT") == "1" || c.Get("Sec-GPC") == "1")
+
+	event := clickEvent{
+		linkID:    link.ID,
+		ip:        ip,
+		referer:   c.Get("Referer"),
+		optOut:    optOut,
+		parent:    trace.SpanContextFromContext(c.UserContext()),
+		requestID: services.RequestIDFromContext(c.UserContext()),
+		request: services.ClickRequest{
+			Method:         c.Method(),
+			UserAgent:      userAgent,
+			Accept:         c.Get("Accept"),
+			AcceptLanguage: c.Get("Accept-Language"),
+			Purpose:        purpose,
+		},
+	}
+
 	// Track click asynchronously with extracted data
-	go h.trackClick(link.ID, ip, userAgent)
+	h.pendingClicks.Add(1)
+	h.clickTracking.Add(1)
+	go func() {
+		defer h.clickTracking.Done()
+		defer h.pendingClicks.Add(-1)
+
+		// The redirect span has usually ended by now, so the click gets a
+		// trace of its own that links back to the originating request. Logs
+		// keep the request ID.
+		ctx := services.WithRequestID(context.Background(), event.requestID)
+		ctx, span := services.Tracer.Start(ctx, "click.track",
+			trace.WithLinks(trace.Link{SpanContext: event.parent}),
+			trace.WithAttributes(attribute.Int("link.id", int(event.linkID))),
+		)
+		defer span.End()
+		h.trackClick(ctx, event)
+	}()
 
 	// Redirect to original URL
+	services.Redirects.WithLabelValues("redirected").Inc()
 	return c.Redirect(link.OriginalURL, fiber.StatusTemporaryRedirect)
 }
 
+// ClickBacklog returns the number of clicks still being tracked
+func (h *LinkHandler) ClickBacklog() int64 {
+	return h.pendingClicks.Load()
+}
+
+// WaitForClicks waits up to timeout for clicks being tracked in the
+// background and reports whether all of them finished. Call it once the
+// server no longer accepts requests.
+func (h *LinkHandler) WaitForClicks(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		h.clickTracking.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// clickEvent holds request data copied out of the Fiber context for async tracking
+type clickEvent struct {
+	linkID    uint
+	ip        string
+	referer   string
+	optOut    bool
+	parent    trace.SpanContext
+	requestID string
+	request   services.ClickRequest
+}
+
 // trackClick records click analytics asynchronously
-func (h *LinkHandler) trackClick(linkID uint, ip string, userAgent string) {
+func (h *LinkHandler) trackClick(ctx context.Context, event clickEvent) {
+	linkID := event.linkID
+	db := database.DB.WithContext(ctx)
+
 	// Get geolocation
-	geo, _ := h.geoService.GetLocation(ip)
+	geo, _ := h.geo.GetLocation(ctx, event.ip)
+
+	// Classify crawlers, link checkers and scanners
+	isBot, botReason := services.ClassifyClick(event.request)
+
+	// Parse browser, OS and device from the User-Agent
+	ua := services.ParseUserAgent(event.request.UserAgent)
+	if isBot {
+		ua.DeviceType = services.DeviceBot
+	}
+
+	// Keep only the referrer host unless full URLs are enabled
+	var referrerURL string
+	if h.config.StoreFullReferrer {
+		referrerURL = event.referer
+		if len(referrerURL) > 2048 {
+			referrerURL = referrerURL[:2048]
+		}
+	}
+
+	now := time.Now()
 
 	click := models.Click{
-		LinkID:    linkID,
-		ClickedAt: time.Now(),
-		IPAddress: ip,
-		UserAgent: userAgent,
-		Country:   geo.Country,
-		City:      geo.City,
-		Region:    geo.Region,
+		LinkID:         linkID,
+		ClickedAt:      now,
+		IPAddress:      h.ipAnonymizer.Anonymize(event.ip, now),
+		UserAgent:      event.request.UserAgent,
+		Browser:        ua.Browser,
+		BrowserVersion: ua.BrowserVersion,
+		OS:             ua.OS,
+		OSVersion:      ua.OSVersion,
+		DeviceType:     ua.DeviceType,
+		Country:        geo.Country,
+		CountryCode:    geo.CountryCode,
+		City:           geo.City,
+		Region:         geo.Region,
+		ASN:            geo.ASN,
+		ASOrganization: geo.ASOrganization,
+		Latitude:       geo.Latitude,
+		Longitude:      geo.Longitude,
+		Referrer:       services.NormalizeReferrer(event.referer),
+		ReferrerURL:    referrerURL,
+		IsBot:          isBot,
+		BotReason:      botReason,
 	}
 
-	if err := database.DB.Create(&click).Error; err != nil {
+	// Opted-out visitors are counted with coarse, non-identifying data only
+	if event.optOut {
+		click.IPAddress = ""
+		click.UserAgent = ""
+		click.ReferrerURL = ""
+		click.City = ""
+		click.Region = ""
+		click.ASN = 0
+		click.ASOrganization = ""
+		click.Latitude = nil
+		click.Longitude = nil
+	}
+
+	// Queue webhook click events with the click
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&click).Error; err != nil {
+			return err
+		}
+		return h.webhooks.EmitClick(tx, click)
+	})
+	if err != nil {
 		// Log error but don't fail - click tracking is best-effort
-		println("Error tracking click:", err.Error())
+		slog.ErrorContext(ctx, "failed to track click", "link_id", linkID, "error", err)
+		trace.SpanFromContext(ctx).SetStatus(codes.Error, err.Error())
+		services.ClicksDropped.WithLabelValues("db_error").Inc()
+		return
 	}
 
+	if isBot {
+		services.ClicksTracked.WithLabelValues("bot").Inc()
+	} else {
+		services.ClicksTracked.WithLabelValues("human").Inc()
+	}
+
+	// Count unique visitors by the stored IP, as the sketch backfill does.
+	// Opted-out clicks have none and are not counted.
+	h.uniqueVisitors.Add(linkID, now, isBot, services.VisitorKey(click.IPAddress, click.UserAgent))
+
+	// Publish to live click stream subscribers
+	h.clickBroker.Publish(click)
+
 	// Also update click count on the link
-	database.DB.Model(&models.Link{}).Where("id = ?", linkID).UpdateColumn("click_count", database.DB.Raw("click_count + 1"))
+	db.Model(&models.Link{}).Where("id = ?", linkID).UpdateColumn("click_count", database.DB.Raw("click_count + 1"))
 }
 
 // generateSlug creates a unique 7-character slug
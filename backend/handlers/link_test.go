@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"link-shortener/config"
+	"link-shortener/database"
+	"link-shortener/internal/testdb"
+	"link-shortener/middleware"
+	"link-shortener/models"
+	"link-shortener/services"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeGeolocator answers every lookup with the same location
+type fakeGeolocator struct {
+	location services.GeoLocation
+}
+
+func (g fakeGeolocator) GetLocation(ctx context.Context, ip string) (*services.GeoLocation, error) {
+	location := g.location
+	return &location, nil
+}
+
+// otlpCollector records the spans exported to it over OTLP/HTTP
+type otlpCollector struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil || r.URL.Path != "/v1/traces" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	var req coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	for _, resource := range req.ResourceSpans {
+		for _, scope := range resource.ScopeSpans {
+			c.spans = append(c.spans, scope.Spans...)
+		}
+	}
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	out, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Write(out)
+}
+
+// find returns the spans named name
+func (c *otlpCollector) find(name string) []*tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var found []*tracepb.Span
+	for _, span := range c.spans {
+		if span.Name == name {
+			found = append(found, span)
+		}
+	}
+	return found
+}
+
+// Tracers keep delegating to the first global tracer provider, so all
+// tests export to one collector
+var (
+	tracingOnce sync.Once
+	collector   = &otlpCollector{}
+)
+
+// startTracing exports spans to the test collector and clears the spans
+// of earlier tests
+func startTracing(t *testing.T) {
+	t.Helper()
+
+	var err error
+	tracingOnce.Do(func() {
+		server := httptest.NewServer(collector)
+		_, err = services.InitTracing(context.Background(), server.URL, "link-shortener-test", 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collector.mu.Lock()
+	collector.spans = nil
+	collector.mu.Unlock()
+}
+
+// flushTraces exports all ended spans to the test collector
+func flushTraces(t *testing.T) {
+	t.Helper()
+
+	provider, ok := otel.GetTracerProvider().(*sdktrace.TracerProvider)
+	if !ok {
+		t.Fatal("tracing is not set up")
+	}
+	if err := provider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedirectTracing(t *testing.T) {
+	startTracing(t)
+
+	testdb.Open(t, &models.Link{}, &models.Click{}, &models.WebhookQueuedClick{})
+	if err := database.EnableTracing(); err != nil {
+		t.Fatal(err)
+	}
+	link := models.Link{Slug: "traced", OriginalURL: "https://example.com/"}
+	if err := database.DB.Create(&link).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	anonymizer, err := services.NewIPAnonymizer(services.PrivacyModeOff, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewLinkHandler(&config.Config{}, fakeGeolocator{services.GeoLocation{Country: "Poland", CountryCode: "PL"}},
+		anonymizer, services.NewUniqueVisitorService(time.Hour), services.NewClickBroker(1, 1),
+		services.NewWebhookService(time.Hour, time.Second, 1, false))
+
+	app := fiber.New()
+	app.Use(middleware.Tracing())
+	app.Get("/:slug", h.RedirectLink)
+
+	// The request continues the caller's trace
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/traced", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusTemporaryRedirect {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, fiber.StatusTemporaryRedirect)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.ClickBacklog() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("click was not tracked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	flushTraces(t)
+
+	requestSpans := collector.find("GET /:slug")
+	if len(requestSpans) != 1 {
+		t.Fatalf("got %d request spans, want 1", len(requestSpans))
+	}
+	request := requestSpans[0]
+	if got := hex.EncodeToString(request.TraceId); got != traceID {
+		t.Errorf("request span trace = %s, want %s", got, traceID)
+	}
+
+	trackSpans := collector.find("click.track")
+	if len(trackSpans) != 1 {
+		t.Fatalf("got %d click.track spans, want 1", len(trackSpans))
+	}
+	track := trackSpans[0]
+	if bytes.Equal(track.TraceId, request.TraceId) {
+		t.Error("click.track span should start a trace of its own")
+	}
+	if len(track.Links) != 1 || !bytes.Equal(track.Links[0].TraceId, request.TraceId) || !bytes.Equal(track.Links[0].SpanId, request.SpanId) {
+		t.Errorf("click.track links = %v, want a link to the request span", track.Links)
+	}
+
+	// Queries run under the span of the work that issued them
+	childOf := func(name string, parent *tracepb.Span) {
+		t.Helper()
+		for _, span := range collector.find(name) {
+			if bytes.Equal(span.TraceId, parent.TraceId) && bytes.Equal(span.ParentSpanId, parent.SpanId) {
+				if attributeValue(span, "db.query.text") == "" {
+					t.Errorf("%s span has no query text", name)
+				}
+				return
+			}
+		}
+		t.Errorf("no %s span under %s", name, parent.Name)
+	}
+	childOf("db.query", request)
+	childOf("db.create", track)
+	childOf("db.update", track)
+}
+
+// attributeValue returns a span's string attribute
+func attributeValue(span *tracepb.Span, key string) string {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			return attr.Value.GetStringValue()
+		}
+	}
+	return ""
+}
+
+func TestWaitForClicks(t *testing.T) {
+	h := &LinkHandler{}
+	if !h.WaitForClicks(time.Millisecond) {
+		t.Fatal("WaitForClicks without clicks = false")
+	}
+
+	release := make(chan struct{})
+	h.clickTracking.Add(1)
+	go func() {
+		defer h.clickTracking.Done()
+		<-release
+	}()
+
+	if h.WaitForClicks(10 * time.Millisecond) {
+		t.Fatal("WaitForClicks returned before the click was tracked")
+	}
+	close(release)
+	if !h.WaitForClicks(time.Second) {
+		t.Fatal("WaitForClicks timed out after the click was tracked")
+	}
+}
@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/middleware"
+	"link-shortener/models"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Write timeout for a single WebSocket message
+const streamWriteTimeout = 10 * time.Second
+
+// Locals keys passing the authorized filter and the authorization check to
+// the WebSocket handler
+const (
+	streamLinkIDsKey    = "streamLinkIDs"
+	streamTrafficKey    = "streamTraffic"
+	streamAuthorizedKey = "streamAuthorized"
+)
+
+// CreateStreamTicket issues a single-use ticket for opening a click stream
+// from a browser, which cannot send the access token in a header on
+// EventSource and WebSocket connections. API keys are sent in the
+// X-API-Key header instead.
+func (h *AdminHandler) CreateStreamTicket(c *fiber.Ctx) error {
+	claims := middleware.CurrentClaims(c)
+	if claims == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Stream tickets are issued for sign-in sessions; send API keys in the " + middleware.APIKeyHeader + " header",
+		})
+	}
+
+	ticket, expiresAt, err := h.tokens.IssueStreamTicket(claims.UserID, claims.SessionID, claims.ID)
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "stream ticket creation failed", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create stream ticket",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"ticket":     ticket,
+		"expires_at": expiresAt,
+	})
+}
+
+// StreamClicks publishes tracked clicks as Server-Sent Events. Clicks can be
+// filtered with link_id (comma-separated IDs) and traffic. A comment line is
+// sent every heartbeat interval; a subscriber that falls behind receives a
+// "dropped" event and the stream ends. Users who may not view every link
+// only receive clicks on their own links. Authorization is checked again
+// with every heartbeat; once it is revoked, a "revoked" event ends the
+// stream.
+func (h *AdminHandler) StreamClicks(c *fiber.Ctx) error {
+	linkIDs, traffic, ferr := clickStreamFilter(c)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	sub, err := h.clickBroker.Subscribe(linkIDs, traffic)
+	if err != nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Too many click stream subscribers",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	heartbeat := h.config.ClickStreamHeartbeat
+	authorized := middleware.StillAuthorized(c)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer h.clickBroker.Unsubscribe(sub)
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+
+		// Tell the client how long to wait before reconnecting
+		fmt.Fprintf(w, "retry: %d\n\n", heartbeat.Milliseconds())
+		if w.Flush() != nil {
+			return
+		}
+
+		for {
+			select {
+			case click, ok := <-sub.Events:
+				if !ok {
+					if sub.Dropped() {
+						fmt.Fprint(w, "event: dropped\ndata: {\"reason\":\"slow consumer\"}\n\n")
+						w.Flush()
+					}
+					return
+				}
+				data, err := json.Marshal(click)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "id: %d\nevent: click\ndata: %s\n\n", click.ID, data)
+			case <-ticker.C:
+				if !authorized() {
+					fmt.Fprint(w, "event: revoked\ndata: {\"reason\":\"authorization revoked\"}\n\n")
+					w.Flush()
+					return
+				}
+				fmt.Fprint(w, ": heartbeat\n\n")
+			}
+			// A failed flush means the client went away
+			if w.Flush() != nil {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// UpgradeClickStream only lets WebSocket upgrade requests with a valid
+// filter through, so filter errors are reported before the upgrade
+func (h *AdminHandler) UpgradeClickStream(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+
+	linkIDs, traffic, ferr := clickStreamFilter(c)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+	c.Locals(streamLinkIDsKey, linkIDs)
+	c.Locals(streamTrafficKey, traffic)
+	c.Locals(streamAuthorizedKey, middleware.StillAuthorized(c))
+
+	return c.Next()
+}
+
+// StreamClicksWebSocket publishes tracked clicks over a WebSocket as JSON
+// messages of the form {"type": "click", "click": {...}}, with the same
+// filters as StreamClicks and ping frames as heartbeats. The connection is
+// closed with a policy violation once authorization is revoked.
+func (h *AdminHandler) StreamClicksWebSocket(conn *websocket.Conn) {
+	linkIDs, _ := conn.Locals(streamLinkIDsKey).([]uint)
+	traffic, _ := conn.Locals(streamTrafficKey).(string)
+	authorized, _ := conn.Locals(streamAuthorizedKey).(func() bool)
+
+	sub, err := h.clickBroker.Subscribe(linkIDs, traffic)
+	if err != nil {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too many subscribers"),
+			time.Now().Add(streamWriteTimeout))
+		return
+	}
+	defer h.clickBroker.Unsubscribe(sub)
+
+	// Read (and discard) client messages so close frames are noticed
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(h.config.ClickStreamHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-closed:
+			return
+		case click, ok := <-sub.Events:
+			if !ok {
+				reason := "server shutting down"
+				if sub.Dropped() {
+					conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+					conn.WriteJSON(fiber.Map{"type": "dropped", "reason": "slow consumer"})
+					reason = "slow consumer"
+				}
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, reason),
+					time.Now().Add(streamWriteTimeout))
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			err = conn.WriteJSON(fiber.Map{"type": "click", "click": click})
+		case <-ticker.C:
+			if authorized == nil || !authorized() {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "authorization revoked"),
+					time.Now().Add(streamWriteTimeout))
+				return
+			}
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// clickStreamFilter parses a click stream's filter and limits it to the
+// links the current user may see
+func clickStreamFilter(c *fiber.Ctx) ([]uint, string, *fiber.Error) {
+	linkIDs, traffic, err := parseStreamFilter(c.Query)
+	if err != nil {
+		return nil, "", fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	user := middleware.CurrentUser(c)
+	if user.Can(models.PermLinksView) {
+		return linkIDs, traffic, nil
+	}
+
+	// Without links:view, stream only the user's own links
+	var owned []uint
+	query := database.DB.Model(&models.Link{}).Where("user_id = ?", user.ID)
+	if len(linkIDs) > 0 {
+		query = query.Where("id IN ?", linkIDs)
+	}
+	if err := query.Pluck("id", &owned).Error; err != nil {
+		return nil, "", fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch links")
+	}
+	if len(linkIDs) > 0 && len(owned) < len(linkIDs) {
+		return nil, "", fiber.NewError(fiber.StatusForbidden, "You do not have access to all requested links")
+	}
+	if len(owned) == 0 {
+		return nil, "", fiber.NewError(fiber.StatusForbidden, "You have no links to stream")
+	}
+	return owned, traffic, nil
+}
+
+// parseStreamFilter reads the link_id and traffic filters of a click stream
+func parseStreamFilter(query func(string, ...string) string) ([]uint, string, error) {
+	var linkIDs []uint
+	if value := query("link_id"); value != "" {
+		for _, part := range strings.Split(value, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(part), 10, 64)
+			if err != nil || id == 0 {
+				return nil, "", errors.New("Invalid link_id. Use comma-separated link IDs")
+			}
+			if !slices.Contains(linkIDs, uint(id)) {
+				linkIDs = append(linkIDs, uint(id))
+			}
+		}
+	}
+
+	traffic := query("traffic", "all")
+	if traffic != "all" && traffic != "human" && traffic != "bot" {
+		return nil, "", errors.New("Invalid traffic filter. Use all, human or bot")
+	}
+
+	return linkIDs, traffic, nil
+}
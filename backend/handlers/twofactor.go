@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"log/slog"
+
+	"link-shortener/database"
+	"link-shortener/middleware"
+	"link-shortener/models"
+	"link-shortener/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/skip2/go-qrcode"
+	"gorm.io/gorm"
+)
+
+// TwoFactorHandler handles TOTP enrolment of the signed-in account
+type TwoFactorHandler struct {
+	issuer     string
+	tokens     *services.TokenService
+	loginGuard *services.LoginGuard
+}
+
+// NewTwoFactorHandler creates a new TwoFactorHandler instance. issuer names
+// the service in authenticator apps; tokens signs out the other sessions
+// when two-factor authentication is turned off. Passwords and codes are
+// checked through loginGuard like logins, so a stolen session cannot be used
+// to guess them.
+func NewTwoFactorHandler(issuer string, tokens *services.TokenService, loginGuard *services.LoginGuard) *TwoFactorHandler {
+	return &TwoFactorHandler{issuer: issuer, tokens: tokens, loginGuard: loginGuard}
+}
+
+// GetTwoFactorStatus reports whether two-factor authentication is enabled
+// and how many recovery codes are left
+func (h *TwoFactorHandler) GetTwoFactorStatus(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	remaining, err := services.RemainingRecoveryCodes(user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch recovery codes",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"enabled":                  user.TOTPEnabled,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// SetupTwoFactor generates a new TOTP secret and returns it with its
+// provisioning URI and a QR code. Two-factor authentication is enabled once
+// a code from the authenticator app is confirmed with EnableTwoFactor.
+func (h *TwoFactorHandler) SetupTwoFactor(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	var req models.TwoFactorSetupRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if user.TOTPEnabled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Two-factor authentication is already enabled",
+		})
+	}
+
+	attempt := newLoginAttempt(c, user.Username)
+	release, refused, err := beginLoginCheck(c, h.loginGuard, &attempt)
+	if refused {
+		return err
+	}
+	defer release()
+	if ok, err := services.CheckPassword(user.PasswordHash, req.Password); err != nil || !ok {
+		return h.refuseCheck(c, &attempt, models.LoginFailureCredentials, err)
+	}
+
+	secret, err := services.GenerateTOTPSecret()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate secret",
+		})
+	}
+	uri := services.TOTPURI(h.issuer, user.Username, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate QR code",
+		})
+	}
+
+	if err := services.SaveTOTPSecret(database.DB, user.ID, secret); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save secret",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"secret":  secret,
+		"uri":     uri,
+		"qr_code": "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// EnableTwoFactor turns on two-factor authentication after checking a code
+// for the secret from SetupTwoFactor, and returns the recovery codes once
+func (h *TwoFactorHandler) EnableTwoFactor(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	var req models.TwoFactorCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if user.TOTPEnabled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Two-factor authentication is already enabled",
+		})
+	}
+	if user.TOTPSecret == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Start two-factor setup first",
+		})
+	}
+
+	ok, err := services.UseTOTP(user, req.Code)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify code",
+		})
+	}
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid code",
+		})
+	}
+
+	var codes []string
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).UpdateColumn("totp_enabled", true).Error; err != nil {
+			return err
+		}
+		codes, err = services.ReplaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to enable two-factor authentication",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes after checking a
+// current TOTP code, and returns the new codes once
+func (h *TwoFactorHandler) RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	var req models.TwoFactorCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if !user.TOTPEnabled {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Two-factor authentication is not enabled",
+		})
+	}
+
+	attempt := newLoginAttempt(c, user.Username)
+	release, refused, err := beginLoginCheck(c, h.loginGuard, &attempt)
+	if refused {
+		return err
+	}
+	defer release()
+	if ok, err := services.UseTOTP(user, req.Code); err != nil || !ok {
+		return h.refuseCheck(c, &attempt, models.LoginFailureTwoFactor, err)
+	}
+
+	codes, err := services.ReplaceRecoveryCodes(database.DB, user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate recovery codes",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTwoFactor turns off two-factor authentication after checking the
+// password and a TOTP or recovery code. Its other sessions are signed out.
+func (h *TwoFactorHandler) DisableTwoFactor(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	var req models.DisableTwoFactorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if !user.TOTPEnabled {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Two-factor authentication is not enabled",
+		})
+	}
+
+	attempt := newLoginAttempt(c, user.Username)
+	release, refused, err := beginLoginCheck(c, h.loginGuard, &attempt)
+	if refused {
+		return err
+	}
+	defer release()
+	if ok, err := services.CheckPassword(user.PasswordHash, req.Password); err != nil || !ok {
+		return h.refuseCheck(c, &attempt, models.LoginFailureCredentials, err)
+	}
+	if ok, err := services.UseTwoFactorCode(user, req.Code); err != nil || !ok {
+		return h.refuseCheck(c, &attempt, models.LoginFailureTwoFactor, err)
+	}
+
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := services.DisableTwoFactor(tx, user.ID); err != nil {
+			return err
+		}
+		return h.tokens.RevokeOtherSessions(tx, user.ID, currentSessionID(c))
+	}); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to disable two-factor authentication",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// refuseCheck answers a wrong password or code of the signed-in account.
+// The failure is recorded like a failed login, so it counts towards delays
+// and lockouts; errors are answered without being recorded.
+func (h *TwoFactorHandler) refuseCheck(c *fiber.Ctx, attempt *models.LoginAttempt, reason string, err error) error {
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "two-factor check failed", "username", attempt.Username, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify credentials",
+		})
+	}
+
+	attempt.FailureReason = reason
+	recordLoginAttempt(c, h.loginGuard, attempt)
+	slog.WarnContext(c.UserContext(), "two-factor change refused", "username", attempt.Username, "ip", attempt.IPAddress, "reason", reason)
+
+	message := "Password is incorrect"
+	if reason == models.LoginFailureTwoFactor {
+		message = "Invalid code"
+	}
+	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+		"error": message,
+	})
+}
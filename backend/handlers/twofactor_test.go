@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/internal/testdb"
+	"link-shortener/middleware"
+	"link-shortener/models"
+	"link-shortener/services"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// newTwoFactorTest signs in an account without two-factor authentication
+// and returns a function posting a setup request with a password. A failed
+// password locks the account out after maxFailures.
+func newTwoFactorTest(t *testing.T, open func(testing.TB, ...interface{}) *gorm.DB, maxFailures int) (models.User, func(password string) int) {
+	t.Helper()
+	open(t, &models.User{}, &models.LoginAttempt{}, &models.LoginLockout{},
+		&models.RefreshToken{}, &models.RevokedToken{}, &models.RecoveryCode{})
+	if err := services.InitTwoFactorSecrets("test-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := services.HashPassword("correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := models.User{Username: "alice", PasswordHash: hash, Roles: models.RoleOwner, Active: true}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := services.NewTokenService("test", "jwt-secret", "", time.Minute, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tokens.IssueTokens(&user, "192.0.2.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guard := services.NewLoginGuard(maxFailures, 20, time.Hour, time.Hour, 0, 0, 8)
+	h := NewTwoFactorHandler("KinterCut", tokens, guard)
+	app := fiber.New()
+	app.Post("/me/2fa/setup", middleware.AuthRequired(tokens), h.SetupTwoFactor)
+
+	return user, func(password string) int {
+		t.Helper()
+		data, _ := json.Marshal(models.TwoFactorSetupRequest{Password: password})
+		req := httptest.NewRequest(fiber.MethodPost, "/me/2fa/setup", bytes.NewReader(data))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+pair.AccessToken)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+}
+
+func TestSetupTwoFactor(t *testing.T) {
+	user, setup := newTwoFactorTest(t, testdb.Open, 5)
+
+	// The secret is stored encrypted
+	if status := setup("correct horse battery"); status != fiber.StatusOK {
+		t.Fatalf("setup = %d, want %d", status, fiber.StatusOK)
+	}
+	var stored models.User
+	database.DB.Take(&stored, user.ID)
+	if !strings.HasPrefix(stored.TOTPSecret, "e1:") {
+		t.Errorf("stored secret %q is not encrypted", stored.TOTPSecret)
+	}
+
+	// A wrong password is recorded like a failed login
+	if status := setup("wrong password"); status != fiber.StatusForbidden {
+		t.Fatalf("wrong password = %d, want %d", status, fiber.StatusForbidden)
+	}
+	var attempt models.LoginAttempt
+	if err := database.DB.Take(&attempt).Error; err != nil {
+		t.Fatalf("failed attempt was not recorded: %v", err)
+	}
+	if attempt.Username != "alice" || attempt.Success || attempt.FailureReason != models.LoginFailureCredentials {
+		t.Errorf("recorded attempt = %+v", attempt)
+	}
+}
+
+func TestSetupTwoFactorLockout(t *testing.T) {
+	_, setup := newTwoFactorTest(t, testdb.OpenPostgres, 2)
+
+	for i := 0; i < 2; i++ {
+		if status := setup("wrong password"); status != fiber.StatusForbidden {
+			t.Fatalf("wrong password %d = %d, want %d", i+1, status, fiber.StatusForbidden)
+		}
+	}
+	// Locked out like after failed logins, even with the right password
+	if status := setup("correct horse battery"); status != fiber.StatusTooManyRequests {
+		t.Errorf("setup after lockout = %d, want %d", status, fiber.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"regexp"
+	"strings"
+
+	"link-shortener/database"
+	"link-shortener/middleware"
+	"link-shortener/models"
+	"link-shortener/services"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// usernameRegex validates account usernames
+var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9._@-]{3,100}$`)
+
+// UserHandler handles user account management
+type UserHandler struct {
+	tokens *services.TokenService
+}
+
+// NewUserHandler creates a new UserHandler instance. tokens revokes the
+// sessions of accounts whose credentials change.
+func NewUserHandler(tokens *services.TokenService) *UserHandler {
+	return &UserHandler{tokens: tokens}
+}
+
+// GetCurrentUser returns the signed-in account and its permissions
+func (h *UserHandler) GetCurrentUser(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+	return c.JSON(fiber.Map{
+		"user":        user,
+		"permissions": user.Permissions(),
+	})
+}
+
+// ChangePassword changes the signed-in account's password after checking
+// the current one. Its other sessions are signed out.
+func (h *UserHandler) ChangePassword(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	var req models.ChangePasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	ok, err := services.CheckPassword(user.PasswordHash, req.CurrentPassword)
+	if err != nil || !ok {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Current password is incorrect",
+		})
+	}
+	if msg := services.ValidatePassword(req.NewPassword); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	hash, err := services.HashPassword(req.NewPassword)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to hash password",
+		})
+	}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).UpdateColumn("password_hash", hash).Error; err != nil {
+			return err
+		}
+		return h.tokens.RevokeOtherSessions(tx, user.ID, currentSessionID(c))
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to change password",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Password changed successfully",
+	})
+}
+
+// ListUsers returns all accounts
+func (h *UserHandler) ListUsers(c *fiber.Ctx) error {
+	var users []models.User
+	if err := database.DB.Order("username").Find(&users).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch users",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"users": users,
+		"total": len(users),
+	})
+}
+
+// CreateUser creates an active account
+func (h *UserHandler) CreateUser(c *fiber.Ctx) error {
+	var req models.CreateUserRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	if !usernameRegex.MatchString(req.Username) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Username must be 3-100 characters of letters, numbers, '.', '_', '@' or '-'",
+		})
+	}
+	if msg := services.ValidatePassword(req.Password); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+	roles, err := services.JoinRoles(req.Roles)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var existing models.User
+	if err := database.DB.Where("username = ?", req.Username).First(&existing).Error; err == nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "This username is already taken",
+		})
+	}
+
+	hash, err := services.HashPassword(req.Password)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to hash password",
+		})
+	}
+
+	user := models.User{
+		Username:     req.Username,
+		PasswordHash: hash,
+		Roles:        roles,
+		Active:       true,
+	}
+	if err := database.DB.Create(&user).Error; err != nil {
+		// A concurrent request may have taken the username since the check
+		if strings.Contains(err.Error(), "duplicate") {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "This username is already taken",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create user",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(user)
+}
+
+// UpdateUser changes an account's password, roles or active state, or
+// turns off its two-factor authentication. Role changes invalidate the
+// account's existing tokens.
+func (h *UserHandler) UpdateUser(c *fiber.Ctx) error {
+	var user models.User
+	if err := database.DB.Where("id = ?", c.Params("id")).First(&user).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	var req models.UpdateUserRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.Password != nil {
+		if msg := services.ValidatePassword(*req.Password); msg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": msg,
+			})
+		}
+		hash, err := services.HashPassword(*req.Password)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to hash password",
+			})
+		}
+		user.PasswordHash = hash
+	}
+
+	if req.Roles != nil {
+		roles, err := services.JoinRoles(req.Roles)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		user.Roles = roles
+
+		// Keeping your own owner role guarantees an owner always remains
+		if user.ID == middleware.CurrentUser(c).ID && !user.HasRole(models.RoleOwner) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "You cannot remove your own owner role",
+			})
+		}
+	}
+
+	if req.Active != nil {
+		// Disabling yourself would lock you out mid-session
+		if !*req.Active && user.ID == middleware.CurrentUser(c).ID {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "You cannot disable your own account",
+			})
+		}
+		user.Active = *req.Active
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&user).Error; err != nil {
+			return err
+		}
+		if req.DisableTwoFactor {
+			user.TOTPEnabled = false
+			if err := services.DisableTwoFactor(tx, user.ID); err != nil {
+				return err
+			}
+		}
+		if req.Password == nil && !req.DisableTwoFactor {
+			return nil
+		}
+		// Changed credentials sign the account out everywhere, except for
+		// the session making the change to its own account
+		keep := ""
+		if user.ID == middleware.CurrentUser(c).ID {
+			keep = currentSessionID(c)
+		}
+		return h.tokens.RevokeOtherSessions(tx, user.ID, keep)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update user",
+		})
+	}
+
+	return c.JSON(user)
+}
+
+// DeleteUser deletes an account. Its links are transferred to the user
+// performing the deletion so they keep an owner.
+func (h *UserHandler) DeleteUser(c *fiber.Ctx) error {
+	current := middleware.CurrentUser(c)
+
+	var user models.User
+	if err := database.DB.Where("id = ?", c.Params("id")).First(&user).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if user.ID == current.ID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "You cannot delete your own account",
+		})
+	}
+
+	var transferred int64
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Link{}).Unscoped().
+			Where("user_id = ?", user.ID).
+			UpdateColumn("user_id", current.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		transferred = result.RowsAffected
+		return tx.Delete(&user).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete user",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":           "User deleted successfully",
+		"links_transferred": transferred,
+	})
+}
+
+// currentSessionID returns the session of the access token that
+// authenticated the request, or "" for API keys
+func currentSessionID(c *fiber.Ctx) string {
+	if claims := middleware.CurrentClaims(c); claims != nil {
+		return claims.SessionID
+	}
+	return ""
+}
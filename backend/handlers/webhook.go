@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/models"
+	"link-shortener/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Maximum number of clicks grouped into one webhook delivery
+const maxWebhookBatchSize = 1000
+
+// WebhookHandler handles webhook subscription management
+type WebhookHandler struct {
+	webhooks *services.WebhookService
+}
+
+// NewWebhookHandler creates a new WebhookHandler instance
+func NewWebhookHandler(webhooks *services.WebhookService) *WebhookHandler {
+	return &WebhookHandler{webhooks: webhooks}
+}
+
+// ListWebhooks returns all webhook subscriptions
+func (h *WebhookHandler) ListWebhooks(c *fiber.Ctx) error {
+	var subscriptions []models.WebhookSubscription
+	if err := database.DB.Order("id").Find(&subscriptions).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch webhooks",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"webhooks": subscriptions,
+		"events":   services.WebhookEvents,
+	})
+}
+
+// CreateWebhook creates a subscription and returns its signing secret once
+func (h *WebhookHandler) CreateWebhook(c *fiber.Ctx) error {
+	var req models.WebhookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	subscription := models.WebhookSubscription{
+		Active:          true,
+		ClickSampleRate: 1,
+		ClickBatchSize:  1,
+	}
+	if msg := h.applyWebhookRequest(c.UserContext(), &subscription, &req); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	secret, err := services.GenerateWebhookSecret()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate webhook secret",
+		})
+	}
+	subscription.Secret = secret
+
+	if err := database.DB.Create(&subscription).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create webhook",
+		})
+	}
+	h.webhooks.Reload()
+
+	return c.Status(fiber.StatusCreated).JSON(models.WebhookCreatedResponse{
+		WebhookSubscription: subscription,
+		Secret:              secret,
+	})
+}
+
+// UpdateWebhook changes a subscription's URL, events, state or click options
+func (h *WebhookHandler) UpdateWebhook(c *fiber.Ctx) error {
+	var subscription models.WebhookSubscription
+	if err := database.DB.Where("id = ?", c.Params("id")).First(&subscription).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook not found",
+		})
+	}
+
+	var req models.WebhookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.URL == "" {
+		req.URL = subscription.URL
+	}
+	if req.Events == nil {
+		req.Events = strings.Split(subscription.Events, ",")
+	}
+	if msg := h.applyWebhookRequest(c.UserContext(), &subscription, &req); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	if err := database.DB.Save(&subscription).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update webhook",
+		})
+	}
+	h.webhooks.Reload()
+
+	return c.JSON(subscription)
+}
+
+// DeleteWebhook deletes a subscription and its delivery log
+func (h *WebhookHandler) DeleteWebhook(c *fiber.Ctx) error {
+	var subscription models.WebhookSubscription
+	if err := database.DB.Where("id = ?", c.Params("id")).First(&subscription).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook not found",
+		})
+	}
+
+	database.DB.Where("subscription_id = ?", subscription.ID).Delete(&models.WebhookDelivery{})
+	database.DB.Where("subscription_id = ?", subscription.ID).Delete(&models.WebhookQueuedClick{})
+	if err := database.DB.Delete(&subscription).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete webhook",
+		})
+	}
+	h.webhooks.Reload()
+
+	return c.JSON(fiber.Map{
+		"message": "Webhook deleted successfully",
+	})
+}
+
+// GetWebhookDeliveries returns a subscription's delivery log, newest first.
+// Filter with ?status=pending|retrying|delivered|dead.
+func (h *WebhookHandler) GetWebhookDeliveries(c *fiber.Ctx) error {
+	var subscription models.WebhookSubscription
+	if err := database.DB.Where("id = ?", c.Params("id")).First(&subscription).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook not found",
+		})
+	}
+
+	query := database.DB.Where("subscription_id = ?", subscription.ID)
+	if status := c.Query("status"); status != "" {
+		switch status {
+		case models.DeliveryPending, models.DeliveryRetrying, models.DeliveryDelivered, models.DeliveryDead:
+			query = query.Where("status = ?", status)
+		default:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid status. Use pending, retrying, delivered or dead",
+			})
+		}
+	}
+
+	limit := c.QueryInt("limit", 100)
+	if limit < 1 || limit > 1000 {
+		limit = 100
+	}
+
+	var deliveries []models.WebhookDelivery
+	if err := query.Order("created_at DESC, id DESC").Limit(limit).Find(&deliveries).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch deliveries",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"webhook":    subscription,
+		"deliveries": deliveries,
+		"total":      len(deliveries),
+	})
+}
+
+// RetryWebhookDelivery requeues a dead-lettered or failing delivery
+func (h *WebhookHandler) RetryWebhookDelivery(c *fiber.Ctx) error {
+	result := database.DB.Model(&models.WebhookDelivery{}).
+		Where("id = ? AND subscription_id = ?", c.Params("delivery"), c.Params("id")).
+		Where("status IN ?", []string{models.DeliveryDead, models.DeliveryRetrying}).
+		Updates(map[string]interface{}{
+			"status":          models.DeliveryPending,
+			"attempts":        0,
+			"next_attempt_at": time.Now(),
+		})
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to requeue delivery",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No dead or retrying delivery found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Delivery requeued",
+	})
+}
+
+// applyWebhookRequest validates req and copies it onto subscription. It
+// returns an error message for invalid input.
+func (h *WebhookHandler) applyWebhookRequest(ctx context.Context, subscription *models.WebhookSubscription, req *models.WebhookRequest) string {
+	parsedURL, err := url.Parse(req.URL)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Hostname() == "" {
+		return "Invalid URL. Must be a valid HTTP or HTTPS URL"
+	}
+	if err := h.webhooks.CheckHost(ctx, parsedURL.Hostname()); err != nil {
+		if errors.Is(err, services.ErrPrivateAddress) {
+			return "Invalid URL. Webhooks cannot be sent to private or internal addresses"
+		}
+		return "Invalid URL. Its host could not be resolved"
+	}
+
+	var events []string
+	for _, event := range req.Events {
+		event = strings.TrimSpace(event)
+		if !isWebhookEvent(event) {
+			return "Unknown event '" + event + "'. Use " + strings.Join(services.WebhookEvents, ", ")
+		}
+		events = append(events, event)
+	}
+	if len(events) == 0 {
+		return "At least one event is required"
+	}
+
+	if req.ClickSampleRate != nil {
+		if *req.ClickSampleRate <= 0 || *req.ClickSampleRate > 1 {
+			return "click_sample_rate must be greater than 0 and at most 1"
+		}
+		subscription.ClickSampleRate = *req.ClickSampleRate
+	}
+	if req.ClickBatchSize != nil {
+		if *req.ClickBatchSize < 1 || *req.ClickBatchSize > maxWebhookBatchSize {
+			return "click_batch_size must be between 1 and 1000"
+		}
+		subscription.ClickBatchSize = *req.ClickBatchSize
+	}
+	if req.Active != nil {
+		subscription.Active = *req.Active
+	}
+
+	subscription.URL = req.URL
+	subscription.Events = strings.Join(events, ",")
+	return ""
+}
+
+// isWebhookEvent reports whether event is a known webhook event type
+func isWebhookEvent(event string) bool {
+	for _, known := range services.WebhookEvents {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
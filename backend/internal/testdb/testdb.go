@@ -0,0 +1,103 @@
+// Package testdb provides databases for tests of packages using
+// database.DB
+package testdb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"link-shortener/database"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// PostgresURLEnv names the environment variable with the URL of a
+// PostgreSQL database for tests that need Postgres features
+const PostgresURLEnv = "TEST_DATABASE_URL"
+
+// Open points database.DB at a new in-memory SQLite database with tables
+// for models
+func Open(t testing.TB, models ...interface{}) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each connection would open a database of its own
+	singleConnection(t, db)
+	return use(t, db, models)
+}
+
+// OpenPostgres points database.DB at a new schema with tables for models
+// in the database named by TEST_DATABASE_URL, and drops the schema when
+// the test ends. Tests are skipped when the variable is not set.
+func OpenPostgres(t testing.TB, models ...interface{}) *gorm.DB {
+	t.Helper()
+
+	url := os.Getenv(PostgresURLEnv)
+	if url == "" {
+		t.Skip(PostgresURLEnv + " is not set")
+	}
+	db, err := gorm.Open(postgres.Open(url), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The search path is set per connection
+	singleConnection(t, db)
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	schema := "test_" + hex.EncodeToString(b)
+	if err := db.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("SET search_path TO " + schema).Error; err != nil {
+		t.Fatal(err)
+	}
+	use(t, db, models)
+	// Cleanups run in reverse, so the schema is dropped before db closes
+	t.Cleanup(func() {
+		db.Exec("DROP SCHEMA " + schema + " CASCADE")
+	})
+	return db
+}
+
+// singleConnection keeps db on one connection for the whole test
+func singleConnection(t testing.TB, db *gorm.DB) {
+	t.Helper()
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	sqlDB.SetConnMaxLifetime(0)
+	sqlDB.SetConnMaxIdleTime(0)
+}
+
+// use migrates models and makes db the database of the test
+func use(t testing.TB, db *gorm.DB, models []interface{}) *gorm.DB {
+	t.Helper()
+
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() {
+		database.DB = previous
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
@@ -1,44 +1,177 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"runtime/debug"
 	"syscall"
+	"time"
 
 	"link-shortener/config"
 	"link-shortener/database"
 	"link-shortener/handlers"
 	"link-shortener/middleware"
+	"link-shortener/models"
 	"link-shortener/services"
 
+	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
 	// Load configuration
 	cfg := config.Load()
 
+	// Structured logging; everything below logs through slog
+	logger, err := services.NewLogger(os.Stdout, cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		log.Fatalf("Invalid logging configuration: %v", err)
+	}
+	slog.SetDefault(logger)
+
+	// Set up trace export; disabled without an OTLP endpoint
+	shutdownTracing, err := services.InitTracing(context.Background(), cfg.OTLPEndpoint, cfg.TraceServiceName, cfg.TraceSampleRatio)
+	if err != nil {
+		fatal("failed to set up tracing", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("failed to flush traces", "error", err)
+		}
+	}()
+
 	// Connect to database
 	if err := database.Connect(cfg.DatabaseURL); err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		fatal("failed to connect to database", err)
 	}
 	defer database.Close()
 
+	if cfg.OTLPEndpoint != "" {
+		if err := database.EnableTracing(); err != nil {
+			fatal("failed to enable query tracing", err)
+		}
+		slog.Info("exporting traces", "endpoint", cfg.OTLPEndpoint)
+	}
+
 	// Run migrations
 	if err := database.Migrate(); err != nil {
-		log.Fatalf("Failed to run migrations: %v", err)
+		fatal("failed to run migrations", err)
+	}
+
+	// Key recovery code hashes and encrypt TOTP secrets, upgrading ones
+	// stored unprotected
+	if err := services.InitTwoFactorSecrets(cfg.RecoveryCodeSecret); err != nil {
+		fatal("invalid RECOVERY_CODE_SECRET", err)
+	}
+
+	// Create the configured admin account on first start
+	if err := services.BootstrapAdmin(cfg.AdminUsername, cfg.AdminPassword); err != nil {
+		fatal("failed to create bootstrap admin account", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Build geolocation provider chain: local database, HTTP API, fallback
+	var geoProviders []services.GeoProvider
+	if cfg.GeoIPCityDB != "" {
+		db, err := services.NewLocalGeoDB(cfg.GeoIPCityDB, cfg.GeoIPASNDB)
+		if err != nil {
+			fatal("failed to open GeoIP database", err)
+		}
+		defer db.Close()
+		db.WatchForChanges(ctx, cfg.GeoIPReloadInterval)
+		geoProviders = append(geoProviders, db)
+		slog.Info("using local GeoIP database", "path", cfg.GeoIPCityDB)
+	}
+	if cfg.GeoAPIEnabled {
+		geoProviders = append(geoProviders, services.NewIPAPIProvider(cfg.GeoAPIURL))
+	}
+	geoProviders = append(geoProviders, services.FallbackProvider{})
+
+	privateNetworks, err := services.ParseNetworkLabels(cfg.GeoPrivateNetworks)
+	if err != nil {
+		fatal("invalid GEO_PRIVATE_NETWORKS", err)
 	}
 
 	// Initialize services
-	geoService := services.NewGeoService()
+	geoService := services.NewGeoService(cfg.GeoCacheSize, cfg.GeoCacheTTL, privateNetworks, geoProviders...)
+
+	sqlDB, err := database.DB.DB()
+	if err != nil {
+		fatal("failed to get database handle", err)
+	}
+	services.RegisterMetrics(sqlDB, geoService)
+
+	ipAnonymizer, err := services.NewIPAnonymizer(cfg.PrivacyMode, cfg.PrivacyHashSecret)
+	if err != nil {
+		fatal("invalid privacy settings", err)
+	}
+
+	// Start background click rollups and retention
+	rollupService := services.NewRollupService(cfg.RollupInterval, cfg.ClickRetention, cfg.ClickScrubAfter)
+	rollupService.Start(ctx)
+
+	// Start unique visitor sketches (flushed once more on shutdown)
+	uniqueVisitors := services.NewUniqueVisitorService(cfg.VisitorFlushInterval)
+	uniqueVisitors.Start(ctx)
+	defer uniqueVisitors.Flush()
+
+	// Live click stream (subscriptions are closed on shutdown)
+	clickBroker := services.NewClickBroker(cfg.ClickStreamBuffer, cfg.ClickStreamMaxSubscribers)
+
+	// Start webhook dispatcher
+	webhooks := services.NewWebhookService(cfg.WebhookInterval, cfg.WebhookTimeout, cfg.WebhookMaxAttempts, cfg.WebhookAllowPrivate)
+	webhooks.Start(ctx)
+
+	// Throttle and lock out repeated failed logins
+	loginGuard := services.NewLoginGuard(cfg.LoginMaxFailures, cfg.LoginIPMaxFailures,
+		cfg.LoginFailureWindow, cfg.LoginLockoutDuration, cfg.LoginDelay, cfg.LoginMaxDelay, cfg.LoginMaxConcurrent)
+
+	// Access and refresh tokens (expired ones are pruned in the background)
+	tokens, err := services.NewTokenService(cfg.JWTKeyID, cfg.JWTSecret, cfg.JWTPreviousKeys, cfg.AccessTokenTTL, cfg.RefreshTokenTTL, cfg.SessionMaxAge)
+	if err != nil {
+		fatal("invalid JWT_PREVIOUS_KEYS", err)
+	}
+	tokens.Start(ctx)
+
+	// Single sign-on, when an OpenID Connect provider is configured
+	var oidcService *services.OIDCService
+	if cfg.OIDCIssuerURL != "" {
+		oidcService, err = services.NewOIDCService(services.OIDCConfig{
+			IssuerURL:     cfg.OIDCIssuerURL,
+			ClientID:      cfg.OIDCClientID,
+			ClientSecret:  cfg.OIDCClientSecret,
+			RedirectURL:   cfg.OIDCRedirectURL,
+			Scopes:        cfg.OIDCScopes,
+			UsernameClaim: cfg.OIDCUsernameClaim,
+			RolesClaims:   cfg.OIDCRolesClaim,
+			RoleMapping:   cfg.OIDCRoleMapping,
+		})
+		if err != nil {
+			fatal("invalid OIDC configuration", err)
+		}
+		slog.Info("single sign-on enabled", "issuer", cfg.OIDCIssuerURL)
+	}
 
 	// Initialize handlers
-	linkHandler := handlers.NewLinkHandler(cfg, geoService)
-	adminHandler := handlers.NewAdminHandler(cfg)
+	linkHandler := handlers.NewLinkHandler(cfg, geoService, ipAnonymizer, uniqueVisitors, clickBroker, webhooks)
+	adminHandler := handlers.NewAdminHandler(cfg, geoService, uniqueVisitors, clickBroker, webhooks, loginGuard, tokens, oidcService)
+	webhookHandler := handlers.NewWebhookHandler(webhooks)
+	userHandler := handlers.NewUserHandler(tokens)
+	apiKeyHandler := handlers.NewAPIKeyHandler()
+	twoFactorHandler := handlers.NewTwoFactorHandler(cfg.TOTPIssuer, tokens, loginGuard)
+	healthHandler := handlers.NewHealthHandler(cfg, geoService, linkHandler.ClickBacklog)
 
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
@@ -47,44 +180,118 @@ func main() {
 		ErrorHandler: customErrorHandler,
 	})
 
+	clientIPResolver, err := middleware.NewClientIPResolver(cfg.TrustedProxies)
+	if err != nil {
+		fatal("invalid TRUSTED_PROXIES", err)
+	}
+
 	// Middleware
-	app.Use(recover.New())
-	app.Use(logger.New(logger.Config{
-		Format: "[${time}] ${status} - ${latency} ${method} ${path}\n",
+	app.Use(recover.New(recover.Config{
+		EnableStackTrace:  true,
+		StackTraceHandler: logPanic,
 	}))
+	app.Use(middleware.Metrics())
+	app.Use(clientIPResolver.Handler())
+	app.Use(middleware.RequestLogger(ipAnonymizer, cfg.HonorDoNotTrack))
+	if cfg.OTLPEndpoint != "" {
+		app.Use(middleware.Tracing())
+	}
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     cfg.FrontendURL + ", " + cfg.BaseURL + ", http://localhost:3000",
 		AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS",
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, " + middleware.APIKeyHeader + ", " + middleware.RequestIDHeader,
+		ExposeHeaders:    middleware.RequestIDHeader,
 		AllowCredentials: true,
 	}))
 
-	// Health check endpoint
-	app.Get("/health", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{
-			"status": "ok",
-			"name":   "KinterCut API",
-		})
-	})
+	// Liveness and readiness probes (/health is kept as a liveness alias)
+	app.Get("/livez", healthHandler.Livez)
+	app.Get("/readyz", healthHandler.Readyz)
+	app.Get("/health", healthHandler.Livez)
+
+	// Prometheus metrics, open only when explicitly made public
+	metricsHandler := adaptor.HTTPHandler(promhttp.HandlerFor(services.MetricsRegistry, promhttp.HandlerOpts{}))
+	if cfg.MetricsPublic {
+		app.Get("/metrics", metricsHandler)
+	} else {
+		app.Get("/metrics", middleware.MetricsAuth(cfg.MetricsToken), metricsHandler)
+	}
 
 	// API routes
 	api := app.Group("/api")
 
 	// Public link shortening (with optional auth)
-	api.Post("/shorten", middleware.OptionalAuth(cfg), linkHandler.ShortenLink)
+	api.Post("/shorten", middleware.OptionalAuth(tokens), linkHandler.ShortenLink)
 
 	// Admin routes
 	admin := api.Group("/admin")
 	admin.Post("/login", adminHandler.Login)
+	admin.Post("/login/2fa", adminHandler.LoginTwoFactor)
+	admin.Post("/refresh", adminHandler.Refresh)
+	admin.Get("/oidc", adminHandler.GetOIDCStatus)
+	admin.Post("/oidc/start", adminHandler.StartOIDCLogin)
+	admin.Post("/login/oidc", adminHandler.LoginOIDC)
+
+	// Per-route permission checks (roles are mapped to permissions in
+	// models.RolePermissions, narrowed by scopes for API keys). Link routes
+	// that accept the *_own permissions only serve the user's own links.
+	canViewLinks := middleware.RequirePermission(models.PermLinksView)
+	canViewOwnLinks := middleware.RequirePermission(models.PermLinksView, models.PermLinksViewOwn)
+	canCreateLinks := middleware.RequirePermission(models.PermLinksCreate)
+	canDeleteLinks := middleware.RequirePermission(models.PermLinksDelete, models.PermLinksDeleteOwn)
+	canManageAccount := middleware.RequirePermission(models.PermAccountSelf)
+	canViewAudit := middleware.RequirePermission(models.PermAuditView)
+	canViewUsers := middleware.RequirePermission(models.PermUsersView)
+	canManageUsers := middleware.RequirePermission(models.PermUsersManage)
+	canManageWebhooks := middleware.RequirePermission(models.PermWebhooksManage)
+	canViewSystem := middleware.RequirePermission(models.PermSystemView)
+
+	// Live click stream (EventSource/WebSocket clients pass a ticket as
+	// ?ticket=). Registered before the protected group, whose AuthRequired
+	// would otherwise run first and refuse ticket requests.
+	streamAuth := middleware.StreamAuth(tokens, "ticket")
+	admin.Get("/stream/clicks", streamAuth, canViewOwnLinks, adminHandler.StreamClicks)
+	admin.Get("/stream/clicks/ws", streamAuth, canViewOwnLinks, adminHandler.UpgradeClickStream, websocket.New(adminHandler.StreamClicksWebSocket))
 
 	// Protected admin routes
-	adminProtected := admin.Group("", middleware.AuthRequired(cfg))
-	adminProtected.Get("/my", adminHandler.GetMyStats)
-	adminProtected.Get("/users", adminHandler.GetUserLinks)
-	adminProtected.Get("/logins", adminHandler.GetLoginAttempts)
-	adminProtected.Get("/links/:id", adminHandler.GetLinkDetails)
-	adminProtected.Delete("/links/:id", adminHandler.DeleteLink)
-	adminProtected.Post("/links", adminHandler.CreateAdminLink)
+	adminProtected := admin.Group("", middleware.AuthRequired(tokens))
+
+	adminProtected.Get("/me", userHandler.GetCurrentUser)
+	adminProtected.Post("/logout", adminHandler.Logout)
+	adminProtected.Post("/logout/all", canManageAccount, adminHandler.LogoutEverywhere)
+	adminProtected.Put("/me/password", canManageAccount, userHandler.ChangePassword)
+	adminProtected.Get("/me/2fa", canManageAccount, twoFactorHandler.GetTwoFactorStatus)
+	adminProtected.Post("/me/2fa/setup", canManageAccount, twoFactorHandler.SetupTwoFactor)
+	adminProtected.Post("/me/2fa/enable", canManageAccount, twoFactorHandler.EnableTwoFactor)
+	adminProtected.Post("/me/2fa/disable", canManageAccount, twoFactorHandler.DisableTwoFactor)
+	adminProtected.Post("/me/2fa/recovery-codes", canManageAccount, twoFactorHandler.RegenerateRecoveryCodes)
+	adminProtected.Get("/accounts", canViewUsers, userHandler.ListUsers)
+	adminProtected.Post("/accounts", canManageUsers, userHandler.CreateUser)
+	adminProtected.Put("/accounts/:id", canManageUsers, userHandler.UpdateUser)
+	adminProtected.Delete("/accounts/:id", canManageUsers, userHandler.DeleteUser)
+	adminProtected.Get("/api-keys", canManageAccount, apiKeyHandler.ListAPIKeys)
+	adminProtected.Post("/api-keys", canManageAccount, apiKeyHandler.CreateAPIKey)
+	adminProtected.Delete("/api-keys/:id", canManageAccount, apiKeyHandler.RevokeAPIKey)
+	adminProtected.Get("/my", canViewOwnLinks, adminHandler.GetMyStats)
+	adminProtected.Get("/users", canViewLinks, adminHandler.GetUserLinks)
+	adminProtected.Get("/logins", canViewAudit, adminHandler.GetLoginAttempts)
+	adminProtected.Post("/logins/lockouts/:id/unlock", canManageUsers, adminHandler.UnlockLogin)
+	adminProtected.Get("/geo/stats", canViewSystem, adminHandler.GetGeoStats)
+	adminProtected.Get("/links/:id", canViewOwnLinks, adminHandler.GetLinkDetails)
+	adminProtected.Get("/links/:id/timeseries", canViewOwnLinks, adminHandler.GetLinkTimeseries)
+	adminProtected.Get("/links/:id/visitors", canViewOwnLinks, adminHandler.GetLinkVisitors)
+	adminProtected.Get("/links/:id/export", canViewOwnLinks, adminHandler.ExportLinkClicks)
+	adminProtected.Get("/export", canViewLinks, adminHandler.ExportClicks)
+	adminProtected.Delete("/links/:id", canDeleteLinks, adminHandler.DeleteLink)
+	adminProtected.Post("/links", canCreateLinks, adminHandler.CreateAdminLink)
+	adminProtected.Get("/webhooks", canManageWebhooks, webhookHandler.ListWebhooks)
+	adminProtected.Post("/webhooks", canManageWebhooks, webhookHandler.CreateWebhook)
+	adminProtected.Put("/webhooks/:id", canManageWebhooks, webhookHandler.UpdateWebhook)
+	adminProtected.Delete("/webhooks/:id", canManageWebhooks, webhookHandler.DeleteWebhook)
+	adminProtected.Get("/webhooks/:id/deliveries", canManageWebhooks, webhookHandler.GetWebhookDeliveries)
+	adminProtected.Post("/webhooks/:id/deliveries/:delivery/retry", canManageWebhooks, webhookHandler.RetryWebhookDelivery)
+
+	adminProtected.Post("/stream/tickets", canViewOwnLinks, adminHandler.CreateStreamTicket)
 
 	// Expired link page
 	app.Get("/expired", func(c *fiber.Ctx) error {
@@ -101,19 +308,56 @@ func main() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
+	stopped := make(chan struct{})
 	go func() {
 		<-quit
-		log.Println("Shutting down server...")
-		if err := app.Shutdown(); err != nil {
-			log.Fatalf("Server shutdown failed: %v", err)
+		slog.Info("shutting down server")
+
+		// Fail readiness first so load balancers stop routing new requests here
+		healthHandler.StartDraining()
+		time.Sleep(cfg.ShutdownDrainDelay)
+
+		// End live streams, which never go idle on their own, then give
+		// other requests such as long exports a bounded time to finish
+		clickBroker.Close()
+		if err := app.ShutdownWithTimeout(serverShutdownTimeout); err != nil {
+			slog.Warn("server shutdown timed out, closing remaining connections", "error", err)
+		}
+
+		// Clicks are stored after their redirect has been answered; let them
+		// finish before background jobs stop and the database is closed
+		if !linkHandler.WaitForClicks(clickDrainTimeout) {
+			slog.Warn("shutting down with clicks still being tracked", "clicks", linkHandler.ClickBacklog())
 		}
+		cancel()
+		close(stopped)
 	}()
 
 	// Start server
-	log.Printf("Starting KinterCut server on port %s", cfg.Port)
+	slog.Info("starting KinterCut server", "port", cfg.Port)
 	if err := app.Listen(":" + cfg.Port); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+		fatal("failed to start server", err)
 	}
+	<-stopped
+}
+
+// Shutdown bounds: how long in-flight requests and background click
+// tracking may take to finish
+const (
+	serverShutdownTimeout = 30 * time.Second
+	clickDrainTimeout     = 10 * time.Second
+)
+
+// fatal logs a startup error and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// logPanic logs a recovered handler panic with its stack
+func logPanic(c *fiber.Ctx, e interface{}) {
+	slog.ErrorContext(c.UserContext(), "panic while handling request",
+		"error", fmt.Sprint(e), "path", c.Path(), "stack", string(debug.Stack()))
 }
 
 // customErrorHandler handles HTTP errors
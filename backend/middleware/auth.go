@@ -1,100 +1,250 @@
 package middleware
 
 import (
+	"errors"
+	"log/slog"
 	"strings"
 
-	"link-shortener/config"
+	"link-shortener/models"
+	"link-shortener/services"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
 )
 
-// Claims represents JWT token claims
-type Claims struct {
-	Username string `json:"username"`
-	jwt.RegisteredClaims
-}
+// Locals keys holding the authenticated user and, for access tokens, the
+// token's claims
+const (
+	userKey   = "user"
+	claimsKey = "claims"
+	ticketKey = "streamTicket"
+)
+
+// APIKeyHeader carries an API key as an alternative to the Authorization header
+const APIKeyHeader = "X-API-Key"
 
-// AuthRequired is middleware that requires valid JWT authentication
-func AuthRequired(cfg *config.Config) fiber.Handler {
+// AuthRequired is middleware that requires authentication of an active user
+// with a JWT or an API key, sent as "Authorization: Bearer <token>" or in
+// the X-API-Key header. Revoked JWTs and JWTs issued before the user's
+// roles changed are rejected, so the roles in a token are always current.
+func AuthRequired(tokens *services.TokenService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		authHeader := c.Get("Authorization")
-		if authHeader == "" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Authorization header required",
+		user, _, err := authenticate(c, tokens)
+		if err != nil {
+			return c.Status(err.Code).JSON(fiber.Map{
+				"error": err.Message,
 			})
 		}
-
-		// Extract token from "Bearer <token>"
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
+		if user == nil {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Invalid authorization header format",
+				"error": "Authorization header required",
 			})
 		}
 
-		tokenString := parts[1]
+		c.Locals(userKey, user)
 
-		// Parse and validate token
-		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(cfg.JWTSecret), nil
-		})
+		return c.Next()
+	}
+}
 
-		if err != nil || !token.Valid {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Invalid or expired token",
-			})
+// StreamAuth authenticates live click streams. Browsers cannot set headers
+// on EventSource and WebSocket connections, so a single-use ticket from
+// POST /api/admin/stream/tickets may be sent in the given query parameter
+// instead; access tokens and API keys never go in the URL, which ends up
+// in proxy logs and browser history. Requests with credential headers are
+// authenticated like AuthRequired.
+func StreamAuth(tokens *services.TokenService, param string) fiber.Handler {
+	authRequired := AuthRequired(tokens)
+	return func(c *fiber.Ctx) error {
+		ticket := c.Query(param)
+		if ticket == "" || c.Get("Authorization") != "" || c.Get(APIKeyHeader) != "" {
+			return authRequired(c)
 		}
 
-		claims, ok := token.Claims.(*Claims)
-		if !ok {
+		user, stored, err := tokens.RedeemStreamTicket(ticket)
+		if errors.Is(err, services.ErrInvalidStreamTicket) {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Invalid token claims",
+				"error": "Invalid, expired or already used stream ticket",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to verify stream ticket",
 			})
 		}
 
-		// Set admin username in context
-		c.Locals("admin", claims.Username)
+		c.Locals(userKey, user)
+		c.Locals(ticketKey, stored)
 
 		return c.Next()
 	}
 }
 
-// OptionalAuth checks for JWT but does not require it
-func OptionalAuth(cfg *config.Config) fiber.Handler {
+// StillAuthorized returns a check that reports whether the credentials a
+// request was authenticated with are still valid: the user is active with
+// the same roles, and the sign-in session or API key has not been revoked
+// or expired. Long-lived connections such as click streams outlive logout,
+// role changes and disabled accounts, so they call it periodically.
+func StillAuthorized(c *fiber.Ctx) func() bool {
+	user := CurrentUser(c)
+	if user == nil {
+		return func() bool { return false }
+	}
+	userID, roles, apiKeyID := user.ID, user.RoleList(), user.UsedAPIKeyID
+
+	var sessionID, accessJTI string
+	if claims := CurrentClaims(c); claims != nil {
+		sessionID, accessJTI = claims.SessionID, claims.ID
+	} else if ticket, ok := c.Locals(ticketKey).(*models.StreamTicket); ok {
+		sessionID, accessJTI = ticket.SessionID, ticket.AccessJTI
+	}
+	ctx := c.UserContext()
+
+	return func() bool {
+		current, err := services.ActiveUser(userID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "authorization check failed", "error", err)
+			return false
+		}
+		if !sameRoles(roles, current.RoleList()) {
+			return false
+		}
+
+		var active bool
+		if apiKeyID != 0 {
+			active, err = services.APIKeyActive(apiKeyID)
+		} else {
+			active, err = services.SessionActive(userID, sessionID, accessJTI)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "authorization check failed", "error", err)
+			return false
+		}
+		return active
+	}
+}
+
+// OptionalAuth checks for a JWT or API key but does not require one.
+// Requests without a valid JWT continue anonymously; an invalid API key is
+// rejected, since a client sending one expects authenticated behaviour.
+func OptionalAuth(tokens *services.TokenService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		user, isAPIKey, err := authenticate(c, tokens)
+		if err != nil && isAPIKey {
+			return c.Status(err.Code).JSON(fiber.Map{
+				"error": err.Message,
+			})
+		}
+		if user != nil {
+			c.Locals(userKey, user)
+		}
+
+		return c.Next()
+	}
+}
+
+// authenticate resolves the user of a request's API key or JWT. It returns
+// no user and no error for requests without credentials.
+func authenticate(c *fiber.Ctx, tokens *services.TokenService) (*models.User, bool, *fiber.Error) {
+	token := c.Get(APIKeyHeader)
+	if token == "" {
 		authHeader := c.Get("Authorization")
 		if authHeader == "" {
-			c.Locals("isAdmin", false)
-			return c.Next()
+			return nil, false, nil
 		}
 
+		// Extract token from "Bearer <token>"
 		parts := strings.Split(authHeader, " ")
 		if len(parts) != 2 || parts[0] != "Bearer" {
-			c.Locals("isAdmin", false)
-			return c.Next()
+			return nil, false, fiber.NewError(fiber.StatusUnauthorized, "Invalid authorization header format")
 		}
+		token = parts[1]
+	}
 
-		tokenString := parts[1]
+	if services.IsAPIKey(token) {
+		user, err := services.AuthenticateAPIKey(token, ClientIP(c))
+		if errors.Is(err, services.ErrInvalidAPIKey) {
+			return nil, true, fiber.NewError(fiber.StatusUnauthorized, "Invalid, expired or revoked API key")
+		}
+		if err != nil {
+			return nil, true, fiber.NewError(fiber.StatusInternalServerError, "Failed to verify API key")
+		}
+		return user, true, nil
+	}
 
-		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(cfg.JWTSecret), nil
-		})
+	claims, err := tokens.ParseAccessToken(token)
+	if err != nil {
+		return nil, false, fiber.NewError(fiber.StatusUnauthorized, "Invalid or expired token")
+	}
+	revoked, err := services.IsTokenRevoked(claims.ID)
+	if err != nil {
+		return nil, false, fiber.NewError(fiber.StatusInternalServerError, "Failed to verify token")
+	}
+	if revoked {
+		return nil, false, fiber.NewError(fiber.StatusUnauthorized, "Token has been revoked, please sign in again")
+	}
 
-		if err != nil || !token.Valid {
-			c.Locals("isAdmin", false)
-			return c.Next()
-		}
+	// Disabled or deleted accounts lose access immediately
+	user, err := services.ActiveUser(claims.UserID)
+	if err != nil {
+		return nil, false, fiber.NewError(fiber.StatusUnauthorized, "Account is disabled or no longer exists")
+	}
+	if !sameRoles(claims.Roles, user.RoleList()) {
+		return nil, false, fiber.NewError(fiber.StatusUnauthorized, "Your roles have changed, please sign in again")
+	}
+
+	c.Locals(claimsKey, claims)
+	return user, false, nil
+}
 
-		claims, ok := token.Claims.(*Claims)
-		if !ok {
-			c.Locals("isAdmin", false)
-			return c.Next()
+// RequirePermission allows the request when the authenticated user has any
+// of the given permissions. Use it after AuthRequired.
+func RequirePermission(perms ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user := CurrentUser(c)
+		if user != nil {
+			for _, perm := range perms {
+				if user.Can(perm) {
+					return c.Next()
+				}
+			}
 		}
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You do not have permission to do this",
+		})
+	}
+}
 
-		c.Locals("isAdmin", true)
-		c.Locals("admin", claims.Username)
+// CurrentUser returns the user authenticated by AuthRequired or
+// OptionalAuth, or nil for anonymous requests
+func CurrentUser(c *fiber.Ctx) *models.User {
+	user, _ := c.Locals(userKey).(*models.User)
+	return user
+}
 
-		return c.Next()
+// CurrentClaims returns the claims of the access token that authenticated
+// the request, or nil for API keys and anonymous requests
+func CurrentClaims(c *fiber.Ctx) *services.Claims {
+	claims, _ := c.Locals(claimsKey).(*services.Claims)
+	return claims
+}
+
+// sameRoles reports whether two role lists hold the same roles
+func sameRoles(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, role := range a {
+		set[role] = true
+	}
+	for _, role := range b {
+		if !set[role] {
+			return false
+		}
 	}
+	return true
 }
@@ -0,0 +1,281 @@
+package middleware
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/internal/testdb"
+	"link-shortener/models"
+	"link-shortener/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestStreamAuth(t *testing.T) {
+	testdb.Open(t, &models.User{}, &models.RefreshToken{}, &models.RevokedToken{}, &models.StreamTicket{})
+
+	user := models.User{Username: "alice", PasswordHash: "unused", Roles: models.RoleViewer, Active: true}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := services.NewTokenService("test", "jwt-secret", "", time.Minute, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tokens.IssueTokens(&user, "192.0.2.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := tokens.ParseAccessToken(pair.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Get("/stream", StreamAuth(tokens, "ticket"), func(c *fiber.Ctx) error {
+		return c.SendString(CurrentUser(c).Username)
+	})
+	get := func(t *testing.T, url, authorization string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(fiber.MethodGet, url, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	issue := func(t *testing.T) string {
+		t.Helper()
+		ticket, _, err := tokens.IssueStreamTicket(user.ID, claims.SessionID, claims.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ticket
+	}
+
+	t.Run("ticket works once", func(t *testing.T) {
+		ticket := issue(t)
+		if status, body := get(t, "/stream?ticket="+ticket, ""); status != fiber.StatusOK || body != "alice" {
+			t.Fatalf("first use: status %d, body %q", status, body)
+		}
+		if status, _ := get(t, "/stream?ticket="+ticket, ""); status != fiber.StatusUnauthorized {
+			t.Errorf("second use: status %d, want 401", status)
+		}
+	})
+
+	t.Run("access token in URL", func(t *testing.T) {
+		if status, _ := get(t, "/stream?ticket="+pair.AccessToken, ""); status != fiber.StatusUnauthorized {
+			t.Errorf("status %d, want 401", status)
+		}
+	})
+
+	t.Run("access token in header", func(t *testing.T) {
+		if status, body := get(t, "/stream", "Bearer "+pair.AccessToken); status != fiber.StatusOK || body != "alice" {
+			t.Errorf("status %d, body %q", status, body)
+		}
+	})
+
+	t.Run("no credentials", func(t *testing.T) {
+		if status, _ := get(t, "/stream", ""); status != fiber.StatusUnauthorized {
+			t.Errorf("status %d, want 401", status)
+		}
+	})
+
+	t.Run("expired ticket", func(t *testing.T) {
+		ticket := issue(t)
+		if err := database.DB.Model(&models.StreamTicket{}).Where("1 = 1").
+			Update("expires_at", time.Now().Add(-time.Second)).Error; err != nil {
+			t.Fatal(err)
+		}
+		if status, _ := get(t, "/stream?ticket="+ticket, ""); status != fiber.StatusUnauthorized {
+			t.Errorf("status %d, want 401", status)
+		}
+	})
+
+	t.Run("revoked access token", func(t *testing.T) {
+		ticket := issue(t)
+		if err := tokens.RevokeAllSessions(user.ID); err != nil {
+			t.Fatal(err)
+		}
+		if status, _ := get(t, "/stream?ticket="+ticket, ""); status != fiber.StatusUnauthorized {
+			t.Errorf("status %d, want 401", status)
+		}
+	})
+}
+
+func TestStillAuthorized(t *testing.T) {
+	setup := func(t *testing.T) (*services.TokenService, *models.User, string) {
+		t.Helper()
+		testdb.Open(t, &models.User{}, &models.APIKey{}, &models.RefreshToken{}, &models.RevokedToken{})
+
+		user := &models.User{Username: "alice", PasswordHash: "unused", Roles: models.RoleViewer, Active: true}
+		if err := database.DB.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+		tokens, err := services.NewTokenService("test", "jwt-secret", "", time.Minute, time.Hour, 24*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pair, err := tokens.IssueTokens(user, "192.0.2.1", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokens, user, pair.AccessToken
+	}
+	// check authenticates a request with header and returns its check
+	check := func(t *testing.T, tokens *services.TokenService, header, value string) func() bool {
+		t.Helper()
+		var authorized func() bool
+		app := fiber.New()
+		app.Get("/", AuthRequired(tokens), func(c *fiber.Ctx) error {
+			authorized = StillAuthorized(c)
+			return nil
+		})
+		req := httptest.NewRequest(fiber.MethodGet, "/", nil)
+		req.Header.Set(header, value)
+		if _, err := app.Test(req); err != nil {
+			t.Fatal(err)
+		}
+		if authorized == nil {
+			t.Fatal("request was not authenticated")
+		}
+		return authorized
+	}
+	newAPIKey := func(t *testing.T, user *models.User) (string, *models.APIKey) {
+		t.Helper()
+		key, prefix, hash, err := services.GenerateAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		apiKey := &models.APIKey{UserID: user.ID, Name: "test", Prefix: prefix, KeyHash: hash, Scopes: models.ScopeRead}
+		if err := database.DB.Create(apiKey).Error; err != nil {
+			t.Fatal(err)
+		}
+		return key, apiKey
+	}
+
+	tests := []struct {
+		name   string
+		apiKey bool
+		change func(t *testing.T, tokens *services.TokenService, user *models.User, apiKey *models.APIKey)
+		want   bool
+	}{
+		{name: "unchanged", want: true},
+		{name: "signed out everywhere", change: func(t *testing.T, tokens *services.TokenService, user *models.User, _ *models.APIKey) {
+			if err := tokens.RevokeAllSessions(user.ID); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "roles changed", change: func(t *testing.T, _ *services.TokenService, user *models.User, _ *models.APIKey) {
+			database.DB.Model(user).Update("roles", models.RoleOwner)
+		}},
+		{name: "account disabled", change: func(t *testing.T, _ *services.TokenService, user *models.User, _ *models.APIKey) {
+			database.DB.Model(user).Update("active", false)
+		}},
+		{name: "API key unchanged", apiKey: true, want: true},
+		{name: "API key revoked", apiKey: true, change: func(t *testing.T, _ *services.TokenService, _ *models.User, apiKey *models.APIKey) {
+			database.DB.Model(apiKey).Update("revoked_at", time.Now())
+		}},
+		{name: "API key owner disabled", apiKey: true, change: func(t *testing.T, _ *services.TokenService, user *models.User, _ *models.APIKey) {
+			database.DB.Model(user).Update("active", false)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, user, accessToken := setup(t)
+
+			var authorized func() bool
+			var apiKey *models.APIKey
+			if tt.apiKey {
+				var key string
+				key, apiKey = newAPIKey(t, user)
+				authorized = check(t, tokens, APIKeyHeader, key)
+			} else {
+				authorized = check(t, tokens, "Authorization", "Bearer "+accessToken)
+			}
+			if !authorized() {
+				t.Fatal("check failed right after authentication")
+			}
+
+			if tt.change != nil {
+				tt.change(t, tokens, user, apiKey)
+			}
+			if got := authorized(); got != tt.want {
+				t.Errorf("StillAuthorized() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequirePermissionAPIKeyScopes(t *testing.T) {
+	testdb.Open(t, &models.User{}, &models.APIKey{}, &models.RefreshToken{}, &models.RevokedToken{})
+
+	user := models.User{Username: "alice", PasswordHash: "unused", Roles: models.RoleOwner, Active: true}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := services.NewTokenService("test", "jwt-secret", "", time.Minute, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tokens.IssueTokens(&user, "192.0.2.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, prefix, hash, err := services.GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKey := models.APIKey{UserID: user.ID, Name: "test", Prefix: prefix, KeyHash: hash, Scopes: models.ScopeRead}
+	if err := database.DB.Create(&apiKey).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ok := func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusNoContent) }
+	app := fiber.New()
+	app.Use(AuthRequired(tokens))
+	app.Get("/links", RequirePermission(models.PermLinksView), ok)
+	app.Post("/links", RequirePermission(models.PermLinksCreate), ok)
+	app.Put("/password", RequirePermission(models.PermAccountSelf), ok)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		apiKey bool
+		want   int
+	}{
+		{"token reads links", fiber.MethodGet, "/links", false, fiber.StatusNoContent},
+		{"token creates links", fiber.MethodPost, "/links", false, fiber.StatusNoContent},
+		{"token changes password", fiber.MethodPut, "/password", false, fiber.StatusNoContent},
+		{"read key reads links", fiber.MethodGet, "/links", true, fiber.StatusNoContent},
+		// The owner may, but the key's scope does not allow it
+		{"read key creates links", fiber.MethodPost, "/links", true, fiber.StatusForbidden},
+		{"read key changes password", fiber.MethodPut, "/password", true, fiber.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.apiKey {
+				req.Header.Set(APIKeyHeader, key)
+			} else {
+				req.Header.Set(fiber.HeaderAuthorization, "Bearer "+pair.AccessToken)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.path, resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
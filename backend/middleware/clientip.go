@@ -0,0 +1,192 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// clientIPKey is the Locals key holding the resolved client IP
+const clientIPKey = "clientIP"
+
+// ClientIPResolver determines the real client address of a request. Proxy
+// headers are only honoured when the connection comes from a trusted proxy,
+// and forwarding chains are walked from the right so that entries a client
+// prepends itself are ignored.
+type ClientIPResolver struct {
+	trusted []netip.Prefix
+}
+
+// NewClientIPResolver parses a comma-separated list of trusted proxy CIDRs
+// or addresses. The keywords "loopback" and "private" expand to the
+// loopback and private (RFC 1918, ULA) ranges.
+func NewClientIPResolver(spec string) (*ClientIPResolver, error) {
+	r := &ClientIPResolver{}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		switch strings.ToLower(entry) {
+		case "":
+			continue
+		case "loopback":
+			r.trusted = append(r.trusted,
+				netip.MustParsePrefix("127.0.0.0/8"),
+				netip.MustParsePrefix("::1/128"))
+			continue
+		case "private":
+			r.trusted = append(r.trusted,
+				netip.MustParsePrefix("10.0.0.0/8"),
+				netip.MustParsePrefix("172.16.0.0/12"),
+				netip.MustParsePrefix("192.168.0.0/16"),
+				netip.MustParsePrefix("fc00::/7"))
+			continue
+		}
+
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+			}
+			r.trusted = append(r.trusted, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		addr = addr.Unmap()
+		r.trusted = append(r.trusted, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	return r, nil
+}
+
+// Handler resolves the client IP once per request and stores it for ClientIP
+func (r *ClientIPResolver) Handler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals(clientIPKey, r.Resolve(
+			c.Context().RemoteIP().String(),
+			joinedHeader(c, fiber.HeaderForwarded),
+			joinedHeader(c, fiber.HeaderXForwardedFor),
+			c.Get("X-Real-IP"),
+		))
+		return c.Next()
+	}
+}
+
+// joinedHeader returns all values of a list header joined with commas, as
+// if they had been sent in one line. Each proxy may append its own header
+// line, so reading only the first would take the client-supplied entry.
+func joinedHeader(c *fiber.Ctx, name string) string {
+	var parts []string
+	for _, value := range c.Request().Header.PeekAll(name) {
+		if len(value) > 0 {
+			parts = append(parts, string(value))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Resolve returns the client IP given the peer address and proxy headers.
+// The RFC 7239 Forwarded header takes precedence over X-Forwarded-For,
+// which takes precedence over X-Real-IP.
+func (r *ClientIPResolver) Resolve(remoteAddr, forwarded, forwardedFor, realIP string) string {
+	remote, err := netip.ParseAddr(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	remote = remote.Unmap()
+
+	if !r.isTrusted(remote) {
+		return remote.String()
+	}
+
+	if forwarded != "" {
+		return r.walkChain(remote, parseForwardedFor(forwarded))
+	}
+	if forwardedFor != "" {
+		return r.walkChain(remote, strings.Split(forwardedFor, ","))
+	}
+	if addr, ok := parseHop(realIP); ok {
+		return addr.String()
+	}
+	return remote.String()
+}
+
+// walkChain returns the rightmost hop that is not a trusted proxy. If a hop
+// cannot be parsed the walk stops at the last trusted address seen.
+func (r *ClientIPResolver) walkChain(remote netip.Addr, hops []string) string {
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			break
+		}
+		client = addr
+		if !r.isTrusted(addr) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// isTrusted reports whether addr belongs to a trusted proxy range
+func (r *ClientIPResolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range r.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardedFor extracts the for= values of an RFC 7239 Forwarded header
+func parseForwardedFor(header string) []string {
+	var hops []string
+	for _, element := range strings.Split(header, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				hops = append(hops, value)
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop parses one forwarding hop: a bare IP, "ip:port", "[ipv6]:port"
+// or a quoted variant of these as used by the Forwarded header
+func parseHop(hop string) (netip.Addr, bool) {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if hop == "" {
+		return netip.Addr{}, false
+	}
+
+	if addr, err := netip.ParseAddr(hop); err == nil {
+		return addr.Unmap(), true
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		if addr, err := netip.ParseAddr(host); err == nil {
+			return addr.Unmap(), true
+		}
+	}
+	if strings.HasPrefix(hop, "[") && strings.HasSuffix(hop, "]") {
+		if addr, err := netip.ParseAddr(hop[1 : len(hop)-1]); err == nil {
+			return addr.Unmap(), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// ClientIP returns the client IP resolved by ClientIPResolver.Handler,
+// falling back to the connection's peer address
+func ClientIP(c *fiber.Ctx) string {
+	if ip, ok := c.Locals(clientIPKey).(string); ok && ip != "" {
+		return ip
+	}
+	return c.Context().RemoteIP().String()
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestClientIPResolve(t *testing.T) {
+	r, err := NewClientIPResolver("10.0.0.0/8, 192.0.2.1, loopback")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		remote       string
+		forwarded    string
+		forwardedFor string
+		realIP       string
+		want         string
+	}{
+		{"direct client", "203.0.113.5", "", "", "", "203.0.113.5"},
+		{"untrusted peer spoofing headers", "203.0.113.5", "for=198.51.100.1", "198.51.100.1", "198.51.100.1", "203.0.113.5"},
+		{"single proxy", "10.0.0.1", "", "198.51.100.7", "", "198.51.100.7"},
+		{"client-prepended entry is ignored", "10.0.0.1", "", "1.2.3.4, 198.51.100.7", "", "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.1", "", "1.2.3.4, 198.51.100.7, 192.0.2.1, 10.0.0.2", "", "198.51.100.7"},
+		{"only trusted hops", "10.0.0.1", "", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"unparseable hop stops the walk", "10.0.0.1", "", "198.51.100.7, unknown, 10.0.0.2", "", "10.0.0.2"},
+		{"hop with port", "10.0.0.1", "", "198.51.100.7:4711", "", "198.51.100.7"},
+		{"mapped IPv4 peer", "::ffff:10.0.0.1", "", "198.51.100.7", "", "198.51.100.7"},
+		{"forwarded header", "10.0.0.1", `for=1.2.3.4, for="[2001:db8::1]:4711";proto=https`, "198.51.100.7", "", "2001:db8::1"},
+		{"forwarded takes precedence", "10.0.0.1", "for=198.51.100.8", "198.51.100.7", "198.51.100.9", "198.51.100.8"},
+		{"real IP fallback", "127.0.0.1", "", "", "198.51.100.9", "198.51.100.9"},
+		{"invalid real IP", "127.0.0.1", "", "", "garbage", "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := r.Resolve(tt.remote, tt.forwarded, tt.forwardedFor, tt.realIP)
+			if got != tt.want {
+				t.Errorf("Resolve() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIPRepeatedHeaders(t *testing.T) {
+	// app.Test connections come from 0.0.0.0
+	r, err := NewClientIPResolver("0.0.0.0, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Use(r.Handler())
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendString(ClientIP(c))
+	})
+
+	tests := []struct {
+		name         string
+		forwardedFor []string
+		want         string
+	}{
+		{"one header", []string{"198.51.100.7"}, "198.51.100.7"},
+		// The client sends its own header; the proxy appends a second line
+		{"spoofed first header", []string{"1.2.3.4", "198.51.100.7"}, "198.51.100.7"},
+		{"chained headers", []string{"1.2.3.4, 198.51.100.7", "10.0.0.2"}, "198.51.100.7"},
+		{"empty header line", []string{"198.51.100.7", ""}, "198.51.100.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(fiber.MethodGet, "/", nil)
+			for _, value := range tt.forwardedFor {
+				req.Header.Add(fiber.HeaderXForwardedFor, value)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if got := string(body); got != tt.want {
+				t.Errorf("client IP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"link-shortener/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequestIDHeader carries the request ID on requests and responses
+const RequestIDHeader = "X-Request-ID"
+
+// probePaths are logged at debug level to keep health checks and scrapes
+// out of the default log
+var probePaths = map[string]bool{
+	"/health":  true,
+	"/livez":   true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// RequestLogger gives every request an ID, reusing a well-formed incoming
+// X-Request-ID, and writes one structured log record per request. The ID is
+// returned in the response and carried by c.UserContext(), so records
+// logged with that context are tagged with it. Query strings are not
+// logged since they can carry access tokens. Client IPs are logged the way
+// clicks store them, through ipAnonymizer, and not at all for Do-Not-Track
+// or Global Privacy Control requests when honorDoNotTrack is set.
+func RequestLogger(ipAnonymizer *services.IPAnonymizer, honorDoNotTrack bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
+		id := c.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Set(RequestIDHeader, id)
+		c.SetUserContext(services.WithRequestID(c.UserContext(), id))
+
+		err := c.Next()
+
+		// Errors are turned into responses by the error handler later on
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			if e, ok := err.(*fiber.Error); ok {
+				status = e.Code
+			}
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case status >= fiber.StatusInternalServerError:
+			level = slog.LevelError
+		case probePaths[c.Path()]:
+			level = slog.LevelDebug
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", c.Method()),
+			slog.String("path", c.Path()),
+			slog.String("route", c.Route().Path),
+			slog.Int("status", status),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+		}
+		if !honorDoNotTrack || (c.Get("DNT") != "1" && c.Get("Sec-GPC") != "1") {
+			attrs = append(attrs, slog.String("ip", ipAnonymizer.Anonymize(ClientIP(c), start)))
+		}
+		// Body() would read a streamed body (SSE, exports) into memory and
+		// block until it ends, so its size is only logged for plain bodies
+		if !c.Response().IsBodyStream() {
+			attrs = append(attrs, slog.Int("bytes", len(c.Response().Body())))
+		}
+		if err != nil {
+			attrs = append(attrs, slog.String("error", err.Error()))
+		}
+
+		// The user context now also carries the span of the tracing middleware
+		slog.LogAttrs(c.UserContext(), level, "request", attrs...)
+		return err
+	}
+}
+
+// validRequestID accepts short IDs of URL-safe characters, so client
+// supplied values cannot inject anything into logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-' || r == '_' || r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random 128-bit hex ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+
+	"link-shortener/internal/testdb"
+	"link-shortener/models"
+	"link-shortener/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRequestLoggerIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		honor   bool
+		dnt     bool
+		wantIP  string
+		checkIP func(string) bool
+	}{
+		{name: "off", mode: services.PrivacyModeOff, wantIP: "198.51.100.7"},
+		{name: "truncate", mode: services.PrivacyModeTruncate, wantIP: "198.51.100.0"},
+		{name: "hash", mode: services.PrivacyModeHash, checkIP: func(ip string) bool { return len(ip) > 2 && ip[:2] == "h:" }},
+		{name: "do not track honored", mode: services.PrivacyModeOff, honor: true, dnt: true},
+		{name: "do not track ignored", mode: services.PrivacyModeOff, dnt: true, wantIP: "198.51.100.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			previous := slog.Default()
+			slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+			t.Cleanup(func() { slog.SetDefault(previous) })
+
+			testdb.Open(t, &models.IPHashSalt{})
+			anonymizer, err := services.NewIPAnonymizer(tt.mode, "test-secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// app.Test connects from 0.0.0.0, which forwards the client IP
+			resolver, err := NewClientIPResolver("0.0.0.0/32")
+			if err != nil {
+				t.Fatal(err)
+			}
+			app := fiber.New()
+			app.Use(resolver.Handler())
+			app.Use(RequestLogger(anonymizer, tt.honor))
+			app.Get("/:slug", func(c *fiber.Ctx) error {
+				return c.SendStatus(fiber.StatusFound)
+			})
+
+			req := httptest.NewRequest(fiber.MethodGet, "/abc", nil)
+			req.Header.Set("X-Forwarded-For", "198.51.100.7")
+			if tt.dnt {
+				req.Header.Set("DNT", "1")
+			}
+			if _, err := app.Test(req); err != nil {
+				t.Fatal(err)
+			}
+
+			var record map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+				t.Fatalf("log record %q: %v", buf.String(), err)
+			}
+			ip, logged := record["ip"].(string)
+			switch {
+			case tt.checkIP != nil:
+				if !tt.checkIP(ip) {
+					t.Errorf("ip = %q", ip)
+				}
+			case tt.wantIP == "":
+				if logged {
+					t.Errorf("ip %q logged", ip)
+				}
+			case ip != tt.wantIP:
+				t.Errorf("ip = %q, want %q", ip, tt.wantIP)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"strconv"
+	"time"
+
+	"link-shortener/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Metrics records request counts and latency per route pattern, so
+// /:slug is one series rather than one per short link
+func Metrics() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		// Errors are turned into responses by the error handler later on
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			if e, ok := err.(*fiber.Error); ok {
+				status = e.Code
+			}
+		}
+
+		// Requests that match no route only pass through "/" middleware
+		route := c.Route().Path
+		if status == fiber.StatusNotFound && route == "/" {
+			route = "unmatched"
+		}
+
+		labels := []string{c.Method(), route, strconv.Itoa(status)}
+		services.HTTPRequests.WithLabelValues(labels...).Inc()
+		services.HTTPRequestDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+
+		return err
+	}
+}
+
+// MetricsAuth requires "Authorization: Bearer <token>". Without a token
+// every request is refused, so metrics are never exposed by accident.
+func MetricsAuth(token string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if token == "" {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Metrics are disabled; set METRICS_TOKEN",
+			})
+		}
+		if subtle.ConstantTimeCompare([]byte(c.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid metrics token",
+			})
+		}
+		return c.Next()
+	}
+}
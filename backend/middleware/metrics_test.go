@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestMetricsAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		header     string
+		wantStatus int
+	}{
+		{"no token configured", "", "", fiber.StatusForbidden},
+		{"no token configured with header", "", "Bearer ", fiber.StatusForbidden},
+		{"missing header", "secret", "", fiber.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer wrong", fiber.StatusUnauthorized},
+		{"valid token", "secret", "Bearer secret", fiber.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Get("/metrics", MetricsAuth(tt.token), func(c *fiber.Ctx) error {
+				return c.SendString("metrics")
+			})
+
+			req := httptest.NewRequest(fiber.MethodGet, "/metrics", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// API key scopes
+const (
+	// ScopeRead allows reading links, analytics and audit data
+	ScopeRead = "read"
+	// ScopeCreate allows creating links
+	ScopeCreate = "create"
+	// ScopeDelete allows deleting links
+	ScopeDelete = "delete"
+)
+
+// APIKeyScopes lists the valid scopes
+var APIKeyScopes = []string{ScopeRead, ScopeCreate, ScopeDelete}
+
+// ScopePermissions maps each scope to the permissions it leaves available.
+// A key never has more access than its user's roles grant.
+var ScopePermissions = map[string][]string{
+	ScopeRead:   {PermLinksView, PermLinksViewOwn, PermAuditView, PermUsersView, PermSystemView},
+	ScopeCreate: {PermLinksCreate},
+	ScopeDelete: {PermLinksDelete, PermLinksDeleteOwn},
+}
+
+// ScopesGrant reports whether any of scopes covers perm
+func ScopesGrant(scopes []string, perm string) bool {
+	for _, scope := range scopes {
+		if slices.Contains(ScopePermissions[scope], perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKey is a long-lived credential acting as its user within its scopes.
+// Only a hash of the key is stored.
+type APIKey struct {
+	ID     uint   `gorm:"primarykey" json:"id"`
+	UserID uint   `gorm:"index;not null" json:"user_id"`
+	User   *User  `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Name   string `gorm:"size:100;not null" json:"name"`
+	// Prefix is the start of the key, shown to tell keys apart
+	Prefix  string `gorm:"size:16;not null" json:"prefix"`
+	KeyHash string `gorm:"size:64;uniqueIndex;not null" json:"-"`
+	// Scopes is a comma-separated list of scopes
+	Scopes     string     `gorm:"size:100;not null" json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `gorm:"size:45" json:"last_used_ip,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// ScopeList returns the key's scopes
+func (k *APIKey) ScopeList() []string {
+	return strings.Split(k.Scopes, ",")
+}
+
+// CreateAPIKeyRequest represents the request body for creating an API key
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// APIKeyCreatedResponse includes the key itself, which is only returned once
+type APIKeyCreatedResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
@@ -6,22 +6,46 @@ import (
 
 // Click represents a link click event with analytics data
 type Click struct {
-	ID        uint      `gorm:"primarykey" json:"id"`
-	LinkID    uint      `gorm:"index;not null" json:"link_id"`
-	ClickedAt time.Time `gorm:"autoCreateTime" json:"clicked_at"`
-	IPAddress string    `gorm:"size:45" json:"ip_address"`
-	UserAgent string    `gorm:"size:512" json:"user_agent"`
-	Country   string    `gorm:"size:100" json:"country"`
-	City      string    `gorm:"size:100" json:"city"`
-	Region    string    `gorm:"size:100" json:"region"`
+	ID             uint      `gorm:"primarykey" json:"id"`
+	LinkID         uint      `gorm:"index;not null" json:"link_id"`
+	ClickedAt      time.Time `gorm:"autoCreateTime" json:"clicked_at"`
+	IPAddress      string    `gorm:"size:45" json:"ip_address"`
+	UserAgent      string    `gorm:"size:512" json:"user_agent"`
+	Browser        string    `gorm:"size:50" json:"browser"`
+	BrowserVersion string    `gorm:"size:50" json:"browser_version"`
+	OS             string    `gorm:"column:os;size:50" json:"os"`
+	OSVersion      string    `gorm:"column:os_version;size:50" json:"os_version"`
+	DeviceType     string    `gorm:"size:20" json:"device_type"`
+	Country        string    `gorm:"size:100" json:"country"`
+	CountryCode    string    `gorm:"size:2" json:"country_code"`
+	City           string    `gorm:"size:100" json:"city"`
+	Region         string    `gorm:"size:100" json:"region"`
+	ASN            uint      `gorm:"column:asn" json:"asn,omitempty"`
+	ASOrganization string    `gorm:"column:as_organization;size:255" json:"as_organization,omitempty"`
+	Latitude       *float64  `json:"latitude,omitempty"`
+	Longitude      *float64  `json:"longitude,omitempty"`
+	Referrer       string    `gorm:"size:255;index" json:"referrer"`
+	ReferrerURL    string    `gorm:"size:2048" json:"referrer_url,omitempty"`
+	IsBot          bool      `gorm:"index;default:false" json:"is_bot"`
+	BotReason      string    `gorm:"size:50" json:"bot_reason,omitempty"`
+	// InsertedAt is when the click was stored, which can be well after
+	// ClickedAt when tracking is asynchronous. Rollups use it to include
+	// clicks that arrive late.
+	InsertedAt time.Time `gorm:"not null;default:CURRENT_TIMESTAMP;index" json:"-"`
 }
 
 // ClickStats represents aggregated click statistics
 type ClickStats struct {
-	TotalClicks  int64         `json:"total_clicks"`
-	UniqueIPs    int64         `json:"unique_ips"`
-	TopCountries []CountryStat `json:"top_countries"`
-	RecentClicks []Click       `json:"recent_clicks"`
+	TotalClicks  int64          `json:"total_clicks"`
+	HumanClicks  int64          `json:"human_clicks"`
+	BotClicks    int64          `json:"bot_clicks"`
+	UniqueIPs    int64          `json:"unique_ips"` // estimated unique visitors (IP + user agent)
+	TopCountries []CountryStat  `json:"top_countries"`
+	TopBrowsers  []BrowserStat  `json:"top_browsers"`
+	TopOS        []OSStat       `json:"top_os"`
+	TopDevices   []DeviceStat   `json:"top_devices"`
+	TopReferrers []ReferrerStat `json:"top_referrers"`
+	RecentClicks []Click        `json:"recent_clicks"`
 }
 
 // CountryStat represents click count per country
@@ -29,3 +53,46 @@ type CountryStat struct {
 	Country string `json:"country"`
 	Count   int64  `json:"count"`
 }
+
+// BrowserStat represents click count per browser family
+type BrowserStat struct {
+	Browser string `json:"browser"`
+	Count   int64  `json:"count"`
+}
+
+// OSStat represents click count per operating system family
+type OSStat struct {
+	OS    string `gorm:"column:os" json:"os"`
+	Count int64  `json:"count"`
+}
+
+// DeviceStat represents click count per device type
+type DeviceStat struct {
+	DeviceType string `json:"device_type"`
+	Count      int64  `json:"count"`
+}
+
+// ReferrerStat represents click count per referrer host ("direct" when none)
+type ReferrerStat struct {
+	Referrer string `json:"referrer"`
+	Count    int64  `json:"count"`
+}
+
+// TimeseriesPoint represents click count for one time bucket (and group)
+type TimeseriesPoint struct {
+	Bucket time.Time `json:"bucket"`
+	Group  string    `gorm:"column:group" json:"group,omitempty"`
+	Count  int64     `json:"count"`
+}
+
+// Timeseries represents bucketed click counts for a link
+type Timeseries struct {
+	LinkID   uint              `json:"link_id"`
+	Interval string            `json:"interval"`
+	Timezone string            `json:"timezone"`
+	From     time.Time         `json:"from"`
+	To       time.Time         `json:"to"`
+	GroupBy  string            `json:"group_by,omitempty"`
+	Traffic  string            `json:"traffic"`
+	Points   []TimeseriesPoint `json:"points"`
+}
@@ -8,15 +8,17 @@ import (
 
 // Link represents a shortened URL
 type Link struct {
-	ID             uint           `gorm:"primarykey" json:"id"`
-	Slug           string         `gorm:"uniqueIndex;size:30" json:"slug"`
-	OriginalURL    string         `gorm:"size:2048;not null" json:"original_url"`
-	CreatedByAdmin bool           `gorm:"default:false" json:"created_by_admin"`
-	CreatedAt      time.Time      `json:"created_at"`
-	ExpiresAt      *time.Time     `json:"expires_at,omitempty"`
-	Clicks         []Click        `gorm:"foreignKey:LinkID" json:"clicks,omitempty"`
-	ClickCount     int64          `gorm:"-" json:"click_count"`
-	DeletedAt      gorm.DeletedAt `gorm:"index" json:"-"`
+	ID          uint   `gorm:"primarykey" json:"id"`
+	Slug        string `gorm:"uniqueIndex;size:30" json:"slug"`
+	OriginalURL string `gorm:"size:2048;not null" json:"original_url"`
+	// UserID is the account that created the link; nil for anonymous public links
+	UserID     *uint          `gorm:"index" json:"user_id,omitempty"`
+	Owner      *User          `gorm:"foreignKey:UserID;constraint:OnDelete:SET NULL" json:"owner,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	ExpiresAt  *time.Time     `json:"expires_at,omitempty"`
+	Clicks     []Click        `gorm:"foreignKey:LinkID" json:"clicks,omitempty"`
+	ClickCount int64          `gorm:"-" json:"click_count"`
+	DeletedAt  gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
 // IsExpired checks if the link has expired
@@ -4,12 +4,57 @@ import (
 	"time"
 )
 
+// Reasons a login attempt failed
+const (
+	// LoginFailureCredentials means the username or password was wrong
+	LoginFailureCredentials = "invalid_credentials"
+	// LoginFailureTwoFactor means the TOTP or recovery code was wrong
+	LoginFailureTwoFactor = "invalid_2fa_code"
+	// LoginFailureThrottled means the attempt came before the progressive
+	// delay after earlier failures had passed
+	LoginFailureThrottled = "throttled"
+	// LoginFailureLocked means the username or IP address was locked out
+	LoginFailureLocked = "locked"
+	// LoginFailureNoAccess means a single sign-on identity was granted no
+	// role or its account is disabled
+	LoginFailureNoAccess = "sso_no_access"
+)
+
 // LoginAttempt records login attempts for security auditing
 type LoginAttempt struct {
-	ID        uint      `gorm:"primarykey" json:"id"`
-	Username  string    `gorm:"size:100" json:"username"`
-	IPAddress string    `gorm:"size:45" json:"ip_address"`
-	UserAgent string    `gorm:"size:512" json:"user_agent"`
-	Success   bool      `json:"success"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        uint   `gorm:"primarykey" json:"id"`
+	Username  string `gorm:"size:100;index" json:"username"`
+	IPAddress string `gorm:"size:45;index" json:"ip_address"`
+	UserAgent string `gorm:"size:512" json:"user_agent"`
+	Success   bool   `json:"success"`
+	// FailureReason is one of the LoginFailure* constants; empty for
+	// successful attempts and for failures recorded before reasons existed
+	FailureReason string    `gorm:"size:32;not null;default:''" json:"failure_reason,omitempty"`
+	CreatedAt     time.Time `gorm:"index" json:"created_at"`
+}
+
+// Lockout scopes
+const (
+	LockoutScopeUsername = "username"
+	LockoutScopeIP       = "ip"
+)
+
+// LoginLockout temporarily blocks logins for a username or an IP address
+// after too many failed attempts
+type LoginLockout struct {
+	ID    uint   `gorm:"primarykey" json:"id"`
+	Scope string `gorm:"size:16;not null;index:idx_login_lockouts_subject" json:"scope"`
+	// Subject is the locked username or IP address
+	Subject     string     `gorm:"size:100;not null;index:idx_login_lockouts_subject" json:"subject"`
+	Failures    int        `gorm:"not null" json:"failures"`
+	LockedUntil time.Time  `gorm:"not null" json:"locked_until"`
+	UnlockedAt  *time.Time `json:"unlocked_at,omitempty"`
+	// UnlockedBy is the username of the account that lifted the lockout
+	UnlockedBy string    `gorm:"size:100" json:"unlocked_by,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// IsActive reports whether the lockout still blocks logins at now
+func (l *LoginLockout) IsActive(now time.Time) bool {
+	return l.UnlockedAt == nil && l.LockedUntil.After(now)
 }
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+// OIDCLoginState keeps the secrets of a started single sign-on until the
+// identity provider redirects back. It is deleted when the login completes.
+type OIDCLoginState struct {
+	State string `gorm:"primarykey;size:64"`
+	Nonce string `gorm:"size:64;not null"`
+	// CodeVerifier is the PKCE verifier; only its challenge is sent to the
+	// identity provider with the authorization request
+	CodeVerifier string    `gorm:"size:128;not null"`
+	ExpiresAt    time.Time `gorm:"not null;index"`
+	CreatedAt    time.Time
+}
+
+// TableName keeps GORM from splitting "OIDC" at "ID"
+func (OIDCLoginState) TableName() string {
+	return "oidc_login_states"
+}
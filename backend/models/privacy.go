@@ -0,0 +1,14 @@
+package models
+
+import (
+	"time"
+)
+
+// IPHashSalt is the random salt mixed into IP hashes for one UTC day. It
+// is shared by all instances while the day lasts and deleted afterwards,
+// so past hashes cannot be recomputed, even with the hash secret.
+type IPHashSalt struct {
+	Day       string `gorm:"primarykey;size:10"`
+	Salt      string `gorm:"size:64;not null"`
+	CreatedAt time.Time
+}
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"slices"
+	"strings"
+)
+
+// Account roles
+const (
+	// RoleOwner has full access, including account management
+	RoleOwner = "owner"
+	// RoleEditor creates links and manages and analyses its own links
+	RoleEditor = "editor"
+	// RoleViewer has read-only access to all links and their analytics
+	RoleViewer = "viewer"
+	// RoleAuditor reviews login attempts and accounts
+	RoleAuditor = "auditor"
+)
+
+// Permissions checked by admin routes
+const (
+	// PermLinksView allows viewing and exporting every link's analytics
+	PermLinksView = "links:view"
+	// PermLinksViewOwn allows viewing and exporting own links' analytics
+	PermLinksViewOwn = "links:view_own"
+	// PermLinksCreate allows creating permanent links
+	PermLinksCreate = "links:create"
+	// PermLinksDelete allows deleting any link
+	PermLinksDelete = "links:delete"
+	// PermLinksDeleteOwn allows deleting own links
+	PermLinksDeleteOwn = "links:delete_own"
+	// PermAuditView allows reading the login audit
+	PermAuditView = "audit:view"
+	// PermUsersView allows listing accounts
+	PermUsersView = "users:view"
+	// PermUsersManage allows creating, changing and deleting accounts
+	PermUsersManage = "users:manage"
+	// PermWebhooksManage allows managing webhook subscriptions
+	PermWebhooksManage = "webhooks:manage"
+	// PermSystemView allows reading service internals such as geo stats
+	PermSystemView = "system:view"
+	// PermAccountSelf allows changing one's own password and API keys. No
+	// API key scope grants it, so keys cannot manage credentials.
+	PermAccountSelf = "account:self"
+)
+
+// Roles lists the valid roles
+var Roles = []string{RoleOwner, RoleEditor, RoleViewer, RoleAuditor}
+
+// RolePermissions maps each role to the permissions it grants
+var RolePermissions = map[string][]string{
+	RoleOwner: {
+		PermLinksView, PermLinksViewOwn, PermLinksCreate, PermLinksDelete, PermLinksDeleteOwn,
+		PermAuditView, PermUsersView, PermUsersManage, PermWebhooksManage, PermSystemView,
+		PermAccountSelf,
+	},
+	RoleEditor:  {PermLinksViewOwn, PermLinksCreate, PermLinksDeleteOwn, PermAccountSelf},
+	RoleViewer:  {PermLinksView, PermSystemView, PermAccountSelf},
+	RoleAuditor: {PermAuditView, PermUsersView, PermSystemView, PermAccountSelf},
+}
+
+// IsValidRole reports whether role is a known role
+func IsValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+// RoleList returns the user's roles
+func (u *User) RoleList() []string {
+	if u.Roles == "" {
+		return nil
+	}
+	return strings.Split(u.Roles, ",")
+}
+
+// HasRole reports whether the user has role
+func (u *User) HasRole(role string) bool {
+	return slices.Contains(u.RoleList(), role)
+}
+
+// Can reports whether any of the user's roles grants perm. Requests made
+// with an API key are further limited to the key's scopes.
+func (u *User) Can(perm string) bool {
+	if u.APIKeyScopes != nil && !ScopesGrant(u.APIKeyScopes, perm) {
+		return false
+	}
+	for _, role := range u.RoleList() {
+		if slices.Contains(RolePermissions[role], perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions returns the permissions granted by the user's roles
+func (u *User) Permissions() []string {
+	var perms []string
+	for _, role := range u.RoleList() {
+		for _, p := range RolePermissions[role] {
+			if !slices.Contains(perms, p) && u.Can(p) {
+				perms = append(perms, p)
+			}
+		}
+	}
+	return perms
+}
+
+// Owns reports whether the user created link
+func (u *User) Owns(link *Link) bool {
+	return link.UserID != nil && *link.UserID == u.ID
+}
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"slices"
+	"testing"
+)
+
+// allPermissions lists every permission checked by admin routes
+var allPermissions = []string{
+	PermLinksView, PermLinksViewOwn, PermLinksCreate, PermLinksDelete, PermLinksDeleteOwn,
+	PermAuditView, PermUsersView, PermUsersManage, PermWebhooksManage, PermSystemView,
+	PermAccountSelf,
+}
+
+func TestRolePermissions(t *testing.T) {
+	// The full matrix, so granting a role a new permission is a deliberate
+	// change to this table
+	want := map[string][]string{
+		RoleOwner: allPermissions,
+		RoleEditor: {
+			PermLinksViewOwn, PermLinksCreate, PermLinksDeleteOwn, PermAccountSelf,
+		},
+		RoleViewer: {
+			PermLinksView, PermSystemView, PermAccountSelf,
+		},
+		RoleAuditor: {
+			PermAuditView, PermUsersView, PermSystemView, PermAccountSelf,
+		},
+	}
+
+	for _, role := range Roles {
+		user := User{Roles: role}
+		for _, perm := range allPermissions {
+			if got := user.Can(perm); got != slices.Contains(want[role], perm) {
+				t.Errorf("%s can %s = %v, want %v", role, perm, got, !got)
+			}
+		}
+		if got := user.Permissions(); !slices.Equal(got, RolePermissions[role]) {
+			t.Errorf("%s permissions = %v, want %v", role, got, RolePermissions[role])
+		}
+	}
+	if len(RolePermissions) != len(want) {
+		t.Errorf("%d roles have permissions, want %d", len(RolePermissions), len(want))
+	}
+}
+
+func TestUserCan(t *testing.T) {
+	tests := []struct {
+		name  string
+		roles string
+		perm  string
+		want  bool
+	}{
+		// Roles combine
+		{"editor and auditor reads the audit", "editor,auditor", PermAuditView, true},
+		{"editor and auditor creates links", "editor,auditor", PermLinksCreate, true},
+		{"editor and auditor cannot manage users", "editor,auditor", PermUsersManage, false},
+		{"no roles", "", PermAccountSelf, false},
+		{"unknown role", "admin", PermLinksView, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := User{Roles: tt.roles}
+			if got := user.Can(tt.perm); got != tt.want {
+				t.Errorf("Can(%s) = %v, want %v", tt.perm, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsValidRole(t *testing.T) {
+	for _, role := range Roles {
+		if !IsValidRole(role) {
+			t.Errorf("IsValidRole(%q) = false", role)
+		}
+	}
+	for _, role := range []string{"", "admin", "Owner"} {
+		if IsValidRole(role) {
+			t.Errorf("IsValidRole(%q) = true", role)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+)
+
+// ClickHourlyRollup holds pre-aggregated click counts per link, hour and dimensions
+type ClickHourlyRollup struct {
+	ID          uint      `gorm:"primarykey" json:"-"`
+	LinkID      uint      `gorm:"not null;uniqueIndex:idx_hourly_rollup_key,priority:1" json:"link_id"`
+	BucketStart time.Time `gorm:"not null;uniqueIndex:idx_hourly_rollup_key,priority:2;index" json:"bucket_start"`
+	Country     string    `gorm:"size:100;not null;default:'';uniqueIndex:idx_hourly_rollup_key,priority:3" json:"country"`
+	DeviceType  string    `gorm:"size:20;not null;default:'';uniqueIndex:idx_hourly_rollup_key,priority:4" json:"device_type"`
+	Browser     string    `gorm:"size:50;not null;default:'';uniqueIndex:idx_hourly_rollup_key,priority:5" json:"browser"`
+	OS          string    `gorm:"column:os;size:50;not null;default:'';uniqueIndex:idx_hourly_rollup_key,priority:6" json:"os"`
+	Referrer    string    `gorm:"size:255;not null;default:'';uniqueIndex:idx_hourly_rollup_key,priority:7" json:"referrer"`
+	IsBot       bool      `gorm:"not null;default:false;uniqueIndex:idx_hourly_rollup_key,priority:8" json:"is_bot"`
+	Clicks      int64     `gorm:"not null;default:0" json:"clicks"`
+}
+
+// ClickDailyRollup holds pre-aggregated click counts per link, UTC day and dimensions
+type ClickDailyRollup struct {
+	ID          uint      `gorm:"primarykey" json:"-"`
+	LinkID      uint      `gorm:"not null;uniqueIndex:idx_daily_rollup_key,priority:1" json:"link_id"`
+	BucketStart time.Time `gorm:"not null;uniqueIndex:idx_daily_rollup_key,priority:2;index" json:"bucket_start"`
+	Country     string    `gorm:"size:100;not null;default:'';uniqueIndex:idx_daily_rollup_key,priority:3" json:"country"`
+	DeviceType  string    `gorm:"size:20;not null;default:'';uniqueIndex:idx_daily_rollup_key,priority:4" json:"device_type"`
+	Browser     string    `gorm:"size:50;not null;default:'';uniqueIndex:idx_daily_rollup_key,priority:5" json:"browser"`
+	OS          string    `gorm:"column:os;size:50;not null;default:'';uniqueIndex:idx_daily_rollup_key,priority:6" json:"os"`
+	Referrer    string    `gorm:"size:255;not null;default:'';uniqueIndex:idx_daily_rollup_key,priority:7" json:"referrer"`
+	IsBot       bool      `gorm:"not null;default:false;uniqueIndex:idx_daily_rollup_key,priority:8" json:"is_bot"`
+	Clicks      int64     `gorm:"not null;default:0" json:"clicks"`
+}
+
+// RollupState tracks how far a background job (click rollups, the webhook
+// expiry sweep) has processed data
+type RollupState struct {
+	Name        string    `gorm:"primaryKey;size:50" json:"name"`
+	RolledUntil time.Time `json:"rolled_until"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// VisitorSketch stores a HyperLogLog sketch of unique visitors per link and UTC day
+type VisitorSketch struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	LinkID    uint      `gorm:"not null;uniqueIndex:idx_visitor_sketch_key,priority:1" json:"link_id"`
+	Day       time.Time `gorm:"type:date;not null;uniqueIndex:idx_visitor_sketch_key,priority:2" json:"day"`
+	IsBot     bool      `gorm:"not null;default:false;uniqueIndex:idx_visitor_sketch_key,priority:3" json:"is_bot"`
+	Registers []byte    `gorm:"type:bytea;not null" json:"-"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
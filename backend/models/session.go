@@ -0,0 +1,61 @@
+package models
+
+import (
+	"time"
+)
+
+// RefreshToken is a single-use token that renews a sign-in session. Each
+// refresh replaces it with a new one in the same session; only a hash of
+// the token is stored.
+type RefreshToken struct {
+	ID     uint  `gorm:"primarykey"`
+	UserID uint  `gorm:"index;not null"`
+	User   *User `gorm:"constraint:OnDelete:CASCADE"`
+	// SessionID is shared by all tokens of a sign-in, from login to logout
+	SessionID string `gorm:"size:32;index;not null"`
+	// SessionStartedAt is the time of the sign-in; refresh tokens never
+	// outlive it by more than the maximum session age
+	SessionStartedAt time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	TokenHash        string    `gorm:"size:64;uniqueIndex;not null"`
+	// AccessJTI and AccessExpiresAt identify the access token issued with
+	// this refresh token, so it can be revoked with the session
+	AccessJTI       string    `gorm:"size:32;not null"`
+	AccessExpiresAt time.Time `gorm:"not null"`
+	ExpiresAt       time.Time `gorm:"not null;index"`
+	// UsedAt is set when the token was exchanged for a new one
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	IPAddress string `gorm:"size:45"`
+	UserAgent string `gorm:"size:512"`
+	CreatedAt time.Time
+}
+
+// RevokedToken is a denylisted access token, kept until it expires
+type RevokedToken struct {
+	JTI       string    `gorm:"primarykey;size:32"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	CreatedAt time.Time
+}
+
+// StreamTicket is a short-lived, single-use credential for opening a live
+// click stream. Browsers cannot set headers on EventSource and WebSocket
+// connections, so the ticket is sent in the URL instead of the access
+// token, which would otherwise end up in proxy logs and browser history.
+type StreamTicket struct {
+	ID         uint   `gorm:"primarykey"`
+	UserID     uint   `gorm:"index;not null"`
+	User       *User  `gorm:"constraint:OnDelete:CASCADE"`
+	TicketHash string `gorm:"size:64;uniqueIndex;not null"`
+	// SessionID and AccessJTI identify the sign-in and access token the
+	// ticket was issued for; revoking them invalidates the ticket and the
+	// streams opened with it
+	SessionID string    `gorm:"size:32;not null;default:''"`
+	AccessJTI string    `gorm:"size:32;not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	CreatedAt time.Time
+}
+
+// RefreshRequest represents the request body for renewing a session
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
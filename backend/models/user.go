@@ -0,0 +1,82 @@
+package models
+
+import (
+	"time"
+)
+
+// User is an account that can sign in to the admin panel and own links
+type User struct {
+	ID           uint   `gorm:"primarykey" json:"id"`
+	Username     string `gorm:"uniqueIndex;size:100;not null" json:"username"`
+	PasswordHash string `gorm:"size:255;not null" json:"-"`
+	// Roles is a comma-separated list of roles
+	Roles       string     `gorm:"size:100;not null;default:''" json:"roles"`
+	Active      bool       `gorm:"not null" json:"active"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+
+	// TOTPSecret is the base32 RFC 6238 secret, encrypted with the server
+	// secret; it is set during enrolment and only checked at login once
+	// TOTPEnabled is true
+	TOTPSecret  string `gorm:"size:128" json:"-"`
+	TOTPEnabled bool   `gorm:"not null" json:"totp_enabled"`
+	// TOTPLastStep is the time step of the last accepted code, so a code
+	// cannot be used twice
+	TOTPLastStep int64 `gorm:"not null" json:"-"`
+
+	// OIDCIssuer and OIDCSubject identify the single sign-on identity of
+	// accounts created by it; accounts with a password leave them empty.
+	// Column names are explicit, as GORM would split "OIDC" at "ID".
+	OIDCIssuer  string  `gorm:"column:oidc_issuer;size:255;not null;default:'';uniqueIndex:idx_users_oidc_identity" json:"-"`
+	OIDCSubject *string `gorm:"column:oidc_subject;size:255;uniqueIndex:idx_users_oidc_identity" json:"-"`
+
+	// APIKeyScopes limits the user's permissions while authenticated with
+	// an API key; nil for sign-in tokens. UsedAPIKeyID identifies that key.
+	APIKeyScopes []string `gorm:"-" json:"-"`
+	UsedAPIKeyID uint     `gorm:"-" json:"-"`
+}
+
+// CreateUserRequest represents the request body for creating a user
+type CreateUserRequest struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+}
+
+// UpdateUserRequest represents the request body for updating a user.
+// Omitted fields are left unchanged.
+type UpdateUserRequest struct {
+	Password *string  `json:"password,omitempty"`
+	Roles    []string `json:"roles,omitempty"`
+	Active   *bool    `json:"active,omitempty"`
+	// DisableTwoFactor turns off two-factor authentication, e.g. after the
+	// account's authenticator was lost
+	DisableTwoFactor bool `json:"disable_two_factor,omitempty"`
+}
+
+// ChangePasswordRequest represents the request body for changing one's own password
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// TwoFactorSetupRequest represents the request body for starting TOTP
+// enrolment
+type TwoFactorSetupRequest struct {
+	Password string `json:"password"`
+}
+
+// TwoFactorCodeRequest represents a request body carrying a code from the
+// authenticator app
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// DisableTwoFactorRequest represents the request body for turning off
+// one's own two-factor authentication
+type DisableTwoFactorRequest struct {
+	Password string `json:"password"`
+	// Code is a current TOTP code or an unused recovery code
+	Code string `json:"code"`
+}
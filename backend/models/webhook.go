@@ -0,0 +1,79 @@
+package models
+
+import (
+	"time"
+)
+
+// Webhook event types
+const (
+	WebhookLinkCreated = "link.created"
+	WebhookLinkDeleted = "link.deleted"
+	WebhookLinkExpired = "link.expired"
+	WebhookLinkClicked = "link.clicked"
+)
+
+// Webhook delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliveryRetrying  = "retrying"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// WebhookSubscription is an endpoint that receives signed event payloads
+type WebhookSubscription struct {
+	ID     uint   `gorm:"primarykey" json:"id"`
+	URL    string `gorm:"size:2048;not null" json:"url"`
+	Secret string `gorm:"size:128;not null" json:"-"`
+	// Events is a comma-separated list of subscribed event types
+	Events string `gorm:"size:255;not null" json:"events"`
+	Active bool   `gorm:"not null" json:"active"`
+	// ClickSampleRate is the fraction of click events delivered (0-1]
+	ClickSampleRate float64 `gorm:"not null" json:"click_sample_rate"`
+	// ClickBatchSize groups up to this many clicks into one delivery (1 disables batching)
+	ClickBatchSize int       `gorm:"not null" json:"click_batch_size"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// WebhookDelivery is an outbox entry for one event sent to one subscription.
+// Rows are kept after delivery as the subscription's delivery log.
+type WebhookDelivery struct {
+	ID             uint       `gorm:"primarykey" json:"id"`
+	SubscriptionID uint       `gorm:"not null;index" json:"subscription_id"`
+	Event          string     `gorm:"size:50;not null" json:"event"`
+	Payload        string     `gorm:"type:text;not null" json:"payload"`
+	Status         string     `gorm:"size:20;not null;index:idx_webhook_delivery_due,priority:1" json:"status"`
+	Attempts       int        `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt  time.Time  `gorm:"not null;index:idx_webhook_delivery_due,priority:2" json:"next_attempt_at"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty"`
+	ResponseStatus int        `json:"response_status,omitempty"`
+	LastError      string     `gorm:"size:1024" json:"last_error,omitempty"`
+	CreatedAt      time.Time  `gorm:"index" json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// WebhookQueuedClick is a sampled click waiting to be batched into a
+// link.clicked delivery. Queuing clicks in the database keeps partial
+// batches across restarts.
+type WebhookQueuedClick struct {
+	ID             uint   `gorm:"primarykey"`
+	SubscriptionID uint   `gorm:"not null;index"`
+	Data           string `gorm:"type:text;not null"`
+	CreatedAt      time.Time
+}
+
+// WebhookRequest represents the request body for creating or updating a webhook
+type WebhookRequest struct {
+	URL             string   `json:"url"`
+	Events          []string `json:"events"`
+	Active          *bool    `json:"active,omitempty"`
+	ClickSampleRate *float64 `json:"click_sample_rate,omitempty"`
+	ClickBatchSize  *int     `json:"click_batch_size,omitempty"`
+}
+
+// WebhookCreatedResponse includes the signing secret, which is only shown once
+type WebhookCreatedResponse struct {
+	WebhookSubscription
+	Secret string `json:"secret"`
+}
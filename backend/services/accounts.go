@@ -0,0 +1,243 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/models"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Errors returned by account operations
+var (
+	// ErrInvalidCredentials means the username or password is wrong, or the
+	// account is disabled
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrUnknownPasswordHash means a stored hash uses an unsupported scheme
+	ErrUnknownPasswordHash = errors.New("unknown password hash format")
+	// ErrWeakBootstrapPassword means the configured admin password is the
+	// published default or too short to create the first account with
+	ErrWeakBootstrapPassword = fmt.Errorf("ADMIN_PASSWORD must be changed from the default and be %d-%d characters long", MinPasswordLength, MaxPasswordLength)
+)
+
+// defaultAdminPassword is the ADMIN_PASSWORD default, which is refused when
+// creating the bootstrap account
+const defaultAdminPassword = "admin123"
+
+// Password length limits; bcrypt ignores input beyond 72 bytes
+const (
+	MinPasswordLength = 10
+	MaxPasswordLength = 72
+)
+
+// argon2id parameters (OWASP recommendation: 19 MiB, 2 iterations)
+const (
+	argonMemory  = 19 * 1024
+	argonTime    = 2
+	argonThreads = 1
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+// dummyHash is verified when a username does not exist, so failed logins
+// take the same time whether or not the account exists
+var dummyHash, _ = HashPassword("kintercut-dummy-password")
+
+// HashPassword hashes a password with argon2id in PHC string format
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// CheckPassword reports whether password matches hash. Both argon2id hashes
+// and bcrypt hashes (e.g. imported from htpasswd) are accepted.
+func CheckPassword(hash, password string) (bool, error) {
+	switch {
+	case hash == "":
+		// Accounts created by single sign-on have no password; the dummy
+		// check keeps them indistinguishable by timing
+		CheckPassword(dummyHash, password)
+		return false, nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return checkArgon2id(hash, password)
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	default:
+		return false, ErrUnknownPasswordHash
+	}
+}
+
+// checkArgon2id verifies a password against a PHC formatted argon2id hash
+func checkArgon2id(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, ErrUnknownPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, ErrUnknownPasswordHash
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, ErrUnknownPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, ErrUnknownPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, ErrUnknownPasswordHash
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+// ValidatePassword returns a message describing why password is not
+// acceptable, or "" if it is
+func ValidatePassword(password string) string {
+	switch {
+	case len(password) < MinPasswordLength:
+		return fmt.Sprintf("Password must be at least %d characters long", MinPasswordLength)
+	case len(password) > MaxPasswordLength:
+		return fmt.Sprintf("Password must be at most %d bytes long", MaxPasswordLength)
+	}
+	return ""
+}
+
+// Authenticate checks a username and password and returns the active user
+func Authenticate(username, password string) (*models.User, error) {
+	var user models.User
+	err := database.DB.Where("username = ?", username).Take(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		CheckPassword(dummyHash, password)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := CheckPassword(user.PasswordHash, password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || !user.Active {
+		return nil, ErrInvalidCredentials
+	}
+
+	now := time.Now()
+	database.DB.Model(&user).UpdateColumn("last_login_at", now)
+	user.LastLoginAt = &now
+	return &user, nil
+}
+
+// ActiveUser returns the user with the given ID if it exists and is active
+func ActiveUser(id uint) (*models.User, error) {
+	var user models.User
+	if err := database.DB.Where("id = ? AND active", id).Take(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// JoinRoles validates roles and returns them as the comma-separated list
+// stored on a user. At least one role is required.
+func JoinRoles(roles []string) (string, error) {
+	seen := make(map[string]bool, len(roles))
+	var valid []string
+	for _, role := range roles {
+		role = strings.ToLower(strings.TrimSpace(role))
+		if !models.IsValidRole(role) {
+			return "", fmt.Errorf("Unknown role %q. Use %s", role, strings.Join(models.Roles, ", "))
+		}
+		if !seen[role] {
+			seen[role] = true
+			valid = append(valid, role)
+		}
+	}
+	if len(valid) == 0 {
+		return "", errors.New("At least one role is required")
+	}
+	return strings.Join(valid, ","), nil
+}
+
+// BootstrapAdmin creates the configured admin account as an owner when no
+// users exist yet, so a fresh install can sign in. Afterwards accounts are
+// managed through the API and the configured password is no longer used.
+// Links created by the former single admin are assigned to the new account.
+// The default or a too short password is refused with ErrWeakBootstrapPassword.
+func BootstrapAdmin(username, password string) error {
+	// Accounts created before roles existed had full access
+	if err := database.DB.Model(&models.User{}).Where("roles = ''").
+		UpdateColumn("roles", models.RoleOwner).Error; err != nil {
+		return err
+	}
+
+	var count int64
+	if err := database.DB.Model(&models.User{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	if password == defaultAdminPassword || ValidatePassword(password) != "" {
+		return ErrWeakBootstrapPassword
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	user := models.User{
+		Username:     username,
+		PasswordHash: hash,
+		Roles:        models.RoleOwner,
+		Active:       true,
+	}
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		slog.Info("created bootstrap admin account", "username", username)
+
+		if !tx.Migrator().HasColumn(&models.Link{}, "created_by_admin") {
+			return nil
+		}
+		result := tx.Model(&models.Link{}).Unscoped().
+			Where("created_by_admin AND user_id IS NULL").
+			UpdateColumn("user_id", user.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		slog.Info("assigned admin links to bootstrap account", "links", result.RowsAffected)
+		return tx.Migrator().DropColumn(&models.Link{}, "created_by_admin")
+	})
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"link-shortener/database"
+	"link-shortener/internal/testdb"
+	"link-shortener/models"
+)
+
+func TestBootstrapAdmin(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		wantErr  error
+	}{
+		{"default password", "admin123", ErrWeakBootstrapPassword},
+		{"short password", "short-pw", ErrWeakBootstrapPassword},
+		{"strong password", "correct horse battery", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testdb.Open(t, &models.User{}, &models.Link{})
+
+			err := BootstrapAdmin("admin", tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("BootstrapAdmin() = %v, want %v", err, tt.wantErr)
+			}
+
+			var users []models.User
+			database.DB.Find(&users)
+			if tt.wantErr != nil {
+				if len(users) != 0 {
+					t.Errorf("created %d accounts with a refused password", len(users))
+				}
+				return
+			}
+			if len(users) != 1 || users[0].Roles != models.RoleOwner || !users[0].Active {
+				t.Fatalf("accounts = %+v, want one active owner", users)
+			}
+			if _, err := Authenticate("admin", tt.password); err != nil {
+				t.Errorf("cannot sign in with the bootstrap password: %v", err)
+			}
+		})
+	}
+}
+
+func TestBootstrapAdminExistingAccounts(t *testing.T) {
+	testdb.Open(t, &models.User{}, &models.Link{})
+
+	if err := database.DB.Create(&models.User{Username: "alice", Active: true}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// The configured password is not used once accounts exist
+	if err := BootstrapAdmin("admin", "admin123"); err != nil {
+		t.Fatalf("BootstrapAdmin() = %v, want nil", err)
+	}
+
+	var user models.User
+	database.DB.Where("username = ?", "alice").Take(&user)
+	if user.Roles != models.RoleOwner {
+		t.Errorf("roles of a pre-roles account = %q, want %q", user.Roles, models.RoleOwner)
+	}
+	var count int64
+	database.DB.Model(&models.User{}).Count(&count)
+	if count != 1 {
+		t.Errorf("got %d accounts, want 1", count)
+	}
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/internal/testdb"
+	"link-shortener/models"
+)
+
+func TestJoinScopes(t *testing.T) {
+	tests := []struct {
+		scopes  []string
+		want    string
+		wantErr bool
+	}{
+		{[]string{"read"}, "read", false},
+		{[]string{" Read ", "create", "read"}, "read,create", false},
+		{[]string{"read", "create", "delete"}, "read,create,delete", false},
+		{[]string{"admin"}, "", true},
+		{nil, "", true},
+	}
+	for _, tt := range tests {
+		got, err := JoinScopes(tt.scopes)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("JoinScopes(%q) = %q, %v; want %q, error %v", tt.scopes, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestAuthenticateAPIKeyScopes(t *testing.T) {
+	testdb.Open(t, &models.User{}, &models.APIKey{})
+
+	// newKey stores a key of a new user with roles and returns the key
+	newKey := func(t *testing.T, username, roles, scopes string, change func(*models.User, *models.APIKey)) string {
+		t.Helper()
+		user := models.User{Username: username, PasswordHash: "unused", Roles: roles, Active: true}
+		key, prefix, hash, err := GenerateAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		apiKey := models.APIKey{Name: "test", Prefix: prefix, KeyHash: hash, Scopes: scopes}
+		if change != nil {
+			change(&user, &apiKey)
+		}
+		if err := database.DB.Create(&user).Error; err != nil {
+			t.Fatal(err)
+		}
+		apiKey.UserID = user.ID
+		if err := database.DB.Create(&apiKey).Error; err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	t.Run("scopes narrow the owner's roles", func(t *testing.T) {
+		key := newKey(t, "owner", models.RoleOwner, models.ScopeRead, nil)
+		user, err := AuthenticateAPIKey(key, "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, perm := range []string{models.PermLinksView, models.PermAuditView, models.PermSystemView} {
+			if !user.Can(perm) {
+				t.Errorf("read key cannot %s", perm)
+			}
+		}
+		// Allowed by the owner role, but not by the key's scope
+		for _, perm := range []string{models.PermLinksCreate, models.PermLinksDelete, models.PermUsersManage, models.PermWebhooksManage, models.PermAccountSelf} {
+			if user.Can(perm) {
+				t.Errorf("read key can %s", perm)
+			}
+		}
+	})
+
+	t.Run("scopes do not widen the roles", func(t *testing.T) {
+		key := newKey(t, "editor", models.RoleEditor, "read,create,delete", nil)
+		user, err := AuthenticateAPIKey(key, "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Can(models.PermLinksView) || user.Can(models.PermLinksDelete) {
+			t.Error("key has access to every link, which its editor does not")
+		}
+		if !user.Can(models.PermLinksViewOwn) || !user.Can(models.PermLinksCreate) || !user.Can(models.PermLinksDeleteOwn) {
+			t.Error("key lacks permissions granted by both its scopes and roles")
+		}
+	})
+
+	past := time.Now().Add(-time.Hour)
+	refused := []struct {
+		name   string
+		change func(*models.User, *models.APIKey)
+	}{
+		{"revoked", func(_ *models.User, k *models.APIKey) { k.RevokedAt = &past }},
+		{"expired", func(_ *models.User, k *models.APIKey) { k.ExpiresAt = &past }},
+		{"disabled user", func(u *models.User, _ *models.APIKey) { u.Active = false }},
+	}
+	for _, tt := range refused {
+		t.Run(tt.name, func(t *testing.T) {
+			key := newKey(t, tt.name, models.RoleOwner, models.ScopeRead, tt.change)
+			if _, err := AuthenticateAPIKey(key, "192.0.2.1"); !errors.Is(err, ErrInvalidAPIKey) {
+				t.Errorf("AuthenticateAPIKey() error = %v, want ErrInvalidAPIKey", err)
+			}
+		})
+	}
+}
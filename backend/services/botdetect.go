@@ -0,0 +1,217 @@
+package services
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Bot classification reasons stored on clicks
+const (
+	BotReasonNone          = ""
+	BotReasonEmptyUA       = "empty_user_agent"
+	BotReasonKnownCrawler  = "known_crawler"
+	BotReasonUAPattern     = "user_agent_pattern"
+	BotReasonHTTPLibrary   = "http_library"
+	BotReasonPrefetch      = "prefetch"
+	BotReasonHeadRequest   = "head_request"
+	BotReasonMissingHeader = "missing_browser_headers"
+)
+
+// knownCrawlers lists user agent tokens of well-known crawlers, link
+// preview fetchers and security scanners (matched case-insensitively).
+// Tokens must be specific to the bot: apps such as WhatsApp, Tumblr or
+// Outlook name themselves in the user agent of their in-app browsers, and
+// Sogou makes a browser too.
+var knownCrawlers = []string{
+	"googlebot",
+	"adsbot-google",
+	"mediapartners-google",
+	"google-inspectiontool",
+	"googleother",
+	"bingbot",
+	"bingpreview",
+	"msnbot",
+	"slurp",
+	"duckduckbot",
+	"baiduspider",
+	"yandexbot",
+	"yandex.com/bots",
+	"sogou web spider",
+	"exabot",
+	"applebot",
+	"petalbot",
+	"ahrefsbot",
+	"semrushbot",
+	"mj12bot",
+	"dotbot",
+	"rogerbot",
+	"seznambot",
+	"facebookexternalhit",
+	"facebookcatalog",
+	"meta-externalagent",
+	"twitterbot",
+	"linkedinbot",
+	"pinterestbot",
+	"slackbot",
+	"slack-imgproxy",
+	"discordbot",
+	"telegrambot",
+	"skypeuripreview",
+	"redditbot",
+	"embedly",
+	"quora link preview",
+	"vkshare",
+	"tumblr/14",
+	"iframely",
+	"outbrain",
+	"gptbot",
+	"chatgpt-user",
+	"claudebot",
+	"ccbot",
+	"bytespider",
+	"amazonbot",
+	"perplexitybot",
+	"ia_archiver",
+	"archive.org_bot",
+	"uptimerobot",
+	"pingdom",
+	"statuscake",
+	"site24x7",
+	"newrelicpinger",
+	"datadog",
+	"checkly",
+	"censysinspect",
+	"expanse",
+	"paloaltonetworks",
+	"nmap",
+	"masscan",
+	"zgrab",
+	"nuclei",
+	"nikto",
+	"sqlmap",
+	"qualys",
+	"barracuda",
+	"proofpoint",
+	"mimecast",
+	"safelinks",
+	"ms office link preview",
+	"ms-office",
+}
+
+// crawlerPrefixes are user agent prefixes of link preview fetchers whose
+// token also appears in browser user agents, which start with "Mozilla/"
+var crawlerPrefixes = []string{
+	"whatsapp/",
+}
+
+// botWordPattern matches "bot" as a word of its own or at the end of a
+// product name such as "ExampleBot/1.0", but not inside names like the
+// Cubot phone brand
+var botWordPattern = regexp.MustCompile(`(^|[^a-z])bot([^a-z]|$)|bot[/;)]`)
+
+// botUAPatterns are generic tokens that indicate automated clients
+var botUAPatterns = []string{
+	"crawler",
+	"spider",
+	"scraper",
+	"crawl",
+	"headless",
+	"phantomjs",
+	"lighthouse",
+	"preview",
+	"fetcher",
+	"monitor",
+	"scanner",
+	"checker",
+	"validator",
+}
+
+// httpLibraries are user agent prefixes of programmatic HTTP clients
+var httpLibraries = []string{
+	"curl/",
+	"wget/",
+	"python-requests",
+	"python-urllib",
+	"python-httpx",
+	"aiohttp",
+	"go-http-client",
+	"java/",
+	"okhttp",
+	"apache-httpclient",
+	"libwww-perl",
+	"node-fetch",
+	"axios/",
+	"undici",
+	"ruby",
+	"php/",
+	"guzzlehttp",
+	"httpie",
+	"postmanruntime",
+	"insomnia",
+	"powershell",
+	"winhttp",
+	"dart:io",
+	"reqwest",
+}
+
+// ClickRequest holds the request attributes used for bot classification
+type ClickRequest struct {
+	Method         string
+	UserAgent      string
+	Accept         string
+	AcceptLanguage string
+	Purpose        string
+}
+
+// ClassifyClick reports whether a request looks automated and why
+func ClassifyClick(req ClickRequest) (bool, string) {
+	ua := strings.ToLower(strings.TrimSpace(req.UserAgent))
+
+	if ua == "" {
+		return true, BotReasonEmptyUA
+	}
+
+	for _, crawler := range knownCrawlers {
+		if strings.Contains(ua, crawler) {
+			return true, BotReasonKnownCrawler
+		}
+	}
+	for _, crawler := range crawlerPrefixes {
+		if strings.HasPrefix(ua, crawler) {
+			return true, BotReasonKnownCrawler
+		}
+	}
+
+	for _, lib := range httpLibraries {
+		if strings.HasPrefix(ua, lib) {
+			return true, BotReasonHTTPLibrary
+		}
+	}
+
+	if botWordPattern.MatchString(ua) {
+		return true, BotReasonUAPattern
+	}
+	for _, pattern := range botUAPatterns {
+		if strings.Contains(ua, pattern) {
+			return true, BotReasonUAPattern
+		}
+	}
+
+	// Browser prefetch and link preview requests are not real visits
+	purpose := strings.ToLower(req.Purpose)
+	if strings.Contains(purpose, "prefetch") || strings.Contains(purpose, "preview") {
+		return true, BotReasonPrefetch
+	}
+
+	// Link checkers typically probe with HEAD instead of following the link
+	if strings.EqualFold(req.Method, "HEAD") {
+		return true, BotReasonHeadRequest
+	}
+
+	// Real browsers always send Accept and Accept-Language on navigation
+	if strings.HasPrefix(ua, "mozilla/") && (req.Accept == "" || req.AcceptLanguage == "") {
+		return true, BotReasonMissingHeader
+	}
+
+	return false, BotReasonNone
+}
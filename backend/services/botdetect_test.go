@@ -0,0 +1,64 @@
+package services
+
+import "testing"
+
+func TestClassifyClick(t *testing.T) {
+	const (
+		chrome     = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36"
+		accept     = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+		acceptLang = "en-US,en;q=0.9"
+	)
+
+	browser := func(ua string) ClickRequest {
+		return ClickRequest{Method: "GET", UserAgent: ua, Accept: accept, AcceptLanguage: acceptLang}
+	}
+
+	tests := []struct {
+		name       string
+		req        ClickRequest
+		wantBot    bool
+		wantReason string
+	}{
+		{"desktop browser", browser(chrome), false, BotReasonNone},
+		{"cubot phone", browser("Mozilla/5.0 (Linux; Android 10; CUBOT X30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36"), false, BotReasonNone},
+		{"cubot phone with underscore", browser("Mozilla/5.0 (Linux; Android 11; CUBOT_P40) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36"), false, BotReasonNone},
+		{"empty user agent", ClickRequest{Method: "GET"}, true, BotReasonEmptyUA},
+		{"blank user agent", browser("   "), true, BotReasonEmptyUA},
+		{"googlebot", browser("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"), true, BotReasonKnownCrawler},
+		{"slack preview", browser("Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"), true, BotReasonKnownCrawler},
+		{"whatsapp preview", browser("WhatsApp/2.23.20.0 A"), true, BotReasonKnownCrawler},
+		{"sogou spider", browser("Sogou web spider/4.0(+http://www.sogou.com/docs/help/webmasters.htm#07)"), true, BotReasonKnownCrawler},
+		{"tumblr preview", browser("Tumblr/14.0.835.186"), true, BotReasonKnownCrawler},
+		{"office link preview", browser("Mozilla/5.0 (Windows NT 10.0; Win64; x64) MS Office Link Preview"), true, BotReasonKnownCrawler},
+		// Browsers and in-app browsers naming an app that also runs a bot
+		{"whatsapp in-app browser", browser("Mozilla/5.0 (Linux; Android 14; SM-S918B Build/UP1A.231005.007; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/124.0.6367.82 Mobile Safari/537.36 WhatsApp/2.24.9.78"), false, BotReasonNone},
+		{"sogou browser", browser("Mozilla/5.0 (Linux; Android 10; V2001A) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/86.0.4240.99 Mobile Safari/537.36 SogouMobileBrowser/5.28.12"), false, BotReasonNone},
+		{"tumblr app", browser("Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 Tumblr/33.6"), false, BotReasonNone},
+		{"outlook desktop", browser("Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Microsoft Office/16.0 (Microsoft Outlook 16.0.17531; Pro)"), false, BotReasonNone},
+		{"curl", browser("curl/8.4.0"), true, BotReasonHTTPLibrary},
+		{"python requests", browser("python-requests/2.31.0"), true, BotReasonHTTPLibrary},
+		{"go client", browser("Go-http-client/1.1"), true, BotReasonHTTPLibrary},
+		{"unknown bot product", browser("ExampleBot/1.0 (+https://example.com)"), true, BotReasonUAPattern},
+		{"bot word", browser("Mozilla/5.0 (compatible; bot)"), true, BotReasonUAPattern},
+		{"hyphenated bot", browser("link-bot 2.0"), true, BotReasonUAPattern},
+		{"bot in compatible list", browser("Mozilla/5.0 (compatible; AcmeBot; +https://acme.example)"), true, BotReasonUAPattern},
+		{"crawler", browser("Mozilla/5.0 (compatible; SiteCrawler 3.1)"), true, BotReasonUAPattern},
+		{"headless chrome", browser("Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/126.0.0.0 Safari/537.36"), true, BotReasonUAPattern},
+		{"prefetch", ClickRequest{Method: "GET", UserAgent: chrome, Accept: accept, AcceptLanguage: acceptLang, Purpose: "prefetch"}, true, BotReasonPrefetch},
+		{"preview purpose", ClickRequest{Method: "GET", UserAgent: chrome, Accept: accept, AcceptLanguage: acceptLang, Purpose: "Preview"}, true, BotReasonPrefetch},
+		{"head request", ClickRequest{Method: "HEAD", UserAgent: chrome, Accept: accept, AcceptLanguage: acceptLang}, true, BotReasonHeadRequest},
+		{"missing accept language", ClickRequest{Method: "GET", UserAgent: chrome, Accept: accept}, true, BotReasonMissingHeader},
+		{"missing accept", ClickRequest{Method: "GET", UserAgent: chrome, AcceptLanguage: acceptLang}, true, BotReasonMissingHeader},
+		// Only browser-like clients are expected to send navigation headers
+		{"app without headers", ClickRequest{Method: "GET", UserAgent: "MyApp/3.2 (iPhone; iOS 17.5)"}, false, BotReasonNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isBot, reason := ClassifyClick(tt.req)
+			if isBot != tt.wantBot || reason != tt.wantReason {
+				t.Errorf("ClassifyClick() = %v, %q; want %v, %q", isBot, reason, tt.wantBot, tt.wantReason)
+			}
+		})
+	}
+}
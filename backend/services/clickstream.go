@@ -0,0 +1,144 @@
+package services
+
+import (
+	"errors"
+	"sync"
+
+	"link-shortener/models"
+)
+
+// ErrTooManySubscribers is returned when the click stream is at capacity
+var ErrTooManySubscribers = errors.New("too many click stream subscribers")
+
+// ClickSubscription receives published clicks matching its filter. Events
+// is closed when the subscription ends; Dropped then reports whether it
+// was ended because the subscriber fell behind.
+type ClickSubscription struct {
+	Events  <-chan models.Click
+	events  chan models.Click
+	linkIDs map[uint]bool
+	traffic string
+	dropped bool
+}
+
+// Dropped reports whether the subscription was closed for being too slow.
+// Only valid after Events has been closed.
+func (s *ClickSubscription) Dropped() bool {
+	return s.dropped
+}
+
+// matches reports whether a click passes the subscription filter
+func (s *ClickSubscription) matches(click *models.Click) bool {
+	if len(s.linkIDs) > 0 && !s.linkIDs[click.LinkID] {
+		return false
+	}
+	switch s.traffic {
+	case "human":
+		return !click.IsBot
+	case "bot":
+		return click.IsBot
+	}
+	return true
+}
+
+// ClickBroker fans tracked clicks out to live subscribers. Publishing never
+// blocks: a subscriber whose buffer is full is dropped.
+type ClickBroker struct {
+	bufferSize     int
+	maxSubscribers int
+	mu             sync.Mutex
+	subscribers    map[*ClickSubscription]struct{}
+	closed         bool
+}
+
+// NewClickBroker creates a broker with per-subscriber buffers of bufferSize
+// clicks and at most maxSubscribers concurrent subscribers (0 is unlimited)
+func NewClickBroker(bufferSize, maxSubscribers int) *ClickBroker {
+	if bufferSize <= 0 {
+		bufferSize = 1
+	}
+	return &ClickBroker{
+		bufferSize:     bufferSize,
+		maxSubscribers: maxSubscribers,
+		subscribers:    make(map[*ClickSubscription]struct{}),
+	}
+}
+
+// Close ends all subscriptions and refuses new ones. Call it before
+// shutting down the server: open streams would otherwise keep their
+// connections busy and hold up a graceful shutdown.
+func (b *ClickBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for sub := range b.subscribers {
+		b.remove(sub)
+	}
+}
+
+// Subscribe registers a subscriber for clicks on linkIDs (all links when
+// empty) filtered by traffic ("all", "human" or "bot")
+func (b *ClickBroker) Subscribe(linkIDs []uint, traffic string) (*ClickSubscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed || (b.maxSubscribers > 0 && len(b.subscribers) >= b.maxSubscribers) {
+		return nil, ErrTooManySubscribers
+	}
+
+	events := make(chan models.Click, b.bufferSize)
+	sub := &ClickSubscription{
+		Events:  events,
+		events:  events,
+		linkIDs: make(map[uint]bool, len(linkIDs)),
+		traffic: traffic,
+	}
+	for _, id := range linkIDs {
+		sub.linkIDs[id] = true
+	}
+	b.subscribers[sub] = struct{}{}
+	return sub, nil
+}
+
+// Unsubscribe ends a subscription. It is safe to call more than once.
+func (b *ClickBroker) Unsubscribe(sub *ClickSubscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[sub]; ok {
+		b.remove(sub)
+	}
+}
+
+// Publish delivers a click to every matching subscriber
+func (b *ClickBroker) Publish(click models.Click) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		if !sub.matches(&click) {
+			continue
+		}
+		select {
+		case sub.events <- click:
+		default:
+			// Slow consumer: drop it rather than block click tracking
+			sub.dropped = true
+			b.remove(sub)
+		}
+	}
+}
+
+// Subscribers returns the number of active subscribers
+func (b *ClickBroker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers)
+}
+
+// remove closes and forgets a subscription. Callers must hold b.mu.
+func (b *ClickBroker) remove(sub *ClickSubscription) {
+	delete(b.subscribers, sub)
+	close(sub.events)
+}
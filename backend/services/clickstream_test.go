@@ -0,0 +1,27 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestClickBrokerClose(t *testing.T) {
+	broker := NewClickBroker(1, 0)
+	sub, err := broker.Subscribe(nil, "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.Close()
+
+	if _, ok := <-sub.Events; ok {
+		t.Error("subscription still open after Close")
+	}
+	if sub.Dropped() {
+		t.Error("closed subscription reported as dropped")
+	}
+	if _, err := broker.Subscribe(nil, "all"); !errors.Is(err, ErrTooManySubscribers) {
+		t.Errorf("Subscribe after Close: err = %v, want ErrTooManySubscribers", err)
+	}
+	broker.Unsubscribe(sub)
+}
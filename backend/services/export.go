@@ -0,0 +1,381 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"gorm.io/gorm"
+)
+
+// Export formats
+const (
+	ExportFormatCSV     = "csv"
+	ExportFormatNDJSON  = "ndjson"
+	ExportFormatParquet = "parquet"
+)
+
+// ExportContentTypes maps export formats to their response content type
+var ExportContentTypes = map[string]string{
+	ExportFormatCSV:     "text/csv; charset=utf-8",
+	ExportFormatNDJSON:  "application/x-ndjson",
+	ExportFormatParquet: "application/vnd.apache.parquet",
+}
+
+// exportRowGroupSize is the number of rows buffered per Parquet row group
+const exportRowGroupSize = 50000
+
+// Export column value kinds
+const (
+	exportString = iota
+	exportInt
+	exportTime
+	exportBool
+	exportFloat
+)
+
+// ExportColumn is a click column that can be exported
+type ExportColumn struct {
+	Name string
+	Expr string
+	kind int
+}
+
+// exportColumns lists the exportable columns in their default order
+var exportColumns = []ExportColumn{
+	{Name: "id", Expr: "clicks.id", kind: exportInt},
+	{Name: "link_id", Expr: "clicks.link_id", kind: exportInt},
+	{Name: "slug", Expr: "links.slug", kind: exportString},
+	{Name: "clicked_at", Expr: "clicks.clicked_at", kind: exportTime},
+	{Name: "ip_address", Expr: "clicks.ip_address", kind: exportString},
+	{Name: "user_agent", Expr: "clicks.user_agent", kind: exportString},
+	{Name: "browser", Expr: "clicks.browser", kind: exportString},
+	{Name: "browser_version", Expr: "clicks.browser_version", kind: exportString},
+	{Name: "os", Expr: "clicks.os", kind: exportString},
+	{Name: "os_version", Expr: "clicks.os_version", kind: exportString},
+	{Name: "device_type", Expr: "clicks.device_type", kind: exportString},
+	{Name: "country", Expr: "clicks.country", kind: exportString},
+	{Name: "country_code", Expr: "clicks.country_code", kind: exportString},
+	{Name: "city", Expr: "clicks.city", kind: exportString},
+	{Name: "region", Expr: "clicks.region", kind: exportString},
+	{Name: "asn", Expr: "clicks.asn", kind: exportInt},
+	{Name: "as_organization", Expr: "clicks.as_organization", kind: exportString},
+	{Name: "latitude", Expr: "clicks.latitude", kind: exportFloat},
+	{Name: "longitude", Expr: "clicks.longitude", kind: exportFloat},
+	{Name: "referrer", Expr: "clicks.referrer", kind: exportString},
+	{Name: "referrer_url", Expr: "clicks.referrer_url", kind: exportString},
+	{Name: "is_bot", Expr: "clicks.is_bot", kind: exportBool},
+	{Name: "bot_reason", Expr: "clicks.bot_reason", kind: exportString},
+}
+
+// ParseExportColumns resolves a comma-separated list of column names.
+// An empty list selects all columns.
+func ParseExportColumns(spec string) ([]ExportColumn, error) {
+	if strings.TrimSpace(spec) == "" {
+		return exportColumns, nil
+	}
+
+	var columns []ExportColumn
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		column, ok := findExportColumn(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		seen[name] = true
+		columns = append(columns, column)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns selected")
+	}
+	return columns, nil
+}
+
+// findExportColumn looks up an exportable column by name
+func findExportColumn(name string) (ExportColumn, bool) {
+	for _, column := range exportColumns {
+		if column.Name == name {
+			return column, true
+		}
+	}
+	return ExportColumn{}, false
+}
+
+// exportWriter encodes rows of column values in one export format
+type exportWriter interface {
+	WriteRow(values []interface{}) error
+	Close() error
+}
+
+// ExportClicks streams the rows of query in the given format. query must
+// select from clicks joined with links; the selected columns are added here.
+// Rows are read from a database cursor and written as they arrive.
+func ExportClicks(w io.Writer, format string, columns []ExportColumn, query *gorm.DB) error {
+	encoder, err := newExportWriter(w, format, columns)
+	if err != nil {
+		return err
+	}
+
+	selects := make([]string, len(columns))
+	for i, column := range columns {
+		selects[i] = column.Expr + " AS " + column.Name
+	}
+
+	rows, err := query.Select(strings.Join(selects, ", ")).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	targets := make([]interface{}, len(columns))
+	for i, column := range columns {
+		targets[i] = newScanTarget(column.kind)
+	}
+	values := make([]interface{}, len(columns))
+
+	for rows.Next() {
+		if err := rows.Scan(targets...); err != nil {
+			return err
+		}
+		for i, target := range targets {
+			values[i] = scannedValue(target)
+		}
+		if err := encoder.WriteRow(values); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
+
+// newScanTarget returns a nullable scan destination for a column kind
+func newScanTarget(kind int) interface{} {
+	switch kind {
+	case exportInt:
+		return new(sql.NullInt64)
+	case exportTime:
+		return new(sql.NullTime)
+	case exportBool:
+		return new(sql.NullBool)
+	case exportFloat:
+		return new(sql.NullFloat64)
+	default:
+		return new(sql.NullString)
+	}
+}
+
+// scannedValue unwraps a scan target. NULL floats and times become nil,
+// other NULLs their zero value.
+func scannedValue(target interface{}) interface{} {
+	switch v := target.(type) {
+	case *sql.NullInt64:
+		return v.Int64
+	case *sql.NullTime:
+		if !v.Valid {
+			return nil
+		}
+		return v.Time.UTC()
+	case *sql.NullBool:
+		return v.Bool
+	case *sql.NullFloat64:
+		if !v.Valid {
+			return nil
+		}
+		return v.Float64
+	case *sql.NullString:
+		return v.String
+	}
+	return nil
+}
+
+// newExportWriter creates an encoder for format
+func newExportWriter(w io.Writer, format string, columns []ExportColumn) (exportWriter, error) {
+	switch format {
+	case ExportFormatCSV:
+		return newCSVExportWriter(w, columns)
+	case ExportFormatNDJSON:
+		return &ndjsonExportWriter{w: w, columns: columns}, nil
+	case ExportFormatParquet:
+		return newParquetExportWriter(w, columns), nil
+	}
+	return nil, fmt.Errorf("unsupported export format %q", format)
+}
+
+// csvExportWriter writes a header line followed by one record per row
+type csvExportWriter struct {
+	w      *csv.Writer
+	record []string
+}
+
+func newCSVExportWriter(w io.Writer, columns []ExportColumn) (*csvExportWriter, error) {
+	writer := csv.NewWriter(w)
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.Name
+	}
+	if err := writer.Write(header); err != nil {
+		return nil, err
+	}
+	return &csvExportWriter{w: writer, record: make([]string, len(columns))}, nil
+}
+
+func (e *csvExportWriter) WriteRow(values []interface{}) error {
+	for i, value := range values {
+		switch v := value.(type) {
+		case nil:
+			e.record[i] = ""
+		case string:
+			e.record[i] = escapeCSVFormula(v)
+		case int64:
+			e.record[i] = strconv.FormatInt(v, 10)
+		case float64:
+			e.record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			e.record[i] = strconv.FormatBool(v)
+		case time.Time:
+			e.record[i] = v.Format(time.RFC3339Nano)
+		}
+	}
+	return e.w.Write(e.record)
+}
+
+func (e *csvExportWriter) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// escapeCSVFormula prefixes values that spreadsheets would evaluate as a
+// formula with a quote. User agents and referrers are visitor-controlled,
+// so "=HYPERLINK(...)" must open as text.
+func escapeCSVFormula(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// ndjsonExportWriter writes one JSON object per line, keys in column order
+type ndjsonExportWriter struct {
+	w       io.Writer
+	columns []ExportColumn
+	buf     []byte
+}
+
+func (e *ndjsonExportWriter) WriteRow(values []interface{}) error {
+	e.buf = append(e.buf[:0], '{')
+	for i, value := range values {
+		if i > 0 {
+			e.buf = append(e.buf, ',')
+		}
+		e.buf = strconv.AppendQuote(e.buf, e.columns[i].Name)
+		e.buf = append(e.buf, ':')
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		e.buf = append(e.buf, encoded...)
+	}
+	e.buf = append(e.buf, '}', '\n')
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+func (e *ndjsonExportWriter) Close() error {
+	return nil
+}
+
+// parquetExportWriter writes rows into Snappy-compressed row groups of at
+// most exportRowGroupSize rows, so memory stays bounded for large exports
+type parquetExportWriter struct {
+	w       *parquet.Writer
+	leaves  []parquet.LeafColumn
+	row     parquet.Row
+	pending int
+}
+
+func newParquetExportWriter(w io.Writer, columns []ExportColumn) *parquetExportWriter {
+	group := parquet.Group{}
+	for _, column := range columns {
+		group[column.Name] = parquetNode(column.kind)
+	}
+	schema := parquet.NewSchema("click", group)
+
+	// Parquet orders columns by name, so map each selected column to its leaf
+	leaves := make([]parquet.LeafColumn, len(columns))
+	for i, column := range columns {
+		leaves[i], _ = schema.Lookup(column.Name)
+	}
+
+	return &parquetExportWriter{
+		w:      parquet.NewWriter(w, schema, parquet.Compression(&parquet.Snappy)),
+		leaves: leaves,
+		row:    make(parquet.Row, len(columns)),
+	}
+}
+
+// parquetNode returns the Parquet schema node for a column kind
+func parquetNode(kind int) parquet.Node {
+	switch kind {
+	case exportInt:
+		return parquet.Int(64)
+	case exportTime:
+		return parquet.Optional(parquet.Timestamp(parquet.Microsecond))
+	case exportBool:
+		return parquet.Leaf(parquet.BooleanType)
+	case exportFloat:
+		return parquet.Optional(parquet.Leaf(parquet.DoubleType))
+	default:
+		return parquet.String()
+	}
+}
+
+func (e *parquetExportWriter) WriteRow(values []interface{}) error {
+	for i, value := range values {
+		leaf := e.leaves[i]
+		var v parquet.Value
+		switch value := value.(type) {
+		case nil:
+			e.row[leaf.ColumnIndex] = parquet.NullValue().Level(0, 0, leaf.ColumnIndex)
+			continue
+		case string:
+			v = parquet.ByteArrayValue([]byte(value))
+		case int64:
+			v = parquet.Int64Value(value)
+		case float64:
+			v = parquet.DoubleValue(value)
+		case bool:
+			v = parquet.BooleanValue(value)
+		case time.Time:
+			v = parquet.Int64Value(value.UnixMicro())
+		}
+		e.row[leaf.ColumnIndex] = v.Level(0, leaf.MaxDefinitionLevel, leaf.ColumnIndex)
+	}
+
+	if _, err := e.w.WriteRows([]parquet.Row{e.row}); err != nil {
+		return err
+	}
+
+	e.pending++
+	if e.pending >= exportRowGroupSize {
+		e.pending = 0
+		return e.w.Flush()
+	}
+	return nil
+}
+
+func (e *parquetExportWriter) Close() error {
+	return e.w.Close()
+}
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// geoCacheEntry is a cached location with its expiry time
+type geoCacheEntry struct {
+	ip        string
+	location  *GeoLocation
+	expiresAt time.Time
+}
+
+// geoCache is a size-bounded LRU cache with per-entry TTL
+type geoCache struct {
+	mu        sync.Mutex
+	capacity  int
+	ttl       time.Duration
+	entries   map[string]*list.Element
+	order     *list.List
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// newGeoCache creates a cache holding at most capacity entries for ttl each
+func newGeoCache(capacity int, ttl time.Duration) *geoCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &geoCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns a cached location, dropping it if it has expired
+func (c *geoCache) get(ip string) (*GeoLocation, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[ip]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	entry := elem.Value.(*geoCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.removeElement(elem)
+		c.evictions++
+		c.misses++
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	c.hits++
+	return entry.location, true
+}
+
+// set stores a location, evicting expired entries and then the least
+// recently used ones when the cache is full
+func (c *geoCache) set(ip string, location *GeoLocation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if elem, ok := c.entries[ip]; ok {
+		entry := elem.Value.(*geoCacheEntry)
+		entry.location = location
+		entry.expiresAt = now.Add(c.ttl)
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	if c.order.Len() >= c.capacity {
+		c.evictExpired(now)
+	}
+	for c.order.Len() >= c.capacity {
+		c.removeElement(c.order.Back())
+		c.evictions++
+	}
+
+	c.entries[ip] = c.order.PushFront(&geoCacheEntry{
+		ip:        ip,
+		location:  location,
+		expiresAt: now.Add(c.ttl),
+	})
+}
+
+// evictExpired removes expired entries, scanning from the least recently used end
+func (c *geoCache) evictExpired(now time.Time) {
+	for elem := c.order.Back(); elem != nil; {
+		prev := elem.Prev()
+		if now.After(elem.Value.(*geoCacheEntry).expiresAt) {
+			c.removeElement(elem)
+			c.evictions++
+		}
+		elem = prev
+	}
+}
+
+// removeElement deletes an entry from both the list and the index
+func (c *geoCache) removeElement(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*geoCacheEntry).ip)
+}
+
+// stats returns a snapshot of cache counters
+func (c *geoCache) stats() GeoCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return GeoCacheStats{
+		Size:      c.order.Len(),
+		Capacity:  c.capacity,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
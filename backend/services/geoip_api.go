@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ipAPIResponse represents the response from ip-api.com
+type ipAPIResponse struct {
+	Status      string   `json:"status"`
+	Message     string   `json:"message"`
+	Country     string   `json:"country"`
+	CountryCode string   `json:"countryCode"`
+	RegionName  string   `json:"regionName"`
+	City        string   `json:"city"`
+	Lat         *float64 `json:"lat"`
+	Lon         *float64 `json:"lon"`
+	AS          string   `json:"as"`
+}
+
+// IPAPIProvider looks up locations via the ip-api.com JSON API. It honours
+// the X-Rl/X-Ttl rate-limit headers (free tier: 45 requests per minute) and
+// stops sending requests until the window resets.
+type IPAPIProvider struct {
+	baseURL      string
+	client       *http.Client
+	mu           sync.Mutex
+	blockedUntil time.Time
+}
+
+// NewIPAPIProvider creates an ip-api.com provider; an empty baseURL uses
+// the public endpoint
+func NewIPAPIProvider(baseURL string) *IPAPIProvider {
+	if baseURL == "" {
+		baseURL = "http://ip-api.com"
+	}
+	return &IPAPIProvider{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Health reports an error while the provider is rate limited
+func (p *IPAPIProvider) Health() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Now().Before(p.blockedUntil) {
+		return fmt.Errorf("rate limited until %s", p.blockedUntil.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Name returns the provider name used in metrics
+func (p *IPAPIProvider) Name() string {
+	return "ip-api"
+}
+
+// Lookup queries ip-api.com for ip
+func (p *IPAPIProvider) Lookup(ctx context.Context, ip string) (*GeoLocation, error) {
+	p.mu.Lock()
+	blocked := time.Now().Before(p.blockedUntil)
+	p.mu.Unlock()
+	if blocked {
+		return nil, ErrGeoRateLimited
+	}
+
+	url := fmt.Sprintf("%s/json/%s?fields=status,message,country,countryCode,regionName,city,lat,lon,as", p.baseURL, ip)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	p.updateRateLimit(resp)
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, ErrGeoRateLimited
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ip-api returned status %d", resp.StatusCode)
+	}
+
+	var apiResp ipAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		return nil, err
+	}
+
+	if apiResp.Status != "success" {
+		return nil, ErrGeoNotFound
+	}
+
+	location := &GeoLocation{
+		Country:     apiResp.Country,
+		CountryCode: apiResp.CountryCode,
+		City:        apiResp.City,
+		Region:      apiResp.RegionName,
+		Latitude:    apiResp.Lat,
+		Longitude:   apiResp.Lon,
+	}
+	location.ASN, location.ASOrganization = parseASField(apiResp.AS)
+
+	return location, nil
+}
+
+// updateRateLimit pauses the provider when the rate-limit window is used up
+func (p *IPAPIProvider) updateRateLimit(resp *http.Response) {
+	remaining, err := strconv.Atoi(resp.Header.Get("X-Rl"))
+	exhausted := resp.StatusCode == http.StatusTooManyRequests || (err == nil && remaining <= 0)
+	if !exhausted {
+		return
+	}
+
+	ttl, err := strconv.Atoi(resp.Header.Get("X-Ttl"))
+	if err != nil || ttl <= 0 {
+		ttl = 60
+	}
+
+	p.mu.Lock()
+	p.blockedUntil = time.Now().Add(time.Duration(ttl) * time.Second)
+	p.mu.Unlock()
+}
+
+// parseASField splits ip-api's "AS15169 Google LLC" into number and organization
+func parseASField(as string) (uint, string) {
+	number, org, _ := strings.Cut(as, " ")
+	n, err := strconv.ParseUint(strings.TrimPrefix(number, "AS"), 10, 32)
+	if err != nil {
+		return 0, ""
+	}
+	return uint(n), org
+}
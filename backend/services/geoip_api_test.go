@@ -0,0 +1,84 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIPAPIProviderLookup(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Rl", "44")
+		w.Header().Set("X-Ttl", "60")
+		switch r.URL.Path {
+		case "/json/8.8.8.8":
+			w.Write([]byte(`{"status":"success","country":"United States","countryCode":"US","regionName":"California","city":"Mountain View","lat":37.4,"lon":-122.1,"as":"AS15169 Google LLC"}`))
+		default:
+			w.Write([]byte(`{"status":"fail","message":"reserved range"}`))
+		}
+	}))
+	defer server.Close()
+
+	p := NewIPAPIProvider(server.URL)
+
+	location, err := p.Lookup(context.Background(), "8.8.8.8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.CountryCode != "US" || location.City != "Mountain View" || location.ASN != 15169 || location.ASOrganization != "Google LLC" {
+		t.Errorf("location = %+v", location)
+	}
+
+	if _, err := p.Lookup(context.Background(), "203.0.114.7"); !errors.Is(err, ErrGeoNotFound) {
+		t.Errorf("err = %v, want ErrGeoNotFound", err)
+	}
+	if err := p.Health(); err != nil {
+		t.Errorf("Health() = %v, want nil", err)
+	}
+}
+
+func TestIPAPIProviderRateLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		headers map[string]string
+		wantErr error
+	}{
+		{"too many requests", http.StatusTooManyRequests, map[string]string{"X-Ttl": "30"}, ErrGeoRateLimited},
+		// The last request of the window still gets an answer
+		{"window used up", http.StatusOK, map[string]string{"X-Rl": "0", "X-Ttl": "30"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				for k, v := range tt.headers {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(`{"status":"success","country":"Poland","countryCode":"PL"}`))
+			}))
+			defer server.Close()
+
+			p := NewIPAPIProvider(server.URL)
+
+			if _, err := p.Lookup(context.Background(), "8.8.8.8"); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("first lookup err = %v, want %v", err, tt.wantErr)
+			}
+			if _, err := p.Lookup(context.Background(), "1.1.1.1"); !errors.Is(err, ErrGeoRateLimited) {
+				t.Fatalf("second lookup err = %v, want ErrGeoRateLimited", err)
+			}
+			if got := requests.Load(); got != 1 {
+				t.Errorf("server received %d requests, want 1", got)
+			}
+			if err := p.Health(); err == nil {
+				t.Error("Health() = nil while rate limited")
+			}
+		})
+	}
+}
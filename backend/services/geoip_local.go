@@ -0,0 +1,242 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbCityRecord matches the City/Country layout shared by MaxMind GeoIP2,
+// GeoLite2 and DB-IP Lite databases
+type mmdbCityRecord struct {
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+// mmdbASNRecord matches the GeoLite2-ASN and DB-IP ASN Lite layout
+type mmdbASNRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// mmdbFile is a memory-mapped MMDB file that is reopened when it changes on disk
+type mmdbFile struct {
+	path    string
+	mu      sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+// openMMDBFile opens the database at path
+func openMMDBFile(path string) (*mmdbFile, error) {
+	f := &mmdbFile{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reload reopens the database if its modification time or size changed
+func (f *mmdbFile) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.mu.RLock()
+	unchanged := f.reader != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size
+	f.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	reader, err := maxminddb.Open(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", f.path, err)
+	}
+
+	f.mu.Lock()
+	old := f.reader
+	f.reader = reader
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+		slog.Info("reloaded GeoIP database", "path", f.path,
+			"built", time.Unix(int64(reader.Metadata.BuildEpoch), 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// lookup decodes the record for ip into result
+func (f *mmdbFile) lookup(ip net.IP, result interface{}) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.reader == nil {
+		return fmt.Errorf("GeoIP database %s is closed", f.path)
+	}
+	return f.reader.Lookup(ip, result)
+}
+
+// health reports an error when the database is not open
+func (f *mmdbFile) health() error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.reader == nil {
+		return fmt.Errorf("GeoIP database %s is closed", f.path)
+	}
+	return nil
+}
+
+// close releases the underlying reader
+func (f *mmdbFile) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reader == nil {
+		return nil
+	}
+	err := f.reader.Close()
+	f.reader = nil
+	return err
+}
+
+// LocalGeoDB resolves IP locations from local MMDB files (MaxMind or DB-IP)
+// without any network access
+type LocalGeoDB struct {
+	city *mmdbFile
+	asn  *mmdbFile
+}
+
+// NewLocalGeoDB opens the city database and the optional ASN database
+func NewLocalGeoDB(cityPath, asnPath string) (*LocalGeoDB, error) {
+	city, err := openMMDBFile(cityPath)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &LocalGeoDB{city: city}
+	if asnPath != "" {
+		if db.asn, err = openMMDBFile(asnPath); err != nil {
+			city.close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// WatchForChanges reopens the database files when they are replaced on disk,
+// checking every interval until ctx is cancelled. Files are memory-mapped, so
+// updates should replace them atomically (write a new file, then rename).
+func (db *LocalGeoDB) WatchForChanges(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for _, f := range []*mmdbFile{db.city, db.asn} {
+					if f == nil {
+						continue
+					}
+					if err := f.reload(); err != nil {
+						slog.Error("failed to reload GeoIP database", "error", err)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Health reports an error when a database file is not open
+func (db *LocalGeoDB) Health() error {
+	if err := db.city.health(); err != nil {
+		return err
+	}
+	if db.asn != nil {
+		return db.asn.health()
+	}
+	return nil
+}
+
+// Name returns the provider name used in metrics
+func (db *LocalGeoDB) Name() string {
+	return "mmdb"
+}
+
+// Lookup returns the location for ip, or ErrGeoNotFound when the database
+// has no entry
+func (db *LocalGeoDB) Lookup(ctx context.Context, ip string) (*GeoLocation, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, ErrGeoNotFound
+	}
+
+	var record mmdbCityRecord
+	if err := db.city.lookup(parsed, &record); err != nil {
+		return nil, err
+	}
+	if record.Country.ISOCode == "" {
+		return nil, ErrGeoNotFound
+	}
+
+	location := &GeoLocation{
+		Country:     englishName(record.Country.Names),
+		CountryCode: record.Country.ISOCode,
+		City:        englishName(record.City.Names),
+		Latitude:    record.Location.Latitude,
+		Longitude:   record.Location.Longitude,
+	}
+	if len(record.Subdivisions) > 0 {
+		location.Region = englishName(record.Subdivisions[0].Names)
+	}
+
+	if db.asn != nil {
+		var asn mmdbASNRecord
+		if err := db.asn.lookup(parsed, &asn); err == nil {
+			location.ASN = asn.Number
+			location.ASOrganization = asn.Organization
+		}
+	}
+
+	return location, nil
+}
+
+// Close releases the database files
+func (db *LocalGeoDB) Close() error {
+	if db.asn != nil {
+		db.asn.close()
+	}
+	return db.city.close()
+}
+
+// englishName picks the English name from an MMDB names map
+func englishName(names map[string]string) string {
+	if name, ok := names["en"]; ok {
+		return name
+	}
+	return ""
+}
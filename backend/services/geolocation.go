@@ -1,104 +1,317 @@
 package services
 
 import (
-	"encoding/json"
-	"fmt"
-	"net/http"
+	"context"
+	"errors"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Errors returned by GeoProvider lookups
+var (
+	// ErrGeoNotFound means the provider has no data for the address
+	ErrGeoNotFound = errors.New("location not found")
+	// ErrGeoRateLimited means the provider is throttled and was not queried
+	ErrGeoRateLimited = errors.New("geo provider rate limited")
 )
 
 // GeoLocation represents geographic location data
 type GeoLocation struct {
-	Country string `json:"country"`
-	City    string `json:"city"`
-	Region  string `json:"regionName"`
+	Country        string   `json:"country"`
+	CountryCode    string   `json:"country_code,omitempty"`
+	City           string   `json:"city"`
+	Region         string   `json:"regionName"`
+	ASN            uint     `json:"asn,omitempty"`
+	ASOrganization string   `json:"as_organization,omitempty"`
+	Latitude       *float64 `json:"latitude,omitempty"`
+	Longitude      *float64 `json:"longitude,omitempty"`
+}
+
+// GeoProvider resolves an IP address to a location
+type GeoProvider interface {
+	// Name identifies the provider in metrics
+	Name() string
+	// Lookup returns the location for ip, ErrGeoNotFound when the provider
+	// has no data, or ErrGeoRateLimited when it is throttled
+	Lookup(ctx context.Context, ip string) (*GeoLocation, error)
+}
+
+// Geolocator resolves IP addresses to locations. GeoService implements it
+// with a cached provider chain.
+type Geolocator interface {
+	GetLocation(ctx context.Context, ip string) (*GeoLocation, error)
 }
 
-// ipAPIResponse represents the response from ip-api.com
-type ipAPIResponse struct {
-	Status     string `json:"status"`
-	Country    string `json:"country"`
-	RegionName string `json:"regionName"`
-	City       string `json:"city"`
+// GeoHealthChecker is implemented by providers that can report whether
+// they are currently usable
+type GeoHealthChecker interface {
+	Health() error
 }
 
-// GeoService handles IP geolocation lookups with caching
+// GeoProviderHealth reports the current state of one provider
+type GeoProviderHealth struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// FallbackProvider always answers with an "Unknown" location. It is meant
+// to terminate a provider chain.
+type FallbackProvider struct{}
+
+// Name returns the provider name used in metrics
+func (FallbackProvider) Name() string {
+	return "fallback"
+}
+
+// Lookup returns the unknown location
+func (FallbackProvider) Lookup(ctx context.Context, ip string) (*GeoLocation, error) {
+	return unknownLocation(), nil
+}
+
+// providerCounters tracks lookups for one provider
+type providerCounters struct {
+	lookups     atomic.Uint64
+	found       atomic.Uint64
+	notFound    atomic.Uint64
+	rateLimited atomic.Uint64
+	errors      atomic.Uint64
+	totalNanos  atomic.Int64
+}
+
+// GeoProviderStats reports lookup counters for one provider
+type GeoProviderStats struct {
+	Name          string  `json:"name"`
+	Lookups       uint64  `json:"lookups"`
+	Found         uint64  `json:"found"`
+	NotFound      uint64  `json:"not_found"`
+	RateLimited   uint64  `json:"rate_limited"`
+	Errors        uint64  `json:"errors"`
+	AvgLatencyMs  float64 `json:"avg_latency_ms"`
+	LastError     string  `json:"last_error,omitempty"`
+	LastErrorTime string  `json:"last_error_time,omitempty"`
+}
+
+// GeoCacheStats reports geolocation cache counters
+type GeoCacheStats struct {
+	Size      int    `json:"size"`
+	Capacity  int    `json:"capacity"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// GeoStats reports geolocation cache and provider metrics
+type GeoStats struct {
+	Cache     GeoCacheStats      `json:"cache"`
+	Providers []GeoProviderStats `json:"providers"`
+}
+
+// GeoService handles IP geolocation lookups through a chain of providers
+// with a bounded cache in front
 type GeoService struct {
-	cache      map[string]*GeoLocation
-	cacheMutex sync.RWMutex
-	cacheTTL   time.Duration
-	cacheTime  map[string]time.Time
+	providers []GeoProvider
+	counters  []*providerCounters
+	cache     *geoCache
+	networks  *NetworkLabels
+
+	errMutex   sync.Mutex
+	lastErrors []error
+	errorTimes []time.Time
 }
 
-// NewGeoService creates a new GeoService instance
-func NewGeoService() *GeoService {
-	return &GeoService{
-		cache:     make(map[string]*GeoLocation),
-		cacheTTL:  24 * time.Hour,
-		cacheTime: make(map[string]time.Time),
+// NewGeoService creates a new GeoService that tries providers in order and
+// caches up to cacheSize lookups for cacheTTL. Non-public
+// addresses are labelled locally, with site names from networks (may be nil).
+func NewGeoService(cacheSize int, cacheTTL time.Duration, networks *NetworkLabels, providers ...GeoProvider) *GeoService {
+	g := &GeoService{
+		providers:  providers,
+		counters:   make([]*providerCounters, len(providers)),
+		cache:      newGeoCache(cacheSize, cacheTTL),
+		networks:   networks,
+		lastErrors: make([]error, len(providers)),
+		errorTimes: make([]time.Time, len(providers)),
+	}
+	for i := range g.counters {
+		g.counters[i] = &providerCounters{}
 	}
+	return g
 }
 
 // GetLocation returns geographic location for an IP address
-func (g *GeoService) GetLocation(ip string) (*GeoLocation, error) {
-	// Skip private/local IPs
-	if ip == "" || ip == "127.0.0.1" || ip == "::1" || ip == "localhost" {
-		return &GeoLocation{
-			Country: "Local",
-			City:    "Local",
-			Region:  "Local",
-		}, nil
+func (g *GeoService) GetLocation(ctx context.Context, ip string) (*GeoLocation, error) {
+	if ip == "" || ip == "localhost" {
+		return localLocation(), nil
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return unknownLocation(), nil
+	}
+	addr = addr.Unmap()
+	ip = addr.String()
+
+	// The address itself is not recorded on spans
+	ctx, span := Tracer.Start(ctx, "geo.lookup")
+	defer span.End()
+
+	// Never send private, loopback or reserved addresses to providers
+	kind := ClassifyIP(addr)
+	span.SetAttributes(attribute.String("geo.ip_kind", kind))
+	if kind != IPKindPublic {
+		return g.specialLocation(addr, kind), nil
 	}
 
 	// Check cache
-	g.cacheMutex.RLock()
-	if cached, ok := g.cache[ip]; ok {
-		if time.Since(g.cacheTime[ip]) < g.cacheTTL {
-			g.cacheMutex.RUnlock()
-			return cached, nil
+	cached, ok := g.cache.get(ip)
+	span.SetAttributes(attribute.Bool("geo.cache_hit", ok))
+	if ok {
+		return cached, nil
+	}
+
+	// Addresses no provider knows are cached as unknown too, unless a
+	// provider failed or was rate limited and might know them later
+	definitive := true
+
+	for i, provider := range g.providers {
+		counters := g.counters[i]
+		counters.lookups.Add(1)
+
+		providerCtx, providerSpan := Tracer.Start(ctx, "geo.provider "+provider.Name(),
+			trace.WithAttributes(attribute.String("geo.provider", provider.Name())))
+		start := time.Now()
+		location, err := provider.Lookup(providerCtx, ip)
+		counters.totalNanos.Add(int64(time.Since(start)))
+
+		switch {
+		case err == nil:
+			counters.found.Add(1)
+			if _, isFallback := provider.(FallbackProvider); !isFallback || definitive {
+				g.cache.set(ip, location)
+			}
+			providerSpan.End()
+			span.SetAttributes(attribute.String("geo.provider", provider.Name()))
+			return location, nil
+		case errors.Is(err, ErrGeoNotFound):
+			counters.notFound.Add(1)
+		case errors.Is(err, ErrGeoRateLimited):
+			counters.rateLimited.Add(1)
+			definitive = false
+			providerSpan.SetAttributes(attribute.Bool("geo.rate_limited", true))
+		default:
+			counters.errors.Add(1)
+			definitive = false
+			g.recordError(i, err)
+			providerSpan.RecordError(err)
+			providerSpan.SetStatus(codes.Error, err.Error())
 		}
+		providerSpan.End()
 	}
-	g.cacheMutex.RUnlock()
 
-	// Query ip-api.com (free tier: 45 requests per minute)
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Get(fmt.Sprintf("http://ip-api.com/json/%s?fields=status,country,regionName,city", ip))
-	if err != nil {
-		return g.fallbackLocation(), nil
+	location := unknownLocation()
+	if definitive {
+		g.cache.set(ip, location)
+	}
+	return location, nil
+}
+
+// Stats returns a snapshot of cache and per-provider metrics
+func (g *GeoService) Stats() GeoStats {
+	stats := GeoStats{
+		Cache:     g.cache.stats(),
+		Providers: make([]GeoProviderStats, len(g.providers)),
+	}
+
+	g.errMutex.Lock()
+	defer g.errMutex.Unlock()
+
+	for i, provider := range g.providers {
+		counters := g.counters[i]
+		ps := GeoProviderStats{
+			Name:        provider.Name(),
+			Lookups:     counters.lookups.Load(),
+			Found:       counters.found.Load(),
+			NotFound:    counters.notFound.Load(),
+			RateLimited: counters.rateLimited.Load(),
+			Errors:      counters.errors.Load(),
+		}
+		if ps.Lookups > 0 {
+			ps.AvgLatencyMs = float64(counters.totalNanos.Load()) / float64(ps.Lookups) / float64(time.Millisecond)
+		}
+		if g.lastErrors[i] != nil {
+			ps.LastError = g.lastErrors[i].Error()
+			ps.LastErrorTime = g.errorTimes[i].Format(time.RFC3339)
+		}
+		stats.Providers[i] = ps
 	}
-	defer resp.Body.Close()
+	return stats
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return g.fallbackLocation(), nil
+// Health reports the current state of each provider in the chain
+func (g *GeoService) Health() []GeoProviderHealth {
+	health := make([]GeoProviderHealth, len(g.providers))
+	for i, provider := range g.providers {
+		health[i] = GeoProviderHealth{Name: provider.Name(), Healthy: true}
+		if checker, ok := provider.(GeoHealthChecker); ok {
+			if err := checker.Health(); err != nil {
+				health[i].Healthy = false
+				health[i].Error = err.Error()
+			}
+		}
 	}
+	return health
+}
+
+// recordError remembers the latest error of a provider
+func (g *GeoService) recordError(i int, err error) {
+	g.errMutex.Lock()
+	g.lastErrors[i] = err
+	g.errorTimes[i] = time.Now()
+	g.errMutex.Unlock()
+}
 
-	var apiResp ipAPIResponse
-	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
-		return g.fallbackLocation(), nil
+// specialLocation labels a non-public address, using the configured site
+// name as city when one of the network ranges matches
+func (g *GeoService) specialLocation(addr netip.Addr, kind string) *GeoLocation {
+	if kind == IPKindLoopback {
+		return localLocation()
 	}
 
-	if apiResp.Status != "success" {
-		return g.fallbackLocation(), nil
+	country := "Private"
+	switch kind {
+	case IPKindReserved, IPKindMulticast, IPKindUnspecific:
+		country = "Reserved"
 	}
 
-	location := &GeoLocation{
-		Country: apiResp.Country,
-		City:    apiResp.City,
-		Region:  apiResp.RegionName,
+	city := kind
+	if site, ok := g.networks.Lookup(addr); ok {
+		city = site
 	}
 
-	// Update cache
-	g.cacheMutex.Lock()
-	g.cache[ip] = location
-	g.cacheTime[ip] = time.Now()
-	g.cacheMutex.Unlock()
+	return &GeoLocation{
+		Country: country,
+		City:    city,
+		Region:  kind,
+	}
+}
 
-	return location, nil
+// localLocation returns the location used for loopback addresses
+func localLocation() *GeoLocation {
+	return &GeoLocation{
+		Country: "Local",
+		City:    "Local",
+		Region:  "Local",
+	}
 }
 
-// fallbackLocation returns a default location when lookup fails
-func (g *GeoService) fallbackLocation() *GeoLocation {
+// unknownLocation returns a default location when lookup fails
+func unknownLocation() *GeoLocation {
 	return &GeoLocation{
 		Country: "Unknown",
 		City:    "Unknown",
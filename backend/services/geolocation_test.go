@@ -0,0 +1,216 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGeoProvider answers lookups from a map, failing with err for
+// addresses it does not know
+type fakeGeoProvider struct {
+	name      string
+	locations map[string]*GeoLocation
+	err       error
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (p *fakeGeoProvider) Name() string {
+	return p.name
+}
+
+func (p *fakeGeoProvider) Lookup(ctx context.Context, ip string) (*GeoLocation, error) {
+	p.mu.Lock()
+	p.calls = append(p.calls, ip)
+	p.mu.Unlock()
+
+	if location, ok := p.locations[ip]; ok {
+		return location, nil
+	}
+	return nil, p.err
+}
+
+func (p *fakeGeoProvider) callCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.calls)
+}
+
+func TestGeoServiceFallback(t *testing.T) {
+	tests := []struct {
+		name        string
+		primaryErr  error
+		wantCountry string
+		wantStats   GeoProviderStats
+	}{
+		{"not found", ErrGeoNotFound, "Poland", GeoProviderStats{Lookups: 1, NotFound: 1}},
+		{"rate limited", ErrGeoRateLimited, "Poland", GeoProviderStats{Lookups: 1, RateLimited: 1}},
+		{"error", errors.New("connection refused"), "Poland", GeoProviderStats{Lookups: 1, Errors: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := &fakeGeoProvider{name: "primary", err: tt.primaryErr}
+			secondary := &fakeGeoProvider{name: "secondary", err: ErrGeoNotFound, locations: map[string]*GeoLocation{
+				"8.8.8.8": {Country: "Poland", CountryCode: "PL"},
+			}}
+			g := NewGeoService(10, time.Hour, nil, primary, secondary, FallbackProvider{})
+
+			location, err := g.GetLocation(context.Background(), "8.8.8.8")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if location.Country != tt.wantCountry {
+				t.Errorf("country = %q, want %q", location.Country, tt.wantCountry)
+			}
+
+			stats := g.Stats().Providers[0]
+			if stats.Lookups != tt.wantStats.Lookups || stats.NotFound != tt.wantStats.NotFound ||
+				stats.RateLimited != tt.wantStats.RateLimited || stats.Errors != tt.wantStats.Errors {
+				t.Errorf("primary stats = %+v, want %+v", stats, tt.wantStats)
+			}
+			if tt.wantStats.Errors > 0 && stats.LastError == "" {
+				t.Error("primary error was not recorded")
+			}
+		})
+	}
+}
+
+func TestGeoServiceUnknownAddress(t *testing.T) {
+	tests := []struct {
+		name       string
+		primaryErr error
+		wantCached bool
+	}{
+		// Nobody knows the address, so asking again would not help
+		{"all not found", ErrGeoNotFound, true},
+		// The provider may know the address once it recovers
+		{"rate limited", ErrGeoRateLimited, false},
+		{"error", errors.New("timeout"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := &fakeGeoProvider{name: "primary", err: tt.primaryErr}
+			secondary := &fakeGeoProvider{name: "secondary", err: ErrGeoNotFound}
+			g := NewGeoService(10, time.Hour, nil, primary, secondary, FallbackProvider{})
+
+			for i := 0; i < 2; i++ {
+				location, err := g.GetLocation(context.Background(), "203.0.114.7")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if location.Country != "Unknown" {
+					t.Errorf("country = %q, want Unknown", location.Country)
+				}
+			}
+
+			wantCalls := 2
+			if tt.wantCached {
+				wantCalls = 1
+			}
+			if got := primary.callCount(); got != wantCalls {
+				t.Errorf("primary called %d times, want %d", got, wantCalls)
+			}
+			if got := secondary.callCount(); got != wantCalls {
+				t.Errorf("secondary called %d times, want %d", got, wantCalls)
+			}
+		})
+	}
+}
+
+func TestGeoServiceCache(t *testing.T) {
+	provider := &fakeGeoProvider{name: "fake", err: ErrGeoNotFound, locations: map[string]*GeoLocation{
+		"1.1.1.1": {Country: "Australia"},
+		"8.8.8.8": {Country: "United States"},
+		"9.9.9.9": {Country: "Switzerland"},
+	}}
+	g := NewGeoService(2, time.Hour, nil, provider)
+	ctx := context.Background()
+
+	lookup := func(ip string) {
+		t.Helper()
+		if _, err := g.GetLocation(ctx, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lookup("1.1.1.1")
+	lookup("1.1.1.1")
+	// IPv4-mapped IPv6 addresses share the IPv4 entry
+	lookup("::ffff:1.1.1.1")
+	if got := provider.callCount(); got != 1 {
+		t.Fatalf("provider called %d times for a cached address, want 1", got)
+	}
+
+	// The least recently used address is evicted when the cache is full
+	lookup("8.8.8.8")
+	lookup("1.1.1.1")
+	lookup("9.9.9.9")
+	lookup("1.1.1.1")
+	if got := provider.callCount(); got != 3 {
+		t.Fatalf("provider called %d times, want 3", got)
+	}
+	lookup("8.8.8.8")
+	if got := provider.callCount(); got != 4 {
+		t.Fatalf("provider called %d times after eviction, want 4", got)
+	}
+
+	stats := g.Stats().Cache
+	if stats.Size != 2 || stats.Capacity != 2 || stats.Hits != 4 || stats.Misses != 4 || stats.Evictions != 2 {
+		t.Errorf("cache stats = %+v", stats)
+	}
+}
+
+func TestGeoServiceCacheExpiry(t *testing.T) {
+	provider := &fakeGeoProvider{name: "fake", locations: map[string]*GeoLocation{"1.1.1.1": {Country: "Australia"}}}
+	g := NewGeoService(10, 20*time.Millisecond, nil, provider)
+	ctx := context.Background()
+
+	g.GetLocation(ctx, "1.1.1.1")
+	g.GetLocation(ctx, "1.1.1.1")
+	time.Sleep(30 * time.Millisecond)
+	g.GetLocation(ctx, "1.1.1.1")
+
+	if got := provider.callCount(); got != 2 {
+		t.Errorf("provider called %d times, want 2", got)
+	}
+}
+
+func TestGeoServicePrivateAddresses(t *testing.T) {
+	provider := &fakeGeoProvider{name: "fake", err: ErrGeoNotFound}
+	networks, err := ParseNetworkLabels("10.1.0.0/16=Warsaw Office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGeoService(10, time.Hour, networks, provider)
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"10.1.2.3", "Warsaw Office"},
+		{"192.168.1.1", IPKindPrivate},
+		{"127.0.0.1", "Local"},
+		{"::1", "Local"},
+		{"169.254.169.254", IPKindLinkLocal},
+		{"100.64.0.1", IPKindCGNAT},
+	}
+	for _, tt := range tests {
+		location, err := g.GetLocation(context.Background(), tt.ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if location.City != tt.want && location.Country != tt.want && location.Region != tt.want {
+			t.Errorf("GetLocation(%s) = %+v, want %q", tt.ip, location, tt.want)
+		}
+	}
+
+	if got := provider.callCount(); got != 0 {
+		t.Errorf("non-public addresses were sent to the provider %d times", got)
+	}
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestHyperLogLogErrorBound(t *testing.T) {
+	// Three standard errors of 1.04/sqrt(m)
+	bound := 3 * 1.04 / math.Sqrt(hllRegisters)
+
+	for _, n := range []int{0, 1, 10, 100, 1000, 10000, 100000, 1000000} {
+		h := NewHyperLogLog()
+		for i := 0; i < n; i++ {
+			h.Add(fmt.Sprintf("visitor-%d", i))
+		}
+
+		estimate := h.Estimate()
+		if n == 0 {
+			if estimate != 0 {
+				t.Errorf("empty sketch estimate = %d", estimate)
+			}
+			continue
+		}
+		if relErr := math.Abs(float64(estimate)-float64(n)) / float64(n); relErr > bound {
+			t.Errorf("n=%d: estimate %d is off by %.2f%%, want at most %.2f%%", n, estimate, relErr*100, bound*100)
+		}
+	}
+}
+
+func TestHyperLogLogDuplicates(t *testing.T) {
+	h := NewHyperLogLog()
+	for i := 0; i < 10000; i++ {
+		h.Add(fmt.Sprintf("visitor-%d", i%50))
+	}
+	if got := h.Estimate(); got != 50 {
+		t.Errorf("estimate = %d, want 50", got)
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	a, b, union := NewHyperLogLog(), NewHyperLogLog(), NewHyperLogLog()
+	for i := 0; i < 30000; i++ {
+		a.Add(fmt.Sprintf("visitor-%d", i))
+		union.Add(fmt.Sprintf("visitor-%d", i))
+	}
+	// Overlaps a by 10000 visitors
+	for i := 20000; i < 50000; i++ {
+		b.Add(fmt.Sprintf("visitor-%d", i))
+		union.Add(fmt.Sprintf("visitor-%d", i))
+	}
+
+	a.Merge(b)
+	if !bytes.Equal(a.Bytes(), union.Bytes()) {
+		t.Error("merged sketch differs from a sketch of the union")
+	}
+
+	// Merging is idempotent
+	before := a.Estimate()
+	a.Merge(b)
+	a.Merge(a)
+	if got := a.Estimate(); got != before {
+		t.Errorf("estimate after merging again = %d, want %d", got, before)
+	}
+}
+
+func TestHyperLogLogSerialization(t *testing.T) {
+	h := NewHyperLogLog()
+	for i := 0; i < 5000; i++ {
+		h.Add(fmt.Sprintf("visitor-%d", i))
+	}
+
+	data := h.Bytes()
+	if len(data) != hllRegisters {
+		t.Fatalf("serialized size = %d, want %d", len(data), hllRegisters)
+	}
+	restored, err := HyperLogLogFromBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Estimate() != h.Estimate() {
+		t.Errorf("restored estimate = %d, want %d", restored.Estimate(), h.Estimate())
+	}
+
+	// Neither side shares registers with the serialized form
+	data[0], data[1] = 0xff, 0xff
+	if h.registers[0] == 0xff || restored.registers[1] == 0xff {
+		t.Error("sketch shares registers with serialized bytes")
+	}
+
+	for _, size := range []int{0, hllRegisters - 1, hllRegisters + 1} {
+		if _, err := HyperLogLogFromBytes(make([]byte, size)); err == nil {
+			t.Errorf("HyperLogLogFromBytes accepted %d bytes", size)
+		}
+	}
+}
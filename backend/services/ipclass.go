@@ -0,0 +1,129 @@
+package services
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// Address kinds for IPs that are never sent to geo providers
+const (
+	IPKindPublic     = ""
+	IPKindLoopback   = "Loopback"
+	IPKindPrivate    = "Private (RFC 1918)"
+	IPKindCGNAT      = "Carrier-grade NAT"
+	IPKindLinkLocal  = "Link-local"
+	IPKindULA        = "Unique local (IPv6)"
+	IPKindReserved   = "Reserved"
+	IPKindMulticast  = "Multicast"
+	IPKindUnspecific = "Unspecified"
+)
+
+// specialPrefixes maps non-public address ranges to their kind. Ranges are
+// checked after netip's built-in loopback/private/link-local predicates.
+var specialPrefixes = []struct {
+	prefix netip.Prefix
+	kind   string
+}{
+	{netip.MustParsePrefix("100.64.0.0/10"), IPKindCGNAT},
+	{netip.MustParsePrefix("0.0.0.0/8"), IPKindReserved},
+	{netip.MustParsePrefix("192.0.0.0/24"), IPKindReserved},
+	{netip.MustParsePrefix("192.0.2.0/24"), IPKindReserved},
+	{netip.MustParsePrefix("198.18.0.0/15"), IPKindReserved},
+	{netip.MustParsePrefix("198.51.100.0/24"), IPKindReserved},
+	{netip.MustParsePrefix("203.0.113.0/24"), IPKindReserved},
+	{netip.MustParsePrefix("240.0.0.0/4"), IPKindReserved},
+	{netip.MustParsePrefix("255.255.255.255/32"), IPKindReserved},
+	{netip.MustParsePrefix("64:ff9b:1::/48"), IPKindReserved},
+	{netip.MustParsePrefix("100::/64"), IPKindReserved},
+	{netip.MustParsePrefix("2001:db8::/32"), IPKindReserved},
+	{netip.MustParsePrefix("2001::/23"), IPKindReserved},
+}
+
+// ClassifyIP returns the kind of a non-public address, or IPKindPublic
+func ClassifyIP(addr netip.Addr) string {
+	addr = addr.Unmap()
+
+	switch {
+	case addr.IsUnspecified():
+		return IPKindUnspecific
+	case addr.IsLoopback():
+		return IPKindLoopback
+	case addr.Is4() && addr.IsPrivate():
+		return IPKindPrivate
+	case addr.Is6() && addr.IsPrivate():
+		return IPKindULA
+	case addr.IsLinkLocalUnicast():
+		return IPKindLinkLocal
+	case addr.IsMulticast():
+		return IPKindMulticast
+	}
+
+	for _, special := range specialPrefixes {
+		if special.prefix.Contains(addr) {
+			return special.kind
+		}
+	}
+	return IPKindPublic
+}
+
+// labeledPrefix maps a CIDR range to a site name
+type labeledPrefix struct {
+	prefix netip.Prefix
+	name   string
+}
+
+// NetworkLabels maps private CIDR ranges to office or site names
+type NetworkLabels struct {
+	prefixes []labeledPrefix
+}
+
+// ParseNetworkLabels parses "CIDR=Name" pairs separated by commas or
+// semicolons, e.g. "10.1.0.0/16=Warsaw Office;10.2.0.0/16=Berlin Office"
+func ParseNetworkLabels(spec string) (*NetworkLabels, error) {
+	labels := &NetworkLabels{}
+
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == ';' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		cidr, name, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid network label %q, expected CIDR=Name", entry)
+		}
+
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid network label %q: %w", entry, err)
+		}
+
+		labels.prefixes = append(labels.prefixes, labeledPrefix{
+			prefix: prefix.Masked(),
+			name:   strings.TrimSpace(name),
+		})
+	}
+
+	// Most specific prefix wins
+	sort.SliceStable(labels.prefixes, func(i, j int) bool {
+		return labels.prefixes[i].prefix.Bits() > labels.prefixes[j].prefix.Bits()
+	})
+
+	return labels, nil
+}
+
+// Lookup returns the site name for addr, if any range contains it
+func (n *NetworkLabels) Lookup(addr netip.Addr) (string, bool) {
+	if n == nil {
+		return "", false
+	}
+	addr = addr.Unmap()
+	for _, lp := range n.prefixes {
+		if lp.prefix.Contains(addr) {
+			return lp.name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,297 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/models"
+
+	"gorm.io/gorm"
+)
+
+// ErrLockoutInactive means a lockout has already expired or been lifted
+var ErrLockoutInactive = errors.New("lockout is not active")
+
+// uncountedFailures are failure reasons that do not count towards delays and
+// lockouts: refused attempts never checked a password, and single sign-on
+// identities without access were already authenticated by their provider
+var uncountedFailures = []string{
+	models.LoginFailureThrottled,
+	models.LoginFailureLocked,
+	models.LoginFailureNoAccess,
+}
+
+// LoginBlock describes why a login attempt is refused before the password
+// is checked
+type LoginBlock struct {
+	// Reason is models.LoginFailureThrottled or models.LoginFailureLocked
+	Reason string
+	// RetryAfter is how long until a new attempt is allowed
+	RetryAfter time.Duration
+}
+
+// concurrentLoginRetry is the Retry-After of attempts refused because
+// checks are already running
+const concurrentLoginRetry = time.Second
+
+// LoginGuard protects logins against password guessing. Failed attempts
+// recorded in login_attempts delay the next attempt for the same username
+// or IP address, doubling with each failure, and enough failures within the
+// window lock the username or IP address out temporarily.
+//
+// Only one check per username runs at a time, so parallel guesses cannot
+// all pass Check before the first failure is recorded, and the number of
+// concurrent password checks is capped to bound hashing memory.
+type LoginGuard struct {
+	maxFailures   int
+	maxIPFailures int
+	window        time.Duration
+	lockout       time.Duration
+	delay         time.Duration
+	maxDelay      time.Duration
+
+	slots    chan struct{}
+	mu       sync.Mutex
+	checking map[string]bool
+}
+
+// NewLoginGuard creates a guard that locks out a username after maxFailures
+// and an IP address after maxIPFailures failures within window (0 disables
+// either lockout). Lockouts last lockout; delays start at delay and double
+// up to maxDelay. At most maxConcurrent checks (at least one) run at once.
+func NewLoginGuard(maxFailures, maxIPFailures int, window, lockout, delay, maxDelay time.Duration, maxConcurrent int) *LoginGuard {
+	return &LoginGuard{
+		maxFailures:   maxFailures,
+		maxIPFailures: maxIPFailures,
+		window:        window,
+		lockout:       lockout,
+		delay:         delay,
+		maxDelay:      maxDelay,
+		slots:         make(chan struct{}, max(maxConcurrent, 1)),
+		checking:      make(map[string]bool),
+	}
+}
+
+// Begin reserves a credential check for username. It returns a block when
+// a check of the same username is still running or all check slots are
+// taken; otherwise the returned function ends the reservation and must be
+// called once the attempt has been recorded.
+func (g *LoginGuard) Begin(username string) (func(), *LoginBlock) {
+	busy := &LoginBlock{Reason: models.LoginFailureThrottled, RetryAfter: concurrentLoginRetry}
+
+	g.mu.Lock()
+	if g.checking[username] {
+		g.mu.Unlock()
+		return nil, busy
+	}
+	select {
+	case g.slots <- struct{}{}:
+	default:
+		g.mu.Unlock()
+		return nil, busy
+	}
+	g.checking[username] = true
+	g.mu.Unlock()
+
+	return func() {
+		g.mu.Lock()
+		delete(g.checking, username)
+		<-g.slots
+		g.mu.Unlock()
+	}, nil
+}
+
+// guardSubject is a username or IP address whose failures are counted
+type guardSubject struct {
+	scope       string
+	subject     string
+	maxFailures int
+}
+
+// subjects returns the username and IP address of an attempt
+func (g *LoginGuard) subjects(username, ip string) []guardSubject {
+	return []guardSubject{
+		{scope: models.LockoutScopeUsername, subject: username, maxFailures: g.maxFailures},
+		{scope: models.LockoutScopeIP, subject: ip, maxFailures: g.maxIPFailures},
+	}
+}
+
+// Check returns why a login for username from ip must be refused, or nil
+// when it may proceed
+func (g *LoginGuard) Check(username, ip string) (*LoginBlock, error) {
+	now := time.Now()
+
+	var lockouts []models.LoginLockout
+	err := database.DB.
+		Where("unlocked_at IS NULL AND locked_until > ?", now).
+		Where("(scope = ? AND subject = ?) OR (scope = ? AND subject = ?)",
+			models.LockoutScopeUsername, username, models.LockoutScopeIP, ip).
+		Find(&lockouts).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(lockouts) > 0 {
+		block := &LoginBlock{Reason: models.LoginFailureLocked}
+		for _, lockout := range lockouts {
+			if wait := lockout.LockedUntil.Sub(now); wait > block.RetryAfter {
+				block.RetryAfter = wait
+			}
+		}
+		return block, nil
+	}
+
+	var block *LoginBlock
+	for _, s := range g.subjects(username, ip) {
+		failures, lastFailure, err := g.recentFailures(s, now)
+		if err != nil {
+			return nil, err
+		}
+		if failures == 0 {
+			continue
+		}
+		wait := lastFailure.Add(g.delayFor(failures)).Sub(now)
+		if wait > 0 && (block == nil || wait > block.RetryAfter) {
+			block = &LoginBlock{Reason: models.LoginFailureThrottled, RetryAfter: wait}
+		}
+	}
+	return block, nil
+}
+
+// Record stores a login attempt. Failed attempts lock out their username or
+// IP address once it reaches its failure threshold.
+func (g *LoginGuard) Record(attempt *models.LoginAttempt) error {
+	if err := database.DB.Create(attempt).Error; err != nil {
+		return err
+	}
+	if attempt.Success || slices.Contains(uncountedFailures, attempt.FailureReason) {
+		return nil
+	}
+
+	for _, s := range g.subjects(attempt.Username, attempt.IPAddress) {
+		if s.maxFailures <= 0 {
+			continue
+		}
+		failures, _, err := g.recentFailures(s, attempt.CreatedAt)
+		if err != nil {
+			return err
+		}
+		if failures < int64(s.maxFailures) {
+			continue
+		}
+
+		lockout := models.LoginLockout{
+			Scope:       s.scope,
+			Subject:     s.subject,
+			Failures:    int(failures),
+			LockedUntil: attempt.CreatedAt.Add(g.lockout),
+		}
+		if err := database.DB.Create(&lockout).Error; err != nil {
+			return err
+		}
+		LoginLockouts.WithLabelValues(s.scope).Inc()
+		slog.Warn("login locked out", "scope", s.scope, "subject", s.subject,
+			"failures", failures, "locked_until", lockout.LockedUntil)
+	}
+	return nil
+}
+
+// Unlock lifts a lockout, together with any other active lockout of the
+// same username or IP address, and restarts its failure count
+func (g *LoginGuard) Unlock(id uint, unlockedBy string) (*models.LoginLockout, error) {
+	var lockout models.LoginLockout
+	if err := database.DB.Where("id = ?", id).Take(&lockout).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !lockout.IsActive(now) {
+		return nil, ErrLockoutInactive
+	}
+
+	err := database.DB.Model(&models.LoginLockout{}).
+		Where("scope = ? AND subject = ? AND unlocked_at IS NULL AND locked_until > ?", lockout.Scope, lockout.Subject, now).
+		UpdateColumns(map[string]interface{}{
+			"unlocked_at": now,
+			"unlocked_by": unlockedBy,
+		}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	lockout.UnlockedAt = &now
+	lockout.UnlockedBy = unlockedBy
+	slog.Info("login lockout lifted", "scope", lockout.Scope, "subject", lockout.Subject, "unlocked_by", unlockedBy)
+	return &lockout, nil
+}
+
+// recentFailures counts the failed attempts of a subject within the window
+// and returns the time of the latest. Counting restarts when a lockout
+// starts or is lifted and, for usernames, after a successful login.
+// Attempts refused without checking the password are not counted.
+func (g *LoginGuard) recentFailures(s guardSubject, now time.Time) (int64, time.Time, error) {
+	since := now.Add(-g.window)
+
+	var lockout models.LoginLockout
+	err := database.DB.Where("scope = ? AND subject = ?", s.scope, s.subject).
+		Order("created_at DESC").Take(&lockout).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, time.Time{}, err
+	}
+	if err == nil {
+		reset := lockout.CreatedAt
+		if lockout.UnlockedAt != nil {
+			reset = *lockout.UnlockedAt
+		}
+		if reset.After(since) {
+			since = reset
+		}
+	}
+
+	column := "ip_address"
+	if s.scope == models.LockoutScopeUsername {
+		column = "username"
+
+		var lastSuccess sql.NullTime
+		err := database.DB.Model(&models.LoginAttempt{}).
+			Select("MAX(created_at)").
+			Where("username = ? AND success", s.subject).
+			Row().Scan(&lastSuccess)
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		if lastSuccess.Valid && lastSuccess.Time.After(since) {
+			since = lastSuccess.Time
+		}
+	}
+
+	var stats struct {
+		Failures    int64
+		LastFailure sql.NullTime
+	}
+	err = database.DB.Model(&models.LoginAttempt{}).
+		Select("COUNT(*) AS failures, MAX(created_at) AS last_failure").
+		Where(column+" = ? AND NOT success AND created_at > ?", s.subject, since).
+		Where("failure_reason NOT IN ?", uncountedFailures).
+		Scan(&stats).Error
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return stats.Failures, stats.LastFailure.Time, nil
+}
+
+// delayFor returns the wait required after the given number of failures
+func (g *LoginGuard) delayFor(failures int64) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	delay := g.delay
+	for i := int64(1); i < failures && delay < g.maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, g.maxDelay)
+}
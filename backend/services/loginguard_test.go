@@ -0,0 +1,97 @@
+package services
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"link-shortener/models"
+)
+
+func TestLoginGuardBegin(t *testing.T) {
+	g := NewLoginGuard(5, 20, time.Hour, time.Hour, time.Second, time.Minute, 2)
+
+	releaseAlice, block := g.Begin("alice")
+	if block != nil {
+		t.Fatalf("first check of alice was refused: %+v", block)
+	}
+
+	// A second check of the same username waits for the first to be recorded
+	if _, block := g.Begin("alice"); block == nil || block.Reason != models.LoginFailureThrottled {
+		t.Errorf("concurrent check of alice = %+v, want throttled", block)
+	}
+
+	releaseBob, block := g.Begin("bob")
+	if block != nil {
+		t.Fatalf("check of bob was refused: %+v", block)
+	}
+
+	// Both slots are taken
+	if _, block := g.Begin("carol"); block == nil || block.RetryAfter <= 0 {
+		t.Errorf("check beyond the concurrency cap = %+v, want a block with Retry-After", block)
+	}
+
+	releaseAlice()
+	releaseAgain, block := g.Begin("alice")
+	if block != nil {
+		t.Fatalf("check of alice after release was refused: %+v", block)
+	}
+	releaseAgain()
+	releaseBob()
+}
+
+func TestLoginGuardBeginConcurrent(t *testing.T) {
+	g := NewLoginGuard(5, 20, time.Hour, time.Hour, time.Second, time.Minute, 4)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		running  int
+		peak     int
+		admitted = make(map[string]int)
+	)
+	start := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		username := []string{"alice", "bob", "carol", "dave", "erin", "frank"}[i%6]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			release, block := g.Begin(username)
+			if block != nil {
+				return
+			}
+			mu.Lock()
+			running++
+			peak = max(peak, running)
+			admitted[username]++
+			if admitted[username] > 1 {
+				t.Errorf("two checks of %s ran at once", username)
+			}
+			mu.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			admitted[username]--
+			mu.Unlock()
+			release()
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if peak > 4 {
+		t.Errorf("%d checks ran at once, want at most 4", peak)
+	}
+}
+
+func TestLoginGuardMinimumConcurrency(t *testing.T) {
+	g := NewLoginGuard(5, 20, time.Hour, time.Hour, time.Second, time.Minute, 0)
+	release, block := g.Begin("alice")
+	if block != nil {
+		t.Fatal("a guard without concurrency slots refuses every login")
+	}
+	release()
+}
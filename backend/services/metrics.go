@@ -0,0 +1,127 @@
+package services
+
+import (
+	"database/sql"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// metricsNamespace prefixes all application metric names
+const metricsNamespace = "kintercut"
+
+// MetricsRegistry holds all metrics exposed on /metrics
+var MetricsRegistry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequests counts handled requests per method, route and status
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	// HTTPRequestDuration observes request latency per method, route and status
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method, route and status code.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"method", "route", "status"})
+
+	// Redirects counts short link lookups by outcome
+	Redirects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "redirects_total",
+		Help:      "Short link lookups by outcome (redirected, expired, not_found).",
+	}, []string{"outcome"})
+
+	// ClicksTracked counts clicks stored, by traffic type
+	ClicksTracked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "clicks_tracked_total",
+		Help:      "Clicks stored by traffic type (human, bot).",
+	}, []string{"traffic"})
+
+	// ClicksDropped counts clicks that could not be stored
+	ClicksDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "clicks_dropped_total",
+		Help:      "Clicks that could not be stored, by reason.",
+	}, []string{"reason"})
+
+	// LoginAttempts counts admin logins by result
+	LoginAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "login_attempts_total",
+		Help:      "Admin login attempts by result (success, failure, throttled, locked).",
+	}, []string{"result"})
+
+	// LoginLockouts counts lockouts after repeated failed logins
+	LoginLockouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "login_lockouts_total",
+		Help:      "Login lockouts after repeated failures, by scope (username, ip).",
+	}, []string{"scope"})
+)
+
+// RegisterMetrics registers application, Go runtime, database pool and
+// geolocation metrics
+func RegisterMetrics(db *sql.DB, geoService *GeoService) {
+	MetricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(db, "postgres"),
+		HTTPRequests,
+		HTTPRequestDuration,
+		Redirects,
+		ClicksTracked,
+		ClicksDropped,
+		LoginAttempts,
+		LoginLockouts,
+		&geoCollector{geoService: geoService},
+	)
+}
+
+var (
+	geoCacheHitsDesc = prometheus.NewDesc(metricsNamespace+"_geo_cache_hits_total",
+		"Geolocation cache hits.", nil, nil)
+	geoCacheMissesDesc = prometheus.NewDesc(metricsNamespace+"_geo_cache_misses_total",
+		"Geolocation cache misses.", nil, nil)
+	geoCacheEvictionsDesc = prometheus.NewDesc(metricsNamespace+"_geo_cache_evictions_total",
+		"Geolocation cache evictions.", nil, nil)
+	geoCacheSizeDesc = prometheus.NewDesc(metricsNamespace+"_geo_cache_entries",
+		"Entries in the geolocation cache.", nil, nil)
+	geoLookupsDesc = prometheus.NewDesc(metricsNamespace+"_geo_provider_lookups_total",
+		"Geolocation lookups by provider and result (found, not_found, rate_limited, error).",
+		[]string{"provider", "result"}, nil)
+)
+
+// geoCollector exports GeoService statistics at scrape time
+type geoCollector struct {
+	geoService *GeoService
+}
+
+func (g *geoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- geoCacheHitsDesc
+	ch <- geoCacheMissesDesc
+	ch <- geoCacheEvictionsDesc
+	ch <- geoCacheSizeDesc
+	ch <- geoLookupsDesc
+}
+
+func (g *geoCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := g.geoService.Stats()
+
+	ch <- prometheus.MustNewConstMetric(geoCacheHitsDesc, prometheus.CounterValue, float64(stats.Cache.Hits))
+	ch <- prometheus.MustNewConstMetric(geoCacheMissesDesc, prometheus.CounterValue, float64(stats.Cache.Misses))
+	ch <- prometheus.MustNewConstMetric(geoCacheEvictionsDesc, prometheus.CounterValue, float64(stats.Cache.Evictions))
+	ch <- prometheus.MustNewConstMetric(geoCacheSizeDesc, prometheus.GaugeValue, float64(stats.Cache.Size))
+
+	for _, p := range stats.Providers {
+		ch <- prometheus.MustNewConstMetric(geoLookupsDesc, prometheus.CounterValue, float64(p.Found), p.Name, "found")
+		ch <- prometheus.MustNewConstMetric(geoLookupsDesc, prometheus.CounterValue, float64(p.NotFound), p.Name, "not_found")
+		ch <- prometheus.MustNewConstMetric(geoLookupsDesc, prometheus.CounterValue, float64(p.RateLimited), p.Name, "rate_limited")
+		ch <- prometheus.MustNewConstMetric(geoLookupsDesc, prometheus.CounterValue, float64(p.Errors), p.Name, "error")
+	}
+}
@@ -0,0 +1,448 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/models"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+// OIDCStateTTL is how long a started single sign-on may take to complete
+const OIDCStateTTL = 10 * time.Minute
+
+// oidcWildcard in a role mapping matches every identity
+const oidcWildcard = "*"
+
+// Errors returned by single sign-on
+var (
+	// ErrOIDCUnavailable means the identity provider could not be discovered
+	ErrOIDCUnavailable = errors.New("identity provider unavailable")
+	// ErrOIDCInvalidState means the login was not started here, has expired
+	// or was already completed
+	ErrOIDCInvalidState = errors.New("invalid or expired login state")
+	// ErrOIDCFailed means the identity provider rejected the code or
+	// returned an invalid ID token
+	ErrOIDCFailed = errors.New("single sign-on failed")
+	// ErrOIDCNoAccess means no mapped claim value grants the identity a role
+	ErrOIDCNoAccess = errors.New("identity has no role")
+	// ErrOIDCAccountDisabled means the identity's account was disabled
+	ErrOIDCAccountDisabled = errors.New("account disabled")
+	// ErrOIDCInvalidUsername means the username claim is missing or too long
+	ErrOIDCInvalidUsername = errors.New("invalid username claim")
+	// ErrOIDCUsernameTaken means another account already has the identity's
+	// username
+	ErrOIDCUsernameTaken = errors.New("username already taken")
+)
+
+// OIDCConfig configures single sign-on with an OpenID Connect provider
+type OIDCConfig struct {
+	IssuerURL string
+	ClientID  string
+	// ClientSecret is empty for public clients, which rely on PKCE alone
+	ClientSecret string
+	RedirectURL  string
+	// Scopes are space- or comma-separated; "openid" is always requested
+	Scopes string
+	// UsernameClaim names the claim used as username of new accounts
+	UsernameClaim string
+	// RolesClaims are the comma-separated claims whose values are mapped to
+	// roles. Dots select nested claims, e.g. "realm_access.roles".
+	RolesClaims string
+	// RoleMapping maps claim values to roles, see ParseOIDCRoleMapping
+	RoleMapping string
+}
+
+// OIDCIdentity is an identity verified by the identity provider
+type OIDCIdentity struct {
+	Issuer   string
+	Subject  string
+	Username string
+	// Roles are granted by the mapped claim values, in the order of models.Roles
+	Roles []string
+}
+
+// OIDCService signs users in with an OpenID Connect provider using the
+// authorization code flow with PKCE. The provider is discovered on first
+// use, so the service starts even while the provider is unreachable.
+type OIDCService struct {
+	clientID      string
+	clientSecret  string
+	issuerURL     string
+	redirectURL   string
+	scopes        []string
+	usernameClaim string
+	rolesClaims   []string
+	roleMapping   map[string][]string
+	client        *http.Client
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDCService creates a single sign-on service. At least one claim
+// value must be mapped to a role, otherwise nobody could sign in.
+func NewOIDCService(cfg OIDCConfig) (*OIDCService, error) {
+	if cfg.IssuerURL == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("issuer URL, client ID and redirect URL are required")
+	}
+
+	roleMapping, err := ParseOIDCRoleMapping(cfg.RoleMapping)
+	if err != nil {
+		return nil, err
+	}
+	if len(roleMapping) == 0 {
+		return nil, errors.New("role mapping is empty, so nobody could sign in")
+	}
+
+	split := func(r rune) bool { return r == ',' || r == ' ' }
+	scopes := strings.FieldsFunc(cfg.Scopes, split)
+	if !slices.Contains(scopes, oidc.ScopeOpenID) {
+		scopes = append([]string{oidc.ScopeOpenID}, scopes...)
+	}
+
+	return &OIDCService{
+		clientID:      cfg.ClientID,
+		clientSecret:  cfg.ClientSecret,
+		issuerURL:     cfg.IssuerURL,
+		redirectURL:   cfg.RedirectURL,
+		scopes:        scopes,
+		usernameClaim: cfg.UsernameClaim,
+		rolesClaims:   strings.FieldsFunc(cfg.RolesClaims, split),
+		roleMapping:   roleMapping,
+		client:        &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// ParseOIDCRoleMapping parses claim value to role mappings such as
+// "kintercut-admins=owner;marketing=editor,viewer;*=viewer". Entries are
+// separated by semicolons and the last "=" separates the claim value from
+// its roles, so values may be LDAP DNs like "cn=staff,ou=groups".
+func ParseOIDCRoleMapping(spec string) (map[string][]string, error) {
+	mapping := make(map[string][]string)
+
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid role mapping %q, expected value=role", entry)
+		}
+		roles, err := JoinRoles(strings.Split(entry[i+1:], ","))
+		if err != nil {
+			return nil, fmt.Errorf("invalid role mapping %q: %w", entry, err)
+		}
+
+		value := strings.TrimSpace(entry[:i])
+		mapping[value] = append(mapping[value], strings.Split(roles, ",")...)
+	}
+
+	return mapping, nil
+}
+
+// discover returns the provider, discovering it on first use
+func (s *OIDCService) discover() (*oidc.Provider, *oidc.IDTokenVerifier, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.provider == nil {
+		// The provider refreshes its signing keys with this context later,
+		// so it must not be a request context
+		ctx := oidc.ClientContext(context.Background(), s.client)
+		provider, err := oidc.NewProvider(ctx, s.issuerURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrOIDCUnavailable, err)
+		}
+		s.provider = provider
+		s.verifier = provider.Verifier(&oidc.Config{ClientID: s.clientID})
+	}
+	return s.provider, s.verifier, nil
+}
+
+// oauth2Config returns the OAuth 2.0 client configuration for provider
+func (s *OIDCService) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     s.clientID,
+		ClientSecret: s.clientSecret,
+		RedirectURL:  s.redirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       s.scopes,
+	}
+}
+
+// StartLogin begins a login and returns the identity provider URL to send
+// the browser to, along with the login's state
+func (s *OIDCService) StartLogin(ctx context.Context) (string, string, error) {
+	provider, _, err := s.discover()
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	db := database.DB.WithContext(ctx)
+	now := time.Now()
+	// Abandoned logins are deleted whenever a new one starts
+	if err := db.Where("expires_at < ?", now).Delete(&models.OIDCLoginState{}).Error; err != nil {
+		return "", "", err
+	}
+	err = db.Create(&models.OIDCLoginState{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    now.Add(OIDCStateTTL),
+	}).Error
+	if err != nil {
+		return "", "", err
+	}
+
+	authURL := s.oauth2Config(provider).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	return authURL, state, nil
+}
+
+// CompleteLogin exchanges the authorization code of a login begun with
+// StartLogin and returns the verified identity. Each state works once.
+func (s *OIDCService) CompleteLogin(ctx context.Context, state, code string) (*OIDCIdentity, error) {
+	db := database.DB.WithContext(ctx)
+
+	var stored models.OIDCLoginState
+	err := db.Where("state = ?", state).Take(&stored).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrOIDCInvalidState
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Only the request that deletes the state may use it
+	result := db.Where("state = ?", state).Delete(&models.OIDCLoginState{})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 || !stored.ExpiresAt.After(time.Now()) {
+		return nil, ErrOIDCInvalidState
+	}
+
+	provider, verifier, err := s.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = oidc.ClientContext(ctx, s.client)
+	token, err := s.oauth2Config(provider).Exchange(ctx, code, oauth2.VerifierOption(stored.CodeVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("%w: code exchange: %w", ErrOIDCFailed, err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: token response has no ID token", ErrOIDCFailed)
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrOIDCFailed, err)
+	}
+	if idToken.Nonce != stored.Nonce {
+		return nil, fmt.Errorf("%w: ID token nonce does not match", ErrOIDCFailed)
+	}
+
+	claims := make(map[string]interface{})
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrOIDCFailed, err)
+	}
+
+	// Some providers return profile and group claims only from the
+	// userinfo endpoint; ID token claims take precedence
+	if s.missingClaims(claims) && provider.UserInfoEndpoint() != "" {
+		info, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+		if err != nil {
+			return nil, fmt.Errorf("%w: userinfo: %w", ErrOIDCFailed, err)
+		}
+		if info.Subject != idToken.Subject {
+			return nil, fmt.Errorf("%w: userinfo subject does not match the ID token", ErrOIDCFailed)
+		}
+		var extra map[string]interface{}
+		if err := info.Claims(&extra); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrOIDCFailed, err)
+		}
+		for name, value := range extra {
+			if _, ok := claims[name]; !ok {
+				claims[name] = value
+			}
+		}
+	}
+
+	username, _ := lookupClaim(claims, s.usernameClaim).(string)
+	return &OIDCIdentity{
+		Issuer:   idToken.Issuer,
+		Subject:  idToken.Subject,
+		Username: strings.TrimSpace(username),
+		Roles:    s.mapRoles(claims),
+	}, nil
+}
+
+// missingClaims reports whether the username or a roles claim is absent
+func (s *OIDCService) missingClaims(claims map[string]interface{}) bool {
+	if lookupClaim(claims, s.usernameClaim) == nil {
+		return true
+	}
+	for _, name := range s.rolesClaims {
+		if lookupClaim(claims, name) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// mapRoles returns the roles granted by the identity's claim values
+func (s *OIDCService) mapRoles(claims map[string]interface{}) []string {
+	granted := make(map[string]bool)
+	grant := func(value string) {
+		for _, role := range s.roleMapping[value] {
+			granted[role] = true
+		}
+	}
+
+	grant(oidcWildcard)
+	for _, name := range s.rolesClaims {
+		switch value := lookupClaim(claims, name).(type) {
+		case nil:
+		case []interface{}:
+			for _, v := range value {
+				grant(fmt.Sprint(v))
+			}
+		default:
+			grant(fmt.Sprint(value))
+		}
+	}
+
+	var roles []string
+	for _, role := range models.Roles {
+		if granted[role] {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// lookupClaim returns the claim called name. Names that are not a
+// top-level claim are split at dots to select nested claims.
+func lookupClaim(claims map[string]interface{}, name string) interface{} {
+	if value, ok := claims[name]; ok {
+		return value
+	}
+
+	var value interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		nested, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = nested[part]
+	}
+	return value
+}
+
+// SignIn returns the account of a verified identity, creating it on the
+// first sign-in. The account's roles are replaced by the identity's roles
+// every time, so the identity provider stays in charge of access.
+func (s *OIDCService) SignIn(identity *OIDCIdentity) (*models.User, error) {
+	if len(identity.Roles) == 0 {
+		return nil, ErrOIDCNoAccess
+	}
+	roles := strings.Join(identity.Roles, ",")
+
+	user, err := findOIDCUser(identity)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		user, err = createOIDCUser(identity, roles)
+	}
+	switch {
+	case err != nil:
+		return nil, err
+	case !user.Active:
+		return nil, ErrOIDCAccountDisabled
+	case user.Roles != roles:
+		if err := database.DB.Model(user).UpdateColumn("roles", roles).Error; err != nil {
+			return nil, err
+		}
+		user.Roles = roles
+	}
+
+	now := time.Now()
+	database.DB.Model(user).UpdateColumn("last_login_at", now)
+	user.LastLoginAt = &now
+	return user, nil
+}
+
+// findOIDCUser returns the account of an identity
+func findOIDCUser(identity *OIDCIdentity) (*models.User, error) {
+	var user models.User
+	err := database.DB.
+		Where("oidc_issuer = ? AND oidc_subject = ?", identity.Issuer, identity.Subject).
+		Take(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// createOIDCUser creates the account of an identity's first sign-in
+func createOIDCUser(identity *OIDCIdentity, roles string) (*models.User, error) {
+	if identity.Username == "" || len(identity.Username) > 100 {
+		return nil, ErrOIDCInvalidUsername
+	}
+	usernameTaken := func() (bool, error) {
+		var count int64
+		err := database.DB.Model(&models.User{}).Where("username = ?", identity.Username).Count(&count).Error
+		return count > 0, err
+	}
+
+	taken, err := usernameTaken()
+	if err != nil {
+		return nil, err
+	}
+	if taken {
+		return nil, ErrOIDCUsernameTaken
+	}
+
+	subject := identity.Subject
+	user := &models.User{
+		Username:    identity.Username,
+		Roles:       roles,
+		Active:      true,
+		OIDCIssuer:  identity.Issuer,
+		OIDCSubject: &subject,
+	}
+	if err := database.DB.Create(user).Error; err != nil {
+		// A concurrent sign-in may have created the account, or another
+		// account taken the username, since the check above
+		if existing, findErr := findOIDCUser(identity); findErr == nil {
+			return existing, nil
+		}
+		if taken, _ := usernameTaken(); taken {
+			return nil, ErrOIDCUsernameTaken
+		}
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,503 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/internal/testdb"
+	"link-shortener/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	testClientID     = "kintercut"
+	testClientSecret = "client-secret"
+	testRedirectURL  = "https://links.example.com/adminek/sso"
+)
+
+// testGrant is what the mock provider knows about one authorization code
+type testGrant struct {
+	challenge string
+	nonce     string
+	claims    jwt.MapClaims
+}
+
+// mockOIDCProvider is an OpenID Connect provider serving discovery, JWKS
+// and token endpoints. Codes are issued by authorize instead of a login page.
+type mockOIDCProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]*testGrant
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockOIDCProvider{t: t, key: key, grants: make(map[string]*testGrant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *mockOIDCProvider) issuer() string {
+	return p.server.URL
+}
+
+func (p *mockOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                p.issuer(),
+		"authorization_endpoint":                p.issuer() + "/authorize",
+		"token_endpoint":                        p.issuer() + "/token",
+		"jwks_uri":                              p.issuer() + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *mockOIDCProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+// token redeems a code once, checking the client and the PKCE verifier
+func (p *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	grant := p.grants[code]
+	delete(p.grants, code)
+	p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if clientID != testClientID || clientSecret != testClientSecret || grant == nil ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":   p.issuer(),
+		"aud":   testClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Minute).Unix(),
+		"nonce": grant.nonce,
+	}
+	for name, value := range grant.claims {
+		claims[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		p.t.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access-" + code,
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idToken,
+	})
+}
+
+// authorize plays the user signing in at the provider: it checks the
+// authorization URL and returns a code for claims along with the state
+func (p *mockOIDCProvider) authorize(authURL string, claims jwt.MapClaims) (code, state string) {
+	p.t.Helper()
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		p.t.Fatalf("authorization URL without PKCE challenge: %s", authURL)
+	}
+	if query.Get("client_id") != testClientID || query.Get("redirect_uri") != testRedirectURL {
+		p.t.Fatalf("authorization URL for the wrong client: %s", authURL)
+	}
+
+	code, err = randomHex(16)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.mu.Lock()
+	p.grants[code] = &testGrant{
+		challenge: query.Get("code_challenge"),
+		nonce:     query.Get("nonce"),
+		claims:    claims,
+	}
+	p.mu.Unlock()
+	return code, query.Get("state")
+}
+
+// tamper changes the stored grant of code
+func (p *mockOIDCProvider) tamper(code string, change func(*testGrant)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	change(p.grants[code])
+}
+
+func newTestOIDCService(t *testing.T, p *mockOIDCProvider) *OIDCService {
+	t.Helper()
+
+	testdb.Open(t, &models.OIDCLoginState{})
+	s, err := NewOIDCService(OIDCConfig{
+		IssuerURL:     p.issuer(),
+		ClientID:      testClientID,
+		ClientSecret:  testClientSecret,
+		RedirectURL:   testRedirectURL,
+		Scopes:        "profile groups",
+		UsernameClaim: "preferred_username",
+		RolesClaims:   "groups",
+		RoleMapping:   "admins=owner;staff=viewer",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestOIDCLogin(t *testing.T) {
+	p := newMockOIDCProvider(t)
+	s := newTestOIDCService(t, p)
+	ctx := context.Background()
+
+	authURL, state, err := s.StartLogin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, urlState := p.authorize(authURL, jwt.MapClaims{
+		"sub":                "user-1",
+		"preferred_username": "alice",
+		"groups":             []string{"admins", "unmapped"},
+	})
+	if urlState != state {
+		t.Fatalf("authorization URL state = %q, want %q", urlState, state)
+	}
+
+	// The token endpoint only answers for the verifier of the challenge
+	identity, err := s.CompleteLogin(ctx, state, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &OIDCIdentity{Issuer: p.issuer(), Subject: "user-1", Username: "alice", Roles: []string{models.RoleOwner}}
+	if !reflect.DeepEqual(identity, want) {
+		t.Errorf("identity = %+v, want %+v", identity, want)
+	}
+
+	// The state is single-use, even with a fresh code
+	code, _ = p.authorize(authURL, jwt.MapClaims{"sub": "user-1"})
+	if _, err := s.CompleteLogin(ctx, state, code); !errors.Is(err, ErrOIDCInvalidState) {
+		t.Errorf("reused state: err = %v, want ErrOIDCInvalidState", err)
+	}
+	if _, err := s.CompleteLogin(ctx, "unknown", code); !errors.Is(err, ErrOIDCInvalidState) {
+		t.Errorf("unknown state: err = %v, want ErrOIDCInvalidState", err)
+	}
+}
+
+func TestOIDCLoginRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*testGrant)
+	}{
+		{"PKCE verifier mismatch", func(g *testGrant) { g.challenge = "not-the-challenge" }},
+		{"nonce mismatch", func(g *testGrant) { g.nonce = "replayed-nonce" }},
+		{"wrong audience", func(g *testGrant) { g.claims["aud"] = "another-client" }},
+		{"wrong issuer", func(g *testGrant) { g.claims["iss"] = "https://evil.example.com" }},
+		{"expired ID token", func(g *testGrant) { g.claims["exp"] = time.Now().Add(-time.Hour).Unix() }},
+	}
+
+	p := newMockOIDCProvider(t)
+	s := newTestOIDCService(t, p)
+	ctx := context.Background()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authURL, state, err := s.StartLogin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, _ := p.authorize(authURL, jwt.MapClaims{
+				"sub":                "user-1",
+				"preferred_username": "alice",
+				"groups":             []string{"admins"},
+			})
+			p.tamper(code, tt.change)
+
+			identity, err := s.CompleteLogin(ctx, state, code)
+			if !errors.Is(err, ErrOIDCFailed) {
+				t.Errorf("CompleteLogin() = %+v, %v, want ErrOIDCFailed", identity, err)
+			}
+		})
+	}
+}
+
+func TestOIDCLoginExpiredState(t *testing.T) {
+	p := newMockOIDCProvider(t)
+	s := newTestOIDCService(t, p)
+	ctx := context.Background()
+
+	authURL, state, err := s.StartLogin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := p.authorize(authURL, jwt.MapClaims{"sub": "user-1"})
+
+	err = database.DB.Model(&models.OIDCLoginState{}).
+		Where("state = ?", state).
+		Update("expires_at", time.Now().Add(-time.Second)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CompleteLogin(ctx, state, code); !errors.Is(err, ErrOIDCInvalidState) {
+		t.Errorf("err = %v, want ErrOIDCInvalidState", err)
+	}
+}
+
+func TestParseOIDCRoleMapping(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{spec: "", want: map[string][]string{}},
+		{
+			spec: "kintercut-admins=owner; marketing=editor,viewer ;*=viewer",
+			want: map[string][]string{
+				"kintercut-admins": {"owner"},
+				"marketing":        {"editor", "viewer"},
+				"*":                {"viewer"},
+			},
+		},
+		{
+			// LDAP DNs contain "=" and ","; the last "=" ends the value
+			spec: "cn=admins,ou=groups,dc=example,dc=com=owner;cn=staff,ou=groups,dc=example,dc=com=viewer, auditor",
+			want: map[string][]string{
+				"cn=admins,ou=groups,dc=example,dc=com": {"owner"},
+				"cn=staff,ou=groups,dc=example,dc=com":  {"viewer", "auditor"},
+			},
+		},
+		{spec: "staff=viewer;staff=auditor", want: map[string][]string{"staff": {"viewer", "auditor"}}},
+		{spec: "admins", wantErr: true},
+		{spec: "=owner", wantErr: true},
+		{spec: "admins=superuser", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseOIDCRoleMapping(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseOIDCRoleMapping(%q) = %v, want error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseOIDCRoleMapping(%q) error: %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseOIDCRoleMapping(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestOIDCMapRoles(t *testing.T) {
+	s, err := NewOIDCService(OIDCConfig{
+		IssuerURL:   "https://idp.example.com",
+		ClientID:    testClientID,
+		RedirectURL: testRedirectURL,
+		RolesClaims: "groups,realm_access.roles",
+		RoleMapping: "cn=admins,ou=groups,dc=example,dc=com=owner;staff=viewer;auditors=auditor;marketing=editor,viewer",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		claims string
+		want   []string
+	}{
+		{"no claims", `{}`, nil},
+		{"unmapped values", `{"groups": ["guests"]}`, nil},
+		{"LDAP DN", `{"groups": ["cn=admins,ou=groups,dc=example,dc=com"]}`, []string{"owner"}},
+		{"single string", `{"groups": "staff"}`, []string{"viewer"}},
+		{"roles in model order", `{"groups": ["auditors", "marketing", "staff"]}`, []string{"editor", "viewer", "auditor"}},
+		{"nested claim", `{"realm_access": {"roles": ["auditors"]}}`, []string{"auditor"}},
+		{"both claims", `{"groups": ["staff"], "realm_access": {"roles": ["auditors"]}}`, []string{"viewer", "auditor"}},
+		{"dotted top-level claim", `{"realm_access.roles": ["staff"]}`, []string{"viewer"}},
+	}
+
+	for _, tt := range tests {
+		var claims map[string]interface{}
+		if err := json.Unmarshal([]byte(tt.claims), &claims); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.mapRoles(claims); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: mapRoles(%s) = %v, want %v", tt.name, tt.claims, got, tt.want)
+		}
+	}
+
+	// A wildcard grants its roles to everyone who signs in
+	s.roleMapping[oidcWildcard] = []string{models.RoleViewer}
+	if got, want := s.mapRoles(map[string]interface{}{}), []string{models.RoleViewer}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wildcard: mapRoles() = %v, want %v", got, want)
+	}
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	testdb.Open(t, &models.User{})
+	s := &OIDCService{}
+
+	identity := &OIDCIdentity{Issuer: "https://idp.example.com", Subject: "user-1", Username: "alice", Roles: []string{models.RoleOwner}}
+	user, err := s.SignIn(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice" || user.Roles != models.RoleOwner || !user.Active || user.LastLoginAt == nil {
+		t.Errorf("first sign-in created %+v", user)
+	}
+
+	// Later sign-ins find the account by subject and replace its roles
+	identity.Username = "alice.renamed"
+	identity.Roles = []string{models.RoleViewer}
+	again, err := s.SignIn(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != user.ID || again.Username != "alice" || again.Roles != models.RoleViewer {
+		t.Errorf("second sign-in = %+v", again)
+	}
+
+	database.DB.Model(again).UpdateColumn("active", false)
+	if _, err := s.SignIn(identity); !errors.Is(err, ErrOIDCAccountDisabled) {
+		t.Errorf("disabled account: err = %v, want ErrOIDCAccountDisabled", err)
+	}
+
+	if _, err := s.SignIn(&OIDCIdentity{Issuer: identity.Issuer, Subject: "user-2", Username: "bob"}); !errors.Is(err, ErrOIDCNoAccess) {
+		t.Errorf("no roles: err = %v, want ErrOIDCNoAccess", err)
+	}
+	noName := &OIDCIdentity{Issuer: identity.Issuer, Subject: "user-2", Roles: []string{models.RoleViewer}}
+	if _, err := s.SignIn(noName); !errors.Is(err, ErrOIDCInvalidUsername) {
+		t.Errorf("no username: err = %v, want ErrOIDCInvalidUsername", err)
+	}
+
+	password := models.User{Username: "carol", PasswordHash: "unused", Roles: models.RoleViewer, Active: true}
+	if err := database.DB.Create(&password).Error; err != nil {
+		t.Fatal(err)
+	}
+	taken := &OIDCIdentity{Issuer: identity.Issuer, Subject: "user-3", Username: "carol", Roles: []string{models.RoleViewer}}
+	if _, err := s.SignIn(taken); !errors.Is(err, ErrOIDCUsernameTaken) {
+		t.Errorf("username of a password account: err = %v, want ErrOIDCUsernameTaken", err)
+	}
+}
+
+func TestOIDCSignInRace(t *testing.T) {
+	tests := []struct {
+		name string
+		// competitor is created after the username check of the first
+		// sign-in and before its insert
+		competitor func(identity *OIDCIdentity) *models.User
+		wantErr    error
+	}{
+		{
+			name: "same identity",
+			competitor: func(identity *OIDCIdentity) *models.User {
+				subject := identity.Subject
+				return &models.User{Username: identity.Username, Roles: models.RoleViewer, Active: true, OIDCIssuer: identity.Issuer, OIDCSubject: &subject}
+			},
+		},
+		{
+			name: "another account",
+			competitor: func(identity *OIDCIdentity) *models.User {
+				return &models.User{Username: identity.Username, PasswordHash: "unused", Roles: models.RoleViewer, Active: true}
+			},
+			wantErr: ErrOIDCUsernameTaken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testdb.Open(t, &models.User{})
+			identity := &OIDCIdentity{Issuer: "https://idp.example.com", Subject: "user-1", Username: "alice", Roles: []string{models.RoleViewer}}
+
+			competitor := tt.competitor(identity)
+			raced := false
+			err := database.DB.Callback().Create().Before("gorm:begin_transaction").Register("test:race", func(tx *gorm.DB) {
+				if raced {
+					return
+				}
+				if _, ok := tx.Statement.Model.(*models.User); ok {
+					raced = true
+					if err := database.DB.Create(competitor).Error; err != nil {
+						t.Error(err)
+					}
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			user, err := (&OIDCService{}).SignIn(identity)
+			if !raced {
+				t.Fatal("no concurrent sign-in")
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && user.ID != competitor.ID {
+				t.Errorf("signed in as account %d, want the concurrently created %d", user.ID, competitor.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Privacy modes for stored click IP addresses
+const (
+	PrivacyModeOff      = "off"
+	PrivacyModeTruncate = "truncate"
+	PrivacyModeHash     = "hash"
+)
+
+// hashedIPPrefix marks stored IPs that are keyed hashes rather than addresses
+const hashedIPPrefix = "h:"
+
+// IPAnonymizer transforms client IPs before they are stored. Truncation
+// keeps the /24 (IPv4) or /48 (IPv6) network; hashing replaces the address
+// with an HMAC under a key derived from the secret and a random salt for
+// the UTC day. Visitors can be counted as unique within a day, but once
+// the day's salt has been deleted its hashes cannot be linked to addresses
+// or to hashes of other days, even by someone holding the secret.
+type IPAnonymizer struct {
+	mode   string
+	secret []byte
+
+	mu       sync.Mutex
+	keyDay   string
+	dailyKey []byte
+}
+
+// ErrMissingHashSecret is returned when hash mode has no secret to key
+// the hashes with
+var ErrMissingHashSecret = errors.New("hash mode requires PRIVACY_HASH_SECRET")
+
+// NewIPAnonymizer creates an anonymizer for mode using secret to derive
+// the daily hash keys. The secret is required in hash mode.
+func NewIPAnonymizer(mode, secret string) (*IPAnonymizer, error) {
+	switch mode {
+	case "", PrivacyModeOff:
+		mode = PrivacyModeOff
+	case PrivacyModeTruncate:
+	case PrivacyModeHash:
+		if secret == "" {
+			return nil, ErrMissingHashSecret
+		}
+	default:
+		return nil, fmt.Errorf("unknown privacy mode %q (use off, truncate or hash)", mode)
+	}
+
+	return &IPAnonymizer{
+		mode:   mode,
+		secret: []byte(secret),
+	}, nil
+}
+
+// Mode returns the configured privacy mode
+func (a *IPAnonymizer) Mode() string {
+	return a.mode
+}
+
+// Anonymize returns the value to store for ip at time now
+func (a *IPAnonymizer) Anonymize(ip string, now time.Time) string {
+	switch a.mode {
+	case PrivacyModeTruncate:
+		return TruncateIP(ip)
+	case PrivacyModeHash:
+		return a.hash(ip, now)
+	}
+	return ip
+}
+
+// hash returns the keyed hash of ip under the key for now's UTC day, or
+// an empty string when the day's salt is unavailable
+func (a *IPAnonymizer) hash(ip string, now time.Time) string {
+	if ip == "" {
+		return ""
+	}
+
+	day := now.UTC().Format("2006-01-02")
+
+	a.mu.Lock()
+	if a.keyDay != day {
+		salt, err := dailySalt(day)
+		if err != nil {
+			a.mu.Unlock()
+			// Storing nothing is safer than storing the address
+			slog.Error("failed to load IP hash salt", "day", day, "error", err)
+			return ""
+		}
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write([]byte("kintercut-ip-hash:" + day + ":" + salt))
+		a.dailyKey = mac.Sum(nil)
+		a.keyDay = day
+	}
+	key := a.dailyKey
+	a.mu.Unlock()
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(ip))
+	return hashedIPPrefix + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// dailySalt returns the salt for day, creating it if this is the first
+// instance to need it, and deletes the salts of earlier days
+func dailySalt(day string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	var salt models.IPHashSalt
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// Another instance may have created the day's salt already
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&models.IPHashSalt{Day: day, Salt: hex.EncodeToString(b)}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("day = ?", day).Take(&salt).Error; err != nil {
+			return err
+		}
+		return tx.Where("day < ?", day).Delete(&models.IPHashSalt{}).Error
+	})
+	return salt.Salt, err
+}
+
+// TruncateIP zeroes the host part of an address, keeping /24 for IPv4 and
+// /48 for IPv6. Unparseable input yields an empty string.
+func TruncateIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap().WithZone("")
+
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.Addr().String()
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/internal/testdb"
+	"link-shortener/models"
+)
+
+func TestNewIPAnonymizerRequiresHashSecret(t *testing.T) {
+	if _, err := NewIPAnonymizer(PrivacyModeHash, ""); !errors.Is(err, ErrMissingHashSecret) {
+		t.Fatalf("hash mode without secret: err = %v, want ErrMissingHashSecret", err)
+	}
+	if _, err := NewIPAnonymizer(PrivacyModeHash, "test-secret"); err != nil {
+		t.Fatalf("hash mode with secret: %v", err)
+	}
+	for _, mode := range []string{"", PrivacyModeOff, PrivacyModeTruncate} {
+		if _, err := NewIPAnonymizer(mode, ""); err != nil {
+			t.Errorf("mode %q without secret: %v", mode, err)
+		}
+	}
+	if _, err := NewIPAnonymizer("scramble", "test-secret"); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+func TestIPHashDailySalt(t *testing.T) {
+	testdb.Open(t, &models.IPHashSalt{})
+
+	day1 := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	a, err := NewIPAnonymizer(PrivacyModeHash, "test-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second instance sharing the database
+	b, err := NewIPAnonymizer(PrivacyModeHash, "test-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := a.Anonymize("198.51.100.7", day1)
+	if !strings.HasPrefix(first, hashedIPPrefix) {
+		t.Fatalf("hash = %q", first)
+	}
+	if got := a.Anonymize("198.51.100.7", day1.Add(time.Hour)); got != first {
+		t.Error("hash changed within the day")
+	}
+	if got := b.Anonymize("198.51.100.7", day1); got != first {
+		t.Error("instances hash the same address differently on the same day")
+	}
+	if got := a.Anonymize("198.51.100.8", day1); got == first {
+		t.Error("different addresses hash alike")
+	}
+
+	if got := a.Anonymize("198.51.100.7", day2); got == first {
+		t.Error("hash did not change with the day")
+	}
+	var days []string
+	database.DB.Model(&models.IPHashSalt{}).Pluck("day", &days)
+	if len(days) != 1 || days[0] != "2024-03-02" {
+		t.Errorf("stored salts for %v, want only 2024-03-02", days)
+	}
+
+	// Without the deleted salt, the secret alone cannot reproduce the hash
+	testdb.Open(t, &models.IPHashSalt{})
+	c, err := NewIPAnonymizer(PrivacyModeHash, "test-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Anonymize("198.51.100.7", day1); got == first {
+		t.Error("hash reproduced after its salt was deleted")
+	}
+}
+
+func TestIPHashWithoutSalt(t *testing.T) {
+	// No salt table: nothing is stored rather than the address
+	testdb.Open(t)
+	a, err := NewIPAnonymizer(PrivacyModeHash, "test-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := a.Anonymize("198.51.100.7", time.Now()); got != "" {
+		t.Errorf("Anonymize = %q, want empty", got)
+	}
+}
@@ -0,0 +1,41 @@
+package services
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// DirectReferrer is the bucket used for clicks without a Referer header
+const DirectReferrer = "direct"
+
+// NormalizeReferrer reduces a Referer header to a lowercase host without
+// "www." prefix or port. It returns an empty string for direct traffic or
+// values that cannot be parsed.
+func NormalizeReferrer(referer string) string {
+	referer = strings.TrimSpace(referer)
+	if referer == "" {
+		return ""
+	}
+
+	parsed, err := url.Parse(referer)
+	if err != nil {
+		return ""
+	}
+
+	// android-app://<package>/ referrers yield the package name as host
+	host := parsed.Host
+	if host == "" {
+		return ""
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	host = strings.TrimPrefix(host, "www.")
+	if len(host) > 255 {
+		host = host[:255]
+	}
+	return host
+}
@@ -0,0 +1,314 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RollupState rows used for click rollups: how far clicks have been rolled
+// up by click time and by insert time
+const (
+	clickRollupState   = "clicks"
+	clickInsertedState = "clicks_inserted"
+)
+
+// rollupChunk limits how many hours of raw clicks are aggregated per transaction
+const rollupChunk = 24 * time.Hour
+
+// rollupLag keeps clicks inserted in the last minutes out of a run, so
+// inserts that are still being committed are not skipped
+const rollupLag = 2 * time.Minute
+
+// RollupProgress tells which raw clicks are counted in the rollup tables:
+// those clicked before ClickedUntil and inserted before InsertedUntil.
+// Clicks that are not, including clicks of earlier hours that were
+// inserted late, have to be read from the raw table.
+type RollupProgress struct {
+	ClickedUntil  time.Time
+	InsertedUntil time.Time
+}
+
+// RollupService periodically aggregates raw clicks into hourly and daily
+// rollup tables, scrubs personal data from old clicks and prunes raw clicks
+// past the retention period
+type RollupService struct {
+	interval   time.Duration
+	retention  time.Duration
+	scrubAfter time.Duration
+}
+
+// NewRollupService creates a new RollupService instance. A zero retention
+// keeps raw clicks forever; a zero scrubAfter never scrubs them.
+func NewRollupService(interval, retention, scrubAfter time.Duration) *RollupService {
+	return &RollupService{
+		interval:   interval,
+		retention:  retention,
+		scrubAfter: scrubAfter,
+	}
+}
+
+// Start runs rollups in the background until ctx is cancelled
+func (r *RollupService) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := r.Run(); err != nil {
+				slog.Error("click rollup failed", "error", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Run adds clicks inserted late to the rollups of their hours, aggregates
+// all complete hours since the last run and applies retention
+func (r *RollupService) Run() error {
+	insertedUntil := time.Now().UTC().Add(-rollupLag)
+	until := insertedUntil.Truncate(time.Hour)
+
+	progress, ok := RollupWatermark()
+	if !ok {
+		// First run: start at the oldest raw click
+		var oldest sql.NullTime
+		if err := database.DB.Model(&models.Click{}).Select("MIN(clicked_at)").Scan(&oldest).Error; err != nil {
+			return err
+		}
+		progress.ClickedUntil = until
+		if oldest.Valid {
+			progress.ClickedUntil = oldest.Time.UTC().Truncate(time.Hour)
+		}
+		progress.InsertedUntil = insertedUntil
+		err := database.DB.Transaction(func(tx *gorm.DB) error {
+			if err := saveWatermark(tx, progress.ClickedUntil); err != nil {
+				return err
+			}
+			return saveState(tx, clickInsertedState, progress.InsertedUntil)
+		})
+		if err != nil {
+			return err
+		}
+	} else if progress.InsertedUntil.IsZero() {
+		// Clicks stored before insert times were tracked are all rolled
+		// up as far as the watermark
+		progress.InsertedUntil = time.Now().UTC()
+		if err := saveState(database.DB, clickInsertedState, progress.InsertedUntil); err != nil {
+			return err
+		}
+	} else if progress.InsertedUntil.Before(insertedUntil) {
+		if err := rollupLateClicks(progress, insertedUntil); err != nil {
+			return err
+		}
+		progress.InsertedUntil = insertedUntil
+	}
+
+	from := progress.ClickedUntil
+	for from.Before(until) {
+		to := from.Add(rollupChunk)
+		if to.After(until) {
+			to = until
+		}
+		if err := rollupRange(from, to, progress.InsertedUntil); err != nil {
+			return err
+		}
+		from = to
+	}
+
+	if err := r.scrub(); err != nil {
+		return err
+	}
+	return r.prune()
+}
+
+// scrub clears IP addresses, user agents and full referrer URLs from clicks
+// older than scrubAfter; aggregated fields such as country and browser stay
+func (r *RollupService) scrub() error {
+	if r.scrubAfter <= 0 {
+		return nil
+	}
+
+	cutoff := time.Now().Add(-r.scrubAfter)
+	result := database.DB.Model(&models.Click{}).
+		Where("clicked_at < ?", cutoff).
+		Where("ip_address <> '' OR user_agent <> '' OR referrer_url <> '' OR latitude IS NOT NULL").
+		Updates(map[string]interface{}{
+			"ip_address":   "",
+			"user_agent":   "",
+			"referrer_url": "",
+			"latitude":     nil,
+			"longitude":    nil,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		slog.Info("scrubbed personal data from old clicks", "clicks", result.RowsAffected, "older_than", cutoff.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// rollupRange aggregates raw clicks in [from, to) that were inserted before
+// insertedUntil and advances the watermark. Later inserts are left to
+// rollupLateClicks.
+func rollupRange(from, to, insertedUntil time.Time) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`
+			INSERT INTO click_hourly_rollups
+				(link_id, bucket_start, country, device_type, browser, os, referrer, is_bot, clicks)
+			SELECT link_id, date_trunc('hour', clicked_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC',
+				COALESCE(country, ''), COALESCE(device_type, ''), COALESCE(browser, ''),
+				COALESCE(os, ''), COALESCE(referrer, ''), COALESCE(is_bot, false), count(*)
+			FROM clicks
+			WHERE clicked_at >= ? AND clicked_at < ? AND inserted_at < ?
+			GROUP BY 1, 2, 3, 4, 5, 6, 7, 8
+			ON CONFLICT (link_id, bucket_start, country, device_type, browser, os, referrer, is_bot)
+			DO UPDATE SET clicks = EXCLUDED.clicks`, from, to, insertedUntil).Error
+		if err != nil {
+			return err
+		}
+
+		if err := rollupDays(tx, from, to); err != nil {
+			return err
+		}
+		return saveWatermark(tx, to)
+	})
+}
+
+// rollupLateClicks adds clicks of rolled-up hours that were inserted in
+// [progress.InsertedUntil, insertedUntil) to their hours and days, and
+// advances the insert watermark
+func rollupLateClicks(progress RollupProgress, insertedUntil time.Time) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		late := tx.Model(&models.Click{}).
+			Where("clicked_at < ?", progress.ClickedUntil).
+			Where("inserted_at >= ? AND inserted_at < ?", progress.InsertedUntil, insertedUntil)
+
+		var oldest sql.NullTime
+		if err := late.Select("MIN(clicked_at)").Scan(&oldest).Error; err != nil {
+			return err
+		}
+		if oldest.Valid {
+			err := tx.Exec(`
+				INSERT INTO click_hourly_rollups
+					(link_id, bucket_start, country, device_type, browser, os, referrer, is_bot, clicks)
+				SELECT link_id, date_trunc('hour', clicked_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC',
+					COALESCE(country, ''), COALESCE(device_type, ''), COALESCE(browser, ''),
+					COALESCE(os, ''), COALESCE(referrer, ''), COALESCE(is_bot, false), count(*)
+				FROM clicks
+				WHERE clicked_at < ? AND inserted_at >= ? AND inserted_at < ?
+				GROUP BY 1, 2, 3, 4, 5, 6, 7, 8
+				ON CONFLICT (link_id, bucket_start, country, device_type, browser, os, referrer, is_bot)
+				DO UPDATE SET clicks = click_hourly_rollups.clicks + EXCLUDED.clicks`,
+				progress.ClickedUntil, progress.InsertedUntil, insertedUntil).Error
+			if err != nil {
+				return err
+			}
+
+			if err := rollupDays(tx, oldest.Time.UTC(), progress.ClickedUntil); err != nil {
+				return err
+			}
+			slog.Info("rolled up late clicks", "oldest", oldest.Time.UTC().Format(time.RFC3339))
+		}
+
+		return saveState(tx, clickInsertedState, insertedUntil)
+	})
+}
+
+// rollupDays recomputes every UTC day touched by [from, to) from the
+// hourly rollups
+func rollupDays(tx *gorm.DB, from, to time.Time) error {
+	return tx.Exec(`
+		INSERT INTO click_daily_rollups
+			(link_id, bucket_start, country, device_type, browser, os, referrer, is_bot, clicks)
+		SELECT link_id, date_trunc('day', bucket_start AT TIME ZONE 'UTC') AT TIME ZONE 'UTC',
+			country, device_type, browser, os, referrer, is_bot, sum(clicks)
+		FROM click_hourly_rollups
+		WHERE bucket_start >= ? AND bucket_start < ?
+		GROUP BY 1, 2, 3, 4, 5, 6, 7, 8
+		ON CONFLICT (link_id, bucket_start, country, device_type, browser, os, referrer, is_bot)
+		DO UPDATE SET clicks = EXCLUDED.clicks`, from.Truncate(24*time.Hour), to).Error
+}
+
+// prune deletes raw clicks that are past retention and already rolled up
+func (r *RollupService) prune() error {
+	if r.retention <= 0 {
+		return nil
+	}
+
+	progress, ok := RollupWatermark()
+	if !ok || progress.InsertedUntil.IsZero() {
+		return nil
+	}
+
+	cutoff := time.Now().Add(-r.retention)
+	if progress.ClickedUntil.Before(cutoff) {
+		cutoff = progress.ClickedUntil
+	}
+
+	result := database.DB.
+		Where("clicked_at < ? AND inserted_at < ?", cutoff, progress.InsertedUntil).
+		Delete(&models.Click{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		slog.Info("pruned old raw clicks", "clicks", result.RowsAffected, "older_than", cutoff.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// RollupWatermark returns how far raw clicks have been rolled up.
+// InsertedUntil is zero until the first run that tracks insert times.
+func RollupWatermark() (RollupProgress, bool) {
+	var states []models.RollupState
+	// One query, so both values come from the same snapshot
+	err := database.DB.Where("name IN ?", []string{clickRollupState, clickInsertedState}).Find(&states).Error
+	if err != nil {
+		slog.Error("failed to read rollup watermark", "error", err)
+		return RollupProgress{}, false
+	}
+
+	var progress RollupProgress
+	ok := false
+	for _, state := range states {
+		switch state.Name {
+		case clickRollupState:
+			progress.ClickedUntil = state.RolledUntil.UTC()
+			ok = true
+		case clickInsertedState:
+			progress.InsertedUntil = state.RolledUntil.UTC()
+		}
+	}
+	return progress, ok
+}
+
+// saveWatermark stores the rollup watermark
+func saveWatermark(tx *gorm.DB, until time.Time) error {
+	return saveState(tx, clickRollupState, until)
+}
+
+// saveState stores how far the background job name has processed data
+func saveState(tx *gorm.DB, name string, until time.Time) error {
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"rolled_until", "updated_at"}),
+	}).Create(&models.RollupState{
+		Name:        name,
+		RolledUntil: until,
+		UpdatedAt:   time.Now(),
+	}).Error
+}
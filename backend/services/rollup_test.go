@@ -0,0 +1,324 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/internal/testdb"
+	"link-shortener/models"
+)
+
+// rollupModels are the tables used by RollupService
+var rollupModels = []interface{}{
+	&models.Click{}, &models.ClickHourlyRollup{}, &models.ClickDailyRollup{}, &models.RollupState{},
+}
+
+// rollupClick returns a click stored at insertedAt
+func rollupClick(clickedAt, insertedAt time.Time) models.Click {
+	return models.Click{
+		LinkID:      1,
+		ClickedAt:   clickedAt,
+		InsertedAt:  insertedAt,
+		IPAddress:   "198.51.100.1",
+		UserAgent:   "Mozilla/5.0",
+		ReferrerURL: "https://example.com/page",
+		Referrer:    "example.com",
+		Country:     "Germany",
+	}
+}
+
+// setRollupProgress stores the rollup watermarks
+func setRollupProgress(t *testing.T, clickedUntil, insertedUntil time.Time) {
+	t.Helper()
+	if err := saveWatermark(database.DB, clickedUntil); err != nil {
+		t.Fatal(err)
+	}
+	if !insertedUntil.IsZero() {
+		if err := saveState(database.DB, clickInsertedState, insertedUntil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// rolledUpTotal counts clicks the way analytics read them: rolled-up hours
+// plus raw clicks the rollups do not include
+func rolledUpTotal(t *testing.T) int64 {
+	t.Helper()
+	progress, ok := RollupWatermark()
+	if !ok {
+		t.Fatal("no rollup watermark")
+	}
+	var hourly, raw int64
+	if err := database.DB.Model(&models.ClickHourlyRollup{}).
+		Where("bucket_start < ?", progress.ClickedUntil).
+		Select("COALESCE(sum(clicks), 0)").Scan(&hourly).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := database.DB.Model(&models.Click{}).
+		Where("clicked_at >= ? OR inserted_at >= ?", progress.ClickedUntil, progress.InsertedUntil).
+		Count(&raw).Error; err != nil {
+		t.Fatal(err)
+	}
+	return hourly + raw
+}
+
+// rollupSums returns the hourly rollups per bucket and the sum of the daily rollups
+func rollupSums(t *testing.T) (map[time.Time]int64, int64) {
+	t.Helper()
+	var rows []models.ClickHourlyRollup
+	if err := database.DB.Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	hourly := make(map[time.Time]int64)
+	for _, row := range rows {
+		hourly[row.BucketStart.UTC()] += row.Clicks
+	}
+	var daily int64
+	if err := database.DB.Model(&models.ClickDailyRollup{}).
+		Select("COALESCE(sum(clicks), 0)").Scan(&daily).Error; err != nil {
+		t.Fatal(err)
+	}
+	return hourly, daily
+}
+
+func TestRollupWatermark(t *testing.T) {
+	testdb.Open(t, &models.RollupState{})
+
+	if _, ok := RollupWatermark(); ok {
+		t.Fatal("watermark before the first run")
+	}
+
+	clickedUntil := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	setRollupProgress(t, clickedUntil, time.Time{})
+	progress, ok := RollupWatermark()
+	if !ok || !progress.ClickedUntil.Equal(clickedUntil) {
+		t.Fatalf("watermark = %v, %v", progress, ok)
+	}
+	if !progress.InsertedUntil.IsZero() {
+		t.Errorf("insert watermark = %v before insert times were tracked", progress.InsertedUntil)
+	}
+
+	insertedUntil := clickedUntil.Add(time.Hour)
+	setRollupProgress(t, clickedUntil, insertedUntil)
+	progress, _ = RollupWatermark()
+	if !progress.InsertedUntil.Equal(insertedUntil) {
+		t.Errorf("insert watermark = %v, want %v", progress.InsertedUntil, insertedUntil)
+	}
+}
+
+func TestRollupRunFirst(t *testing.T) {
+	testdb.Open(t, rollupModels...)
+
+	before := time.Now().UTC()
+	if err := NewRollupService(time.Hour, 0, 0).Run(); err != nil {
+		t.Fatal(err)
+	}
+	progress, ok := RollupWatermark()
+	if !ok {
+		t.Fatal("no watermark after the first run")
+	}
+	// Without clicks there is nothing to roll up before the current hour
+	if want := before.Add(-rollupLag).Truncate(time.Hour); progress.ClickedUntil.Before(want) {
+		t.Errorf("watermark = %v, want %v", progress.ClickedUntil, want)
+	}
+	if progress.InsertedUntil.Before(before.Add(-rollupLag)) || progress.InsertedUntil.After(time.Now()) {
+		t.Errorf("insert watermark = %v, want about %v", progress.InsertedUntil, before.Add(-rollupLag))
+	}
+}
+
+func TestRollupRunStartsInsertWatermark(t *testing.T) {
+	testdb.Open(t, rollupModels...)
+
+	// Rolled up before insert times were tracked. A watermark past the
+	// current hour leaves nothing to roll up.
+	clickedUntil := time.Now().UTC().Add(time.Hour).Truncate(time.Hour)
+	setRollupProgress(t, clickedUntil, time.Time{})
+
+	old := rollupClick(clickedUntil.Add(-3*time.Hour), time.Now().UTC())
+	if err := database.DB.Create(&old).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now().UTC()
+	if err := NewRollupService(time.Hour, 0, 0).Run(); err != nil {
+		t.Fatal(err)
+	}
+	progress, _ := RollupWatermark()
+	if !progress.ClickedUntil.Equal(clickedUntil) {
+		t.Errorf("watermark moved to %v", progress.ClickedUntil)
+	}
+	// Clicks stored so far count as rolled up, none as inserted late
+	if progress.InsertedUntil.Before(before) {
+		t.Errorf("insert watermark = %v, want at least %v", progress.InsertedUntil, before)
+	}
+	if total := rolledUpTotal(t); total != 0 {
+		t.Errorf("old click read from raw clicks again: total = %d", total)
+	}
+}
+
+func TestRollupScrub(t *testing.T) {
+	testdb.Open(t, rollupModels...)
+
+	now := time.Now().UTC()
+	lat := 52.5
+	old := rollupClick(now.Add(-48*time.Hour), now.Add(-48*time.Hour))
+	old.Latitude, old.Longitude = &lat, &lat
+	recent := rollupClick(now.Add(-time.Hour), now.Add(-time.Hour))
+	if err := database.DB.Create(&[]*models.Click{&old, &recent}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// A zero scrubAfter keeps personal data
+	if err := NewRollupService(time.Hour, 0, 0).scrub(); err != nil {
+		t.Fatal(err)
+	}
+	var got models.Click
+	database.DB.First(&got, old.ID)
+	if got.IPAddress == "" {
+		t.Fatal("scrubbed without scrubAfter")
+	}
+
+	if err := NewRollupService(time.Hour, 0, 24*time.Hour).scrub(); err != nil {
+		t.Fatal(err)
+	}
+	got = models.Click{}
+	database.DB.First(&got, old.ID)
+	if got.IPAddress != "" || got.UserAgent != "" || got.ReferrerURL != "" || got.Latitude != nil || got.Longitude != nil {
+		t.Errorf("old click not scrubbed: %+v", got)
+	}
+	// Aggregated fields stay
+	if got.Country != "Germany" || got.Referrer != "example.com" {
+		t.Errorf("old click lost aggregated fields: %+v", got)
+	}
+	got = models.Click{}
+	database.DB.First(&got, recent.ID)
+	if got.IPAddress == "" || got.UserAgent == "" || got.ReferrerURL == "" {
+		t.Errorf("recent click scrubbed: %+v", got)
+	}
+}
+
+func TestRollupPrune(t *testing.T) {
+	testdb.Open(t, rollupModels...)
+
+	now := time.Now().UTC()
+	clickedUntil := now.Add(-10 * 24 * time.Hour).Truncate(time.Hour)
+	insertedUntil := now.Add(-time.Hour)
+	clicks := map[string]models.Click{
+		"rolled up":        rollupClick(clickedUntil.Add(-time.Hour), clickedUntil.Add(-time.Hour)),
+		"inserted late":    rollupClick(clickedUntil.Add(-time.Hour), now.Add(-time.Minute)),
+		"not rolled up":    rollupClick(clickedUntil.Add(time.Hour), clickedUntil.Add(time.Hour)),
+		"within retention": rollupClick(now.Add(-time.Hour), now.Add(-time.Hour)),
+	}
+	ids := make(map[string]uint)
+	for name, click := range clicks {
+		if err := database.DB.Create(&click).Error; err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = click.ID
+	}
+
+	remaining := func() map[string]bool {
+		left := make(map[string]bool)
+		for name, id := range ids {
+			var count int64
+			database.DB.Model(&models.Click{}).Where("id = ?", id).Count(&count)
+			left[name] = count > 0
+		}
+		return left
+	}
+
+	// Without an insert watermark nothing is known to be rolled up
+	setRollupProgress(t, clickedUntil, time.Time{})
+	if err := NewRollupService(time.Hour, 24*time.Hour, 0).prune(); err != nil {
+		t.Fatal(err)
+	}
+	for name, left := range remaining() {
+		if !left {
+			t.Errorf("%s click pruned without an insert watermark", name)
+		}
+	}
+
+	setRollupProgress(t, clickedUntil, insertedUntil)
+	// A zero retention keeps raw clicks forever
+	if err := NewRollupService(time.Hour, 0, 0).prune(); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewRollupService(time.Hour, 24*time.Hour, 0).prune(); err != nil {
+		t.Fatal(err)
+	}
+	left := remaining()
+	want := map[string]bool{"rolled up": false, "inserted late": true, "not rolled up": true, "within retention": true}
+	for name, keep := range want {
+		if left[name] != keep {
+			t.Errorf("%s click kept = %v, want %v", name, left[name], keep)
+		}
+	}
+}
+
+// TestRollupRunLateClicks needs Postgres for date_trunc and AT TIME ZONE
+func TestRollupRunLateClicks(t *testing.T) {
+	testdb.OpenPostgres(t, rollupModels...)
+
+	now := time.Now().UTC()
+	hour := now.Add(-rollupLag).Truncate(time.Hour)
+	clickedUntil := hour.Add(-4 * time.Hour)
+	insertedUntil := now.Add(-time.Hour)
+	setRollupProgress(t, clickedUntil, insertedUntil)
+
+	// An hour rolled up before
+	rolled := models.ClickHourlyRollup{LinkID: 1, BucketStart: hour.Add(-5 * time.Hour), Country: "Germany", Referrer: "example.com", Clicks: 1}
+	if err := database.DB.Create(&rolled).Error; err != nil {
+		t.Fatal(err)
+	}
+	clicks := []models.Click{
+		// Inserted on time after the watermark
+		rollupClick(hour.Add(-3*time.Hour), hour.Add(-3*time.Hour)),
+		rollupClick(hour.Add(-3*time.Hour+time.Minute), hour.Add(-3*time.Hour+time.Minute)),
+		// Inserted after its hour was rolled up
+		rollupClick(hour.Add(-5*time.Hour+time.Minute), now.Add(-30*time.Minute)),
+		// Clicked in the current hour
+		rollupClick(hour.Add(time.Minute), hour.Add(time.Minute)),
+		// Still being inserted, within rollupLag
+		rollupClick(hour.Add(-time.Hour), now),
+	}
+	if err := database.DB.Create(&clicks).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if total := rolledUpTotal(t); total != 6 {
+		t.Fatalf("total before the run = %d, want 6", total)
+	}
+
+	service := NewRollupService(time.Hour, 0, 0)
+	for run := 1; run <= 2; run++ {
+		if err := service.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if total := rolledUpTotal(t); total != 6 {
+			t.Errorf("run %d: total = %d, want 6", run, total)
+		}
+
+		progress, _ := RollupWatermark()
+		if !progress.ClickedUntil.Equal(hour) {
+			t.Errorf("run %d: watermark = %v, want %v", run, progress.ClickedUntil, hour)
+		}
+		if !progress.InsertedUntil.After(now.Add(-rollupLag - time.Second)) {
+			t.Errorf("run %d: insert watermark = %v", run, progress.InsertedUntil)
+		}
+
+		hourly, daily := rollupSums(t)
+		want := map[time.Time]int64{hour.Add(-5 * time.Hour): 2, hour.Add(-3 * time.Hour): 2}
+		for bucket, clicks := range want {
+			if hourly[bucket] != clicks {
+				t.Errorf("run %d: hour %v has %d clicks, want %d", run, bucket, hourly[bucket], clicks)
+			}
+		}
+		if len(hourly) != len(want) {
+			t.Errorf("run %d: hourly rollups = %v", run, hourly)
+		}
+		if daily != 4 {
+			t.Errorf("run %d: daily rollups sum to %d, want 4", run, daily)
+		}
+	}
+}
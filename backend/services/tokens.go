@@ -0,0 +1,423 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// tokenPruneInterval is how often expired refresh tokens and denylist
+// entries are deleted
+const tokenPruneInterval = time.Hour
+
+// refreshReuseGrace is how long after a refresh its old token is refused
+// without revoking the session, so clients racing to refresh (e.g. several
+// browser tabs) are not signed out
+const refreshReuseGrace = 30 * time.Second
+
+// streamTicketTTL is how long a stream ticket can be redeemed
+const streamTicketTTL = 30 * time.Second
+
+// Errors returned by token operations
+var (
+	// ErrInvalidRefreshToken means the refresh token is unknown, expired,
+	// revoked or already used, or its user is disabled
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrUnknownKeyID means a token was signed with a key that is not
+	// configured (any more)
+	ErrUnknownKeyID = errors.New("unknown signing key")
+	// ErrInvalidStreamTicket means the stream ticket is unknown, expired or
+	// already used, or its access token or user is no longer valid
+	ErrInvalidStreamTicket = errors.New("invalid stream ticket")
+)
+
+// Claims represents JWT access token claims
+type Claims struct {
+	UserID   uint     `json:"uid"`
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"`
+	// SessionID links the token to the refresh tokens of its sign-in
+	SessionID string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// TokenPair is issued at login and on every refresh
+type TokenPair struct {
+	AccessToken      string
+	AccessExpiresAt  time.Time
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+// TokenService issues short-lived access tokens (JWTs) with rotating
+// refresh tokens stored server-side, and revokes them. Access tokens are
+// signed with the current key and carry its ID in the "kid" header;
+// previous keys are still accepted until they are removed from the
+// configuration, so secrets can be rotated without signing everyone out.
+type TokenService struct {
+	keyID      string
+	keys       map[string][]byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	maxAge     time.Duration
+}
+
+// NewTokenService creates a token service signing with secret under keyID.
+// previousKeys lists retired keys still accepted for verification as
+// comma-separated "kid=secret" pairs. Sessions end when they are not
+// refreshed within refreshTTL, and at the latest maxAge after sign-in.
+func NewTokenService(keyID, secret, previousKeys string, accessTTL, refreshTTL, maxAge time.Duration) (*TokenService, error) {
+	keys := map[string][]byte{keyID: []byte(secret)}
+	for _, pair := range strings.Split(previousKeys, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kid, key, ok := strings.Cut(pair, "=")
+		if !ok || kid == "" || key == "" {
+			return nil, errors.New("invalid previous JWT key, expected kid=secret")
+		}
+		if _, exists := keys[kid]; exists {
+			return nil, fmt.Errorf("duplicate JWT key ID %q", kid)
+		}
+		keys[kid] = []byte(key)
+	}
+
+	return &TokenService{
+		keyID:      keyID,
+		keys:       keys,
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+		maxAge:     maxAge,
+	}, nil
+}
+
+// Start prunes expired tokens in the background until ctx is cancelled
+func (s *TokenService) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(tokenPruneInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.Prune(); err != nil {
+				slog.Error("token pruning failed", "error", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Prune deletes expired refresh tokens, stream tickets and denylist
+// entries of expired access tokens
+func (s *TokenService) Prune() error {
+	now := time.Now()
+	if err := database.DB.Where("expires_at < ?", now).Delete(&models.RefreshToken{}).Error; err != nil {
+		return err
+	}
+	if err := database.DB.Where("expires_at < ?", now).Delete(&models.StreamTicket{}).Error; err != nil {
+		return err
+	}
+	return database.DB.Where("expires_at < ?", now).Delete(&models.RevokedToken{}).Error
+}
+
+// ParseAccessToken validates an access token's signature and expiry and
+// returns its claims. It does not check the denylist; see IsTokenRevoked.
+func (s *TokenService) ParseAccessToken(tokenString string) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := s.keys[kid]
+		if !ok {
+			return nil, ErrUnknownKeyID
+		}
+		return key, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}))
+	if err != nil || !token.Valid {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+
+	claims, ok := token.Claims.(*Claims)
+	if !ok || claims.UserID == 0 || claims.ID == "" {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	return claims, nil
+}
+
+// IsTokenRevoked reports whether an access token is on the denylist
+func IsTokenRevoked(jti string) (bool, error) {
+	var count int64
+	err := database.DB.Model(&models.RevokedToken{}).Where("jti = ?", jti).Count(&count).Error
+	return count > 0, err
+}
+
+// IssueTokens starts a new session for user and returns its first tokens
+func (s *TokenService) IssueTokens(user *models.User, ip, userAgent string) (*TokenPair, error) {
+	sessionID, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	return s.issue(database.DB, user, sessionID, time.Now(), ip, userAgent)
+}
+
+// Refresh exchanges a refresh token for new tokens of the same session.
+// Each refresh token works once; presenting a used one again after
+// refreshReuseGrace means it was stolen, so the whole session is revoked.
+func (s *TokenService) Refresh(refreshToken, ip, userAgent string) (*models.User, *TokenPair, error) {
+	var stored models.RefreshToken
+	err := database.DB.Where("token_hash = ?", hashRefreshToken(refreshToken)).Take(&stored).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if stored.UsedAt != nil && stored.RevokedAt == nil && now.Sub(*stored.UsedAt) > refreshReuseGrace {
+		slog.Warn("refresh token reused, revoking session", "user_id", stored.UserID, "session_id", stored.SessionID, "ip", ip)
+		if err := revokeTokens(database.DB, "user_id = ? AND session_id = ?", stored.UserID, stored.SessionID); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrInvalidRefreshToken
+	}
+	if stored.UsedAt != nil || stored.RevokedAt != nil || !stored.ExpiresAt.After(now) {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+
+	user, err := ActiveUser(stored.UserID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var pair *TokenPair
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		// The condition makes concurrent refreshes with the same token fail
+		result := tx.Model(&stored).
+			Where("used_at IS NULL AND revoked_at IS NULL").
+			UpdateColumn("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidRefreshToken
+		}
+		pair, err = s.issue(tx, user, stored.SessionID, stored.SessionStartedAt, ip, userAgent)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, pair, nil
+}
+
+// IssueStreamTicket returns a single-use ticket that opens a live click
+// stream as userID within streamTicketTTL. sessionID and accessJTI
+// identify the sign-in and access token the ticket is issued for.
+func (s *TokenService) IssueStreamTicket(userID uint, sessionID, accessJTI string) (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	ticket := base64.RawURLEncoding.EncodeToString(b)
+
+	expiresAt := time.Now().Add(streamTicketTTL)
+	err := database.DB.Create(&models.StreamTicket{
+		UserID:     userID,
+		TicketHash: hashRefreshToken(ticket),
+		SessionID:  sessionID,
+		AccessJTI:  accessJTI,
+		ExpiresAt:  expiresAt,
+	}).Error
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return ticket, expiresAt, nil
+}
+
+// RedeemStreamTicket uses up a stream ticket and returns it with its user
+func (s *TokenService) RedeemStreamTicket(ticket string) (*models.User, *models.StreamTicket, error) {
+	var stored models.StreamTicket
+	err := database.DB.Where("ticket_hash = ?", hashRefreshToken(ticket)).Take(&stored).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrInvalidStreamTicket
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Deleting the ticket makes concurrent redemptions of it fail
+	result := database.DB.Delete(&models.StreamTicket{}, stored.ID)
+	if result.Error != nil {
+		return nil, nil, result.Error
+	}
+	if result.RowsAffected == 0 || !stored.ExpiresAt.After(time.Now()) {
+		return nil, nil, ErrInvalidStreamTicket
+	}
+
+	active, err := SessionActive(stored.UserID, stored.SessionID, stored.AccessJTI)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !active {
+		return nil, nil, ErrInvalidStreamTicket
+	}
+	user, err := ActiveUser(stored.UserID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrInvalidStreamTicket
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, &stored, nil
+}
+
+// SessionActive reports whether a sign-in session has not been revoked or
+// expired and its access token accessJTI is not on the denylist
+func SessionActive(userID uint, sessionID, accessJTI string) (bool, error) {
+	revoked, err := IsTokenRevoked(accessJTI)
+	if err != nil || revoked {
+		return false, err
+	}
+
+	var count int64
+	err = database.DB.Model(&models.RefreshToken{}).
+		Where("user_id = ? AND session_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, sessionID, time.Now()).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// RevokeSession revokes the refresh tokens of one session and denylists
+// its access tokens
+func (s *TokenService) RevokeSession(userID uint, sessionID string) error {
+	return revokeTokens(database.DB, "user_id = ? AND session_id = ?", userID, sessionID)
+}
+
+// RevokeAllSessions revokes every session of a user
+func (s *TokenService) RevokeAllSessions(userID uint) error {
+	return revokeTokens(database.DB, "user_id = ?", userID)
+}
+
+// RevokeOtherSessions revokes every session of a user except keepSessionID
+// (all of them when it is empty), e.g. after its credentials changed. tx
+// lets the revocation commit together with the change.
+func (s *TokenService) RevokeOtherSessions(tx *gorm.DB, userID uint, keepSessionID string) error {
+	return revokeTokens(tx, "user_id = ? AND session_id <> ?", userID, keepSessionID)
+}
+
+// issue signs an access token and stores a new refresh token for a session
+// that started at sessionStart
+func (s *TokenService) issue(tx *gorm.DB, user *models.User, sessionID string, sessionStart time.Time, ip, userAgent string) (*TokenPair, error) {
+	now := time.Now()
+	jti, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := Claims{
+		UserID:    user.ID,
+		Username:  user.Username,
+		Roles:     user.RoleList(),
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.accessTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			Issuer:    "kintercut",
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = s.keyID
+	accessToken, err := token.SignedString(s.keys[s.keyID])
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(b)
+
+	// Refreshing extends a session by refreshTTL, but not beyond maxAge
+	expiresAt := now.Add(s.refreshTTL)
+	if limit := sessionStart.Add(s.maxAge); expiresAt.After(limit) {
+		expiresAt = limit
+	}
+
+	stored := models.RefreshToken{
+		UserID:           user.ID,
+		SessionID:        sessionID,
+		SessionStartedAt: sessionStart,
+		TokenHash:        hashRefreshToken(refreshToken),
+		AccessJTI:        jti,
+		AccessExpiresAt:  claims.ExpiresAt.Time,
+		ExpiresAt:        expiresAt,
+		IPAddress:        ip,
+		UserAgent:        userAgent,
+	}
+	if err := tx.Create(&stored).Error; err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:      accessToken,
+		AccessExpiresAt:  stored.AccessExpiresAt,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: stored.ExpiresAt,
+	}, nil
+}
+
+// revokeTokens revokes the refresh tokens matching the condition and
+// denylists the access tokens issued with them that have not expired yet
+func revokeTokens(db *gorm.DB, query string, args ...interface{}) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		var live []models.RefreshToken
+		if err := tx.Where(query, args...).Where("access_expires_at > ?", now).Find(&live).Error; err != nil {
+			return err
+		}
+		if len(live) > 0 {
+			revoked := make([]models.RevokedToken, len(live))
+			for i, token := range live {
+				revoked[i] = models.RevokedToken{JTI: token.AccessJTI, ExpiresAt: token.AccessExpiresAt}
+			}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&revoked).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&models.RefreshToken{}).
+			Where(query, args...).
+			Where("revoked_at IS NULL").
+			UpdateColumn("revoked_at", now).Error
+	})
+}
+
+// hashRefreshToken hashes a refresh token or stream ticket for storage and
+// lookup
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
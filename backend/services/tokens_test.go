@@ -0,0 +1,265 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/internal/testdb"
+	"link-shortener/models"
+)
+
+// newTokenTest opens a test database with a user and returns a token
+// service signing under kid "current"
+func newTokenTest(t *testing.T) (*TokenService, *models.User) {
+	t.Helper()
+	testdb.Open(t, &models.User{}, &models.RefreshToken{}, &models.RevokedToken{}, &models.StreamTicket{})
+
+	user := &models.User{Username: "alice", PasswordHash: "unused", Roles: models.RoleViewer, Active: true}
+	if err := database.DB.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := NewTokenService("current", "current-secret", "", time.Minute, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens, user
+}
+
+func TestRefreshRotation(t *testing.T) {
+	tokens, user := newTokenTest(t)
+
+	first, err := tokens.IssueTokens(user, "192.0.2.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second, err := tokens.Refresh(first.RefreshToken, "192.0.2.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.RefreshToken == first.RefreshToken || second.AccessToken == first.AccessToken {
+		t.Fatal("refresh did not rotate the tokens")
+	}
+
+	firstClaims, err := tokens.ParseAccessToken(first.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondClaims, err := tokens.ParseAccessToken(second.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secondClaims.SessionID != firstClaims.SessionID {
+		t.Error("refresh started a new session")
+	}
+
+	// The new refresh token works once in turn
+	if _, _, err := tokens.Refresh(second.RefreshToken, "192.0.2.1", "test"); err != nil {
+		t.Errorf("refreshing with the rotated token: %v", err)
+	}
+}
+
+func TestRefreshReuse(t *testing.T) {
+	tests := []struct {
+		name        string
+		usedAgo     time.Duration
+		wantRevoked bool
+	}{
+		{"within grace", time.Second, false},
+		{"after grace", refreshReuseGrace + time.Second, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, user := newTokenTest(t)
+
+			first, err := tokens.IssueTokens(user, "192.0.2.1", "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, second, err := tokens.Refresh(first.RefreshToken, "192.0.2.1", "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = database.DB.Model(&models.RefreshToken{}).
+				Where("token_hash = ?", hashRefreshToken(first.RefreshToken)).
+				UpdateColumn("used_at", time.Now().Add(-tt.usedAgo)).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, err := tokens.Refresh(first.RefreshToken, "192.0.2.1", "test"); !errors.Is(err, ErrInvalidRefreshToken) {
+				t.Fatalf("reused refresh token: err = %v, want ErrInvalidRefreshToken", err)
+			}
+
+			claims, err := tokens.ParseAccessToken(second.AccessToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			revoked, err := IsTokenRevoked(claims.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if revoked != tt.wantRevoked {
+				t.Errorf("current access token revoked = %v, want %v", revoked, tt.wantRevoked)
+			}
+			_, _, err = tokens.Refresh(second.RefreshToken, "192.0.2.1", "test")
+			if tt.wantRevoked && !errors.Is(err, ErrInvalidRefreshToken) {
+				t.Errorf("current refresh token after session revocation: err = %v", err)
+			}
+			if !tt.wantRevoked && err != nil {
+				t.Errorf("current refresh token: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseAccessTokenKeyRotation(t *testing.T) {
+	testdb.Open(t, &models.User{}, &models.RefreshToken{})
+	user := &models.User{Username: "alice", PasswordHash: "unused", Roles: models.RoleViewer, Active: true}
+	if err := database.DB.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	newService := func(keyID, secret, previous string) *TokenService {
+		t.Helper()
+		s, err := NewTokenService(keyID, secret, previous, time.Minute, time.Hour, 24*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	issue := func(s *TokenService) string {
+		t.Helper()
+		pair, err := s.IssueTokens(user, "192.0.2.1", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pair.AccessToken
+	}
+
+	rotated := newService("2024-02", "new-secret", "2024-01=old-secret")
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"current key", issue(rotated), false},
+		{"previous key", issue(newService("2024-01", "old-secret", "")), false},
+		{"unknown key ID", issue(newService("2023-12", "old-secret", "")), true},
+		{"known key ID with wrong secret", issue(newService("2024-01", "forged-secret", "")), true},
+		{"garbage", "not.a.token", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := rotated.ParseAccessToken(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && claims.UserID != user.ID {
+				t.Errorf("UserID = %d, want %d", claims.UserID, user.ID)
+			}
+		})
+	}
+
+	if _, err := NewTokenService("current", "secret", "current=other", time.Minute, time.Hour, time.Hour); err == nil {
+		t.Error("duplicate key ID accepted")
+	}
+	if _, err := NewTokenService("current", "secret", "missing-secret", time.Minute, time.Hour, time.Hour); err == nil {
+		t.Error("previous key without secret accepted")
+	}
+}
+
+func TestRevokeSessionDenylist(t *testing.T) {
+	tokens, user := newTokenTest(t)
+
+	revokedPair, err := tokens.IssueTokens(user, "192.0.2.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keptPair, err := tokens.IssueTokens(user, "192.0.2.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedClaims, err := tokens.ParseAccessToken(revokedPair.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keptClaims, err := tokens.ParseAccessToken(keptPair.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tokens.RevokeSession(user.ID, revokedClaims.SessionID); err != nil {
+		t.Fatal(err)
+	}
+
+	if revoked, err := IsTokenRevoked(revokedClaims.ID); err != nil || !revoked {
+		t.Errorf("revoked session's access token: revoked = %v, err = %v", revoked, err)
+	}
+	if revoked, err := IsTokenRevoked(keptClaims.ID); err != nil || revoked {
+		t.Errorf("other session's access token: revoked = %v, err = %v", revoked, err)
+	}
+	if _, _, err := tokens.Refresh(revokedPair.RefreshToken, "192.0.2.1", "test"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("revoked session's refresh token: err = %v", err)
+	}
+	if active, err := SessionActive(user.ID, revokedClaims.SessionID, revokedClaims.ID); err != nil || active {
+		t.Errorf("revoked session active = %v, err = %v", active, err)
+	}
+	if active, err := SessionActive(user.ID, keptClaims.SessionID, keptClaims.ID); err != nil || !active {
+		t.Errorf("other session active = %v, err = %v", active, err)
+	}
+}
+
+func TestRedeemStreamTicket(t *testing.T) {
+	tokens, user := newTokenTest(t)
+
+	pair, err := tokens.IssueTokens(user, "192.0.2.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := tokens.ParseAccessToken(pair.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func() string {
+		t.Helper()
+		ticket, _, err := tokens.IssueStreamTicket(user.ID, claims.SessionID, claims.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ticket
+	}
+
+	ticket := issue()
+	redeemed, stored, err := tokens.RedeemStreamTicket(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redeemed.ID != user.ID || stored.SessionID != claims.SessionID {
+		t.Errorf("redeemed user %d, session %q", redeemed.ID, stored.SessionID)
+	}
+	if _, _, err := tokens.RedeemStreamTicket(ticket); !errors.Is(err, ErrInvalidStreamTicket) {
+		t.Errorf("second redemption: err = %v, want ErrInvalidStreamTicket", err)
+	}
+
+	if _, _, err := tokens.RedeemStreamTicket("unknown"); !errors.Is(err, ErrInvalidStreamTicket) {
+		t.Errorf("unknown ticket: err = %v", err)
+	}
+
+	expired := issue()
+	database.DB.Model(&models.StreamTicket{}).Where("1 = 1").UpdateColumn("expires_at", time.Now().Add(-time.Second))
+	if _, _, err := tokens.RedeemStreamTicket(expired); !errors.Is(err, ErrInvalidStreamTicket) {
+		t.Errorf("expired ticket: err = %v", err)
+	}
+
+	revoked := issue()
+	if err := tokens.RevokeSession(user.ID, claims.SessionID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tokens.RedeemStreamTicket(revoked); !errors.Is(err, ErrInvalidStreamTicket) {
+		t.Errorf("ticket of a revoked session: err = %v", err)
+	}
+}
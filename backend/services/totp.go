@@ -0,0 +1,339 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/models"
+
+	"gorm.io/gorm"
+)
+
+// RFC 6238 parameters understood by all common authenticator apps
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpModulo = 1000000 // 10^totpDigits
+	// totpSkew is the number of time steps accepted before and after the
+	// current one, to allow for clock drift
+	totpSkew = 1
+)
+
+// RecoveryCodeCount is the number of recovery codes generated at once
+const RecoveryCodeCount = 10
+
+// totpEncoding is unpadded base32, as expected in provisioning URIs
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new random 160-bit secret in base32
+func GenerateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPURI returns the otpauth:// provisioning URI authenticator apps scan
+func TOTPURI(issuer, account, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// TOTPCode returns the code of secret for the given time step
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation (RFC 4226 section 5.3)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulo), nil
+}
+
+// TOTPStep returns the time step of t
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// MatchTOTP returns the time step whose code equals code, within the
+// allowed clock skew around now, or false if none does
+func MatchTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := TOTPStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := TOTPCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// UseTOTP checks a code against the user's secret and marks its time step
+// as used, so each code is accepted only once
+func UseTOTP(user *models.User, code string) (bool, error) {
+	secret, err := decryptTOTPSecret(user.TOTPSecret)
+	if err != nil {
+		return false, err
+	}
+	step, ok := MatchTOTP(secret, code, time.Now())
+	if !ok || step <= user.TOTPLastStep {
+		return false, nil
+	}
+
+	// The condition makes concurrent use of the same code fail
+	result := database.DB.Model(&models.User{}).
+		Where("id = ? AND totp_last_step < ?", user.ID, step).
+		UpdateColumn("totp_last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	user.TOTPLastStep = step
+	return result.RowsAffected == 1, nil
+}
+
+// UseTwoFactorCode accepts either a TOTP code or an unused recovery code
+func UseTwoFactorCode(user *models.User, code string) (bool, error) {
+	if ok, err := UseTOTP(user, code); ok || err != nil {
+		return ok, err
+	}
+	return UseRecoveryCode(user.ID, code)
+}
+
+// normalizeRecoveryCode strips separators and case from a recovery code
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// keyedRecoveryPrefix marks recovery code hashes keyed with the server
+// secret. Older hashes are plain SHA-256 in hex.
+const keyedRecoveryPrefix = "k1:"
+
+// encryptedTOTPPrefix marks TOTP secrets encrypted with the server secret.
+// Older secrets are stored in plain base32.
+const encryptedTOTPPrefix = "e1:"
+
+// Keys derived from the server secret by InitTwoFactorSecrets: recovery
+// codes are hashed with recoveryCodeKey and TOTP secrets encrypted with
+// totpSecretKey
+var (
+	recoveryCodeKey []byte
+	totpSecretKey   []byte
+)
+
+// InitTwoFactorSecrets derives the recovery code hash key and the TOTP
+// secret encryption key from secret, rekeys recovery code hashes stored
+// before they were keyed and encrypts TOTP secrets stored in plain text.
+// Without the secret, a leaked table of 50-bit codes could be brute-forced
+// offline, and leaked TOTP secrets would generate valid codes.
+func InitTwoFactorSecrets(secret string) error {
+	if secret == "" {
+		return errors.New("a secret is required to protect two-factor secrets")
+	}
+	recoveryCodeKey = deriveKey(secret, "kintercut-recovery-codes")
+	totpSecretKey = deriveKey(secret, "kintercut-totp-secrets")
+
+	var legacy []models.RecoveryCode
+	err := database.DB.Where("code_hash NOT LIKE ?", keyedRecoveryPrefix+"%").Find(&legacy).Error
+	if err != nil {
+		return err
+	}
+	for _, code := range legacy {
+		err := database.DB.Model(&code).UpdateColumn("code_hash", keyRecoveryHash(code.CodeHash)).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	var users []models.User
+	err = database.DB.Select("id", "totp_secret").
+		Where("totp_secret <> '' AND totp_secret NOT LIKE ?", encryptedTOTPPrefix+"%").
+		Find(&users).Error
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := SaveTOTPSecret(database.DB, user.ID, user.TOTPSecret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deriveKey derives a 256-bit key for purpose from the server secret
+func deriveKey(secret, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// SaveTOTPSecret stores the user's TOTP secret encrypted with the server
+// secret
+func SaveTOTPSecret(tx *gorm.DB, userID uint, secret string) error {
+	encrypted, err := EncryptTOTPSecret(secret)
+	if err != nil {
+		return err
+	}
+	return tx.Model(&models.User{}).Where("id = ?", userID).UpdateColumn("totp_secret", encrypted).Error
+}
+
+// EncryptTOTPSecret encrypts a TOTP secret for storage with AES-GCM
+func EncryptTOTPSecret(secret string) (string, error) {
+	aead, err := totpSecretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), nil)
+	return encryptedTOTPPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decryptTOTPSecret returns the TOTP secret of a stored value
+func decryptTOTPSecret(stored string) (string, error) {
+	encoded, ok := strings.CutPrefix(stored, encryptedTOTPPrefix)
+	if !ok {
+		return "", errors.New("TOTP secret is not encrypted")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	aead, err := totpSecretCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("TOTP secret is too short")
+	}
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypting TOTP secret: %w", err)
+	}
+	return string(secret), nil
+}
+
+// totpSecretCipher returns the AEAD keyed with totpSecretKey
+func totpSecretCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(totpSecretKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// hashRecoveryCode hashes a normalized recovery code for storage
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return keyRecoveryHash(hex.EncodeToString(sum[:]))
+}
+
+// keyRecoveryHash keys the SHA-256 hex digest of a recovery code with the
+// server secret, so stored plain digests can be upgraded in place
+func keyRecoveryHash(digest string) string {
+	mac := hmac.New(sha256.New, recoveryCodeKey)
+	mac.Write([]byte(digest))
+	return keyedRecoveryPrefix + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// UseRecoveryCode marks a matching unused recovery code of the user as used
+func UseRecoveryCode(userID uint, code string) (bool, error) {
+	if len(normalizeRecoveryCode(code)) != 10 {
+		return false, nil
+	}
+	result := database.DB.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashRecoveryCode(code)).
+		UpdateColumn("used_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// ReplaceRecoveryCodes generates a new set of recovery codes for the user,
+// invalidating the previous ones. The codes are returned in the form
+// "xxxxx-xxxxx" and cannot be retrieved again.
+func ReplaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	rows := make([]models.RecoveryCode, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		// 10 base32 characters carry 50 random bits
+		code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		rows[i] = models.RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(code)}
+	}
+
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Create(&rows).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RemainingRecoveryCodes counts the user's unused recovery codes
+func RemainingRecoveryCodes(userID uint) (int64, error) {
+	var count int64
+	err := database.DB.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND used_at IS NULL", userID).
+		Count(&count).Error
+	return count, err
+}
+
+// DisableTwoFactor turns off the user's two-factor authentication and
+// deletes its recovery codes
+func DisableTwoFactor(tx *gorm.DB, userID uint) error {
+	err := tx.Model(&models.User{}).Where("id = ?", userID).UpdateColumns(map[string]interface{}{
+		"totp_secret":    "",
+		"totp_enabled":   false,
+		"totp_last_step": 0,
+	}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+}
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/internal/testdb"
+	"link-shortener/models"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B test vectors for SHA-1, truncated to six digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		got, err := TOTPCode(secret, TOTPStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("TOTPCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	if _, ok := MatchTOTP(secret, "081804", now.Add(totpPeriod*time.Second)); !ok {
+		t.Error("code of the previous step was refused")
+	}
+	if _, ok := MatchTOTP(secret, "081804", now.Add(3*totpPeriod*time.Second)); ok {
+		t.Error("code outside the allowed skew was accepted")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	testdb.Open(t, &models.User{}, &models.RecoveryCode{})
+	if err := InitTwoFactorSecrets("test-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	codes, err := ReplaceRecoveryCodes(database.DB, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), RecoveryCodeCount)
+	}
+
+	// Stored hashes are keyed, not plain digests of the code
+	var stored []models.RecoveryCode
+	database.DB.Find(&stored)
+	plain := sha256.Sum256([]byte(normalizeRecoveryCode(codes[0])))
+	for _, code := range stored {
+		if !strings.HasPrefix(code.CodeHash, keyedRecoveryPrefix) || code.CodeHash == hex.EncodeToString(plain[:]) {
+			t.Fatalf("stored hash %q is not keyed", code.CodeHash)
+		}
+	}
+
+	// Codes are accepted once, regardless of case and separators
+	if ok, err := UseRecoveryCode(1, strings.ToUpper(strings.ReplaceAll(codes[0], "-", " "))); err != nil || !ok {
+		t.Fatalf("UseRecoveryCode() = %v, %v; want true", ok, err)
+	}
+	if ok, _ := UseRecoveryCode(1, codes[0]); ok {
+		t.Error("recovery code was accepted twice")
+	}
+	if ok, _ := UseRecoveryCode(2, codes[1]); ok {
+		t.Error("recovery code of another user was accepted")
+	}
+	if remaining, _ := RemainingRecoveryCodes(1); remaining != RecoveryCodeCount-1 {
+		t.Errorf("remaining codes = %d, want %d", remaining, RecoveryCodeCount-1)
+	}
+
+	// Another server secret does not match the stored hashes
+	if err := InitTwoFactorSecrets("other-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := UseRecoveryCode(1, codes[1]); ok {
+		t.Error("recovery code was accepted under another secret")
+	}
+}
+
+func TestInitTwoFactorSecretsUpgradesLegacyHashes(t *testing.T) {
+	testdb.Open(t, &models.User{}, &models.RecoveryCode{})
+
+	// Stored as a plain SHA-256 digest before hashes were keyed
+	legacy := sha256.Sum256([]byte("abcdefghij"))
+	if err := database.DB.Create(&models.RecoveryCode{UserID: 1, CodeHash: hex.EncodeToString(legacy[:])}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InitTwoFactorSecrets("test-secret"); err != nil {
+		t.Fatal(err)
+	}
+	// Upgrading twice must not rekey keyed hashes
+	if err := InitTwoFactorSecrets("test-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored models.RecoveryCode
+	database.DB.Take(&stored)
+	if !strings.HasPrefix(stored.CodeHash, keyedRecoveryPrefix) {
+		t.Fatalf("legacy hash was not upgraded: %q", stored.CodeHash)
+	}
+	if ok, err := UseRecoveryCode(1, "abcde-fghij"); err != nil || !ok {
+		t.Errorf("UseRecoveryCode() = %v, %v; want true for an upgraded code", ok, err)
+	}
+}
+
+func TestInitTwoFactorSecretsRequiresSecret(t *testing.T) {
+	if err := InitTwoFactorSecrets(""); err == nil {
+		t.Error("InitTwoFactorSecrets accepted an empty secret")
+	}
+}
+
+func TestTOTPSecretEncryption(t *testing.T) {
+	testdb.Open(t, &models.User{}, &models.RecoveryCode{})
+
+	// Stored in plain text before secrets were encrypted
+	plain, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := models.User{Username: "alice", PasswordHash: "unused", TOTPSecret: plain, TOTPEnabled: true}
+	if err := database.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InitTwoFactorSecrets("test-secret"); err != nil {
+		t.Fatal(err)
+	}
+	// Upgrading twice must not encrypt encrypted secrets again
+	if err := InitTwoFactorSecrets("test-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored models.User
+	database.DB.Take(&stored, user.ID)
+	if !strings.HasPrefix(stored.TOTPSecret, encryptedTOTPPrefix) || strings.Contains(stored.TOTPSecret, plain) {
+		t.Fatalf("secret was not encrypted: %q", stored.TOTPSecret)
+	}
+	if got, err := decryptTOTPSecret(stored.TOTPSecret); err != nil || got != plain {
+		t.Fatalf("decryptTOTPSecret() = %q, %v; want %q", got, err, plain)
+	}
+
+	code, err := TOTPCode(plain, TOTPStep(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := UseTOTP(&stored, code); err != nil || !ok {
+		t.Errorf("UseTOTP() = %v, %v; want true", ok, err)
+	}
+
+	// Another server secret cannot decrypt it
+	if err := InitTwoFactorSecrets("other-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptTOTPSecret(stored.TOTPSecret); err == nil {
+		t.Error("secret was decrypted under another secret")
+	}
+}
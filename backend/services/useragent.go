@@ -0,0 +1,132 @@
+package services
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Device types stored on clicks
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceTV      = "tv"
+	DeviceConsole = "console"
+	DeviceBot     = "bot"
+	DeviceUnknown = "unknown"
+)
+
+// UserAgentInfo represents the parsed parts of a User-Agent string
+type UserAgentInfo struct {
+	Browser        string `json:"browser"`
+	BrowserVersion string `json:"browser_version"`
+	OS             string `json:"os"`
+	OSVersion      string `json:"os_version"`
+	DeviceType     string `json:"device_type"`
+}
+
+// uaRule maps a regex with a version capture group to a family name
+type uaRule struct {
+	family  string
+	pattern *regexp.Regexp
+}
+
+// browserRules are checked in order, most specific first
+// (e.g. Edge and Opera also advertise Chrome and Safari)
+var browserRules = []uaRule{
+	{"Edge", regexp.MustCompile(`(?:Edg|Edge|EdgA|EdgiOS)/([\d.]+)`)},
+	{"Opera", regexp.MustCompile(`(?:OPR|Opera)[/ ]([\d.]+)`)},
+	{"Samsung Internet", regexp.MustCompile(`SamsungBrowser/([\d.]+)`)},
+	{"Yandex Browser", regexp.MustCompile(`YaBrowser/([\d.]+)`)},
+	{"Vivaldi", regexp.MustCompile(`Vivaldi/([\d.]+)`)},
+	{"UC Browser", regexp.MustCompile(`UCBrowser/([\d.]+)`)},
+	{"Facebook App", regexp.MustCompile(`FB(?:AV|_IAB)/([\d.]+)`)},
+	{"Instagram App", regexp.MustCompile(`Instagram ([\d.]+)`)},
+	{"Chrome", regexp.MustCompile(`CriOS/([\d.]+)`)},
+	{"Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/([\d.]+)`)},
+	{"Chromium", regexp.MustCompile(`Chromium/([\d.]+)`)},
+	{"Chrome", regexp.MustCompile(`Chrome/([\d.]+)`)},
+	{"Safari", regexp.MustCompile(`Version/([\d.]+).*Safari/`)},
+	{"Internet Explorer", regexp.MustCompile(`(?:MSIE |Trident/.*rv:)([\d.]+)`)},
+}
+
+// osRules are checked in order; the capture group holds the version
+var osRules = []uaRule{
+	{"Windows Phone", regexp.MustCompile(`Windows Phone(?: OS)? ([\d.]+)`)},
+	{"Windows", regexp.MustCompile(`Windows NT ([\d.]+)`)},
+	{"iOS", regexp.MustCompile(`(?:iPhone|iPad|iPod).*? OS ([\d_]+)`)},
+	{"Android", regexp.MustCompile(`Android[ /]?([\d.]*)`)},
+	{"Chrome OS", regexp.MustCompile(`CrOS \S+ ([\d.]+)`)},
+	{"macOS", regexp.MustCompile(`Mac OS X ?([\d_.]*)`)},
+	{"Linux", regexp.MustCompile(`Linux()`)},
+}
+
+// windowsVersions maps Windows NT kernel versions to marketing names
+var windowsVersions = map[string]string{
+	"10.0": "10",
+	"6.3":  "8.1",
+	"6.2":  "8",
+	"6.1":  "7",
+	"6.0":  "Vista",
+	"5.1":  "XP",
+}
+
+// ParseUserAgent extracts browser, OS and device type from a User-Agent
+// string using local pattern tables only
+func ParseUserAgent(userAgent string) UserAgentInfo {
+	info := UserAgentInfo{
+		Browser:    "Other",
+		OS:         "Other",
+		DeviceType: DeviceUnknown,
+	}
+	if strings.TrimSpace(userAgent) == "" {
+		return info
+	}
+
+	for _, rule := range browserRules {
+		if m := rule.pattern.FindStringSubmatch(userAgent); m != nil {
+			info.Browser = rule.family
+			info.BrowserVersion = m[1]
+			break
+		}
+	}
+
+	for _, rule := range osRules {
+		if m := rule.pattern.FindStringSubmatch(userAgent); m != nil {
+			info.OS = rule.family
+			info.OSVersion = strings.ReplaceAll(m[1], "_", ".")
+			break
+		}
+	}
+	if info.OS == "Windows" {
+		if name, ok := windowsVersions[info.OSVersion]; ok {
+			info.OSVersion = name
+		}
+	}
+
+	info.DeviceType = detectDeviceType(userAgent, info.OS)
+	return info
+}
+
+// detectDeviceType guesses the device class from User-Agent tokens
+func detectDeviceType(userAgent, os string) string {
+	ua := strings.ToLower(userAgent)
+
+	switch {
+	case strings.Contains(ua, "playstation"), strings.Contains(ua, "xbox"), strings.Contains(ua, "nintendo"):
+		return DeviceConsole
+	case strings.Contains(ua, "smart-tv"), strings.Contains(ua, "smarttv"), strings.Contains(ua, "googletv"),
+		strings.Contains(ua, "appletv"), strings.Contains(ua, "hbbtv"), strings.Contains(ua, "web0s"),
+		strings.Contains(ua, "tizen") && strings.Contains(ua, "tv"):
+		return DeviceTV
+	case strings.Contains(ua, "ipad"), strings.Contains(ua, "tablet"), strings.Contains(ua, "kindle"),
+		strings.Contains(ua, "silk/"), os == "Android" && !strings.Contains(ua, "mobile"):
+		return DeviceTablet
+	case strings.Contains(ua, "mobile"), strings.Contains(ua, "iphone"), strings.Contains(ua, "ipod"),
+		os == "Android", os == "Windows Phone":
+		return DeviceMobile
+	case os == "Windows", os == "macOS", os == "Linux", os == "Chrome OS":
+		return DeviceDesktop
+	}
+	return DeviceUnknown
+}
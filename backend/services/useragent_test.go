@@ -0,0 +1,126 @@
+package services
+
+import "testing"
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		name string
+		ua   string
+		want UserAgentInfo
+	}{
+		{
+			"chrome on windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+			UserAgentInfo{"Chrome", "126.0.0.0", "Windows", "10", DeviceDesktop},
+		},
+		{
+			"firefox on windows 8.1",
+			"Mozilla/5.0 (Windows NT 6.3; Win64; x64; rv:109.0) Gecko/20100101 Firefox/115.0",
+			UserAgentInfo{"Firefox", "115.0", "Windows", "8.1", DeviceDesktop},
+		},
+		{
+			"firefox on macos",
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:127.0) Gecko/20100101 Firefox/127.0",
+			UserAgentInfo{"Firefox", "127.0", "macOS", "10.15", DeviceDesktop},
+		},
+		{
+			"safari on macos",
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Safari/605.1.15",
+			UserAgentInfo{"Safari", "17.5", "macOS", "10.15.7", DeviceDesktop},
+		},
+		{
+			"firefox on linux",
+			"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:126.0) Gecko/20100101 Firefox/126.0",
+			UserAgentInfo{"Firefox", "126.0", "Linux", "", DeviceDesktop},
+		},
+		{
+			"chrome on chrome os",
+			"Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+			UserAgentInfo{"Chrome", "126.0.0.0", "Chrome OS", "14541.0.0", DeviceDesktop},
+		},
+		{
+			"internet explorer 11",
+			"Mozilla/5.0 (Windows NT 6.1; WOW64; Trident/7.0; rv:11.0) like Gecko",
+			UserAgentInfo{"Internet Explorer", "11.0", "Windows", "7", DeviceDesktop},
+		},
+		// Edge and Opera also advertise Chrome and Safari
+		{
+			"edge on windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36 Edg/126.0.2592.87",
+			UserAgentInfo{"Edge", "126.0.2592.87", "Windows", "10", DeviceDesktop},
+		},
+		{
+			"edge on android",
+			"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Mobile Safari/537.36 EdgA/126.0.2592.80",
+			UserAgentInfo{"Edge", "126.0.2592.80", "Android", "14", DeviceMobile},
+		},
+		{
+			"opera on macos",
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/125.0.0.0 Safari/537.36 OPR/111.0.0.0",
+			UserAgentInfo{"Opera", "111.0.0.0", "macOS", "10.15.7", DeviceDesktop},
+		},
+		{
+			"presto opera",
+			"Opera/9.80 (Windows NT 6.1; U; en) Presto/2.12.388 Version/12.18",
+			UserAgentInfo{"Opera", "9.80", "Windows", "7", DeviceDesktop},
+		},
+		{
+			"safari on iphone",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1",
+			UserAgentInfo{"Safari", "17.5", "iOS", "17.5", DeviceMobile},
+		},
+		{
+			"chrome on iphone",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/126.0.6478.54 Mobile/15E148 Safari/604.1",
+			UserAgentInfo{"Chrome", "126.0.6478.54", "iOS", "17.5", DeviceMobile},
+		},
+		{
+			"firefox on ipad",
+			"Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) FxiOS/127.0 Mobile/15E148 Safari/605.1.15",
+			UserAgentInfo{"Firefox", "127.0", "iOS", "16.6", DeviceTablet},
+		},
+		{
+			"chrome on android phone",
+			"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.6478.71 Mobile Safari/537.36",
+			UserAgentInfo{"Chrome", "126.0.6478.71", "Android", "14", DeviceMobile},
+		},
+		{
+			"chrome on android tablet",
+			"Mozilla/5.0 (Linux; Android 13; SM-X710) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+			UserAgentInfo{"Chrome", "126.0.0.0", "Android", "13", DeviceTablet},
+		},
+		{
+			"samsung internet",
+			"Mozilla/5.0 (Linux; Android 13; SM-S911B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/25.0 Chrome/121.0.0.0 Mobile Safari/537.36",
+			UserAgentInfo{"Samsung Internet", "25.0", "Android", "13", DeviceMobile},
+		},
+		{
+			"windows phone",
+			"Mozilla/5.0 (Mobile; Windows Phone 8.1; Android 4.0; ARM; Trident/7.0; Touch; rv:11.0; IEMobile/11.0; NOKIA; Lumia 635) like iPhone OS 7_0_3 Mac OS X AppleWebKit/537 (KHTML, like Gecko) Mobile Safari/537",
+			UserAgentInfo{"Internet Explorer", "11.0", "Windows Phone", "8.1", DeviceMobile},
+		},
+		{
+			"playstation",
+			"Mozilla/5.0 (PlayStation; PlayStation 5/2.26) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.0 Safari/605.1.15",
+			UserAgentInfo{"Safari", "13.0", "Other", "", DeviceConsole},
+		},
+		{
+			"unknown client",
+			"MyApp/3.2",
+			UserAgentInfo{"Other", "", "Other", "", DeviceUnknown},
+		},
+		{
+			"empty",
+			"",
+			UserAgentInfo{"Other", "", "Other", "", DeviceUnknown},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseUserAgent(tt.ua); got != tt.want {
+				t.Errorf("ParseUserAgent() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
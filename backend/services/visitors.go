@@ -0,0 +1,289 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// sketchDayFormat is the layout of sketch day keys (UTC dates)
+const sketchDayFormat = "2006-01-02"
+
+// visitorBackfillState is the RollupState row tracking the sketch backfill.
+// Clicks before its time have not been added to sketches yet; the zero time
+// marks a finished backfill.
+const visitorBackfillState = "visitor_backfill"
+
+// sketchKey identifies one per-link, per-day visitor sketch
+type sketchKey struct {
+	linkID uint
+	day    string
+	isBot  bool
+}
+
+// UniqueVisitorService maintains per-link daily HyperLogLog sketches of
+// unique visitors. Clicks are added to in-memory sketches that are merged
+// into the visitor_sketches table periodically.
+type UniqueVisitorService struct {
+	interval time.Duration
+	mu       sync.Mutex
+	pending  map[sketchKey]*HyperLogLog
+}
+
+// NewUniqueVisitorService creates a service that flushes every interval
+func NewUniqueVisitorService(interval time.Duration) *UniqueVisitorService {
+	return &UniqueVisitorService{
+		interval: interval,
+		pending:  make(map[sketchKey]*HyperLogLog),
+	}
+}
+
+// Add records a visitor for a link at the given time
+func (s *UniqueVisitorService) Add(linkID uint, at time.Time, isBot bool, visitor string) {
+	if visitor == "" {
+		return
+	}
+
+	key := sketchKey{linkID: linkID, day: at.UTC().Format(sketchDayFormat), isBot: isBot}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sketch, ok := s.pending[key]
+	if !ok {
+		sketch = NewHyperLogLog()
+		s.pending[key] = sketch
+	}
+	sketch.Add(visitor)
+}
+
+// Start backfills sketches for clicks recorded before sketches existed,
+// resuming an interrupted backfill, and then flushes pending sketches every interval until ctx is cancelled
+func (s *UniqueVisitorService) Start(ctx context.Context) {
+	go func() {
+		if err := s.backfill(); err != nil {
+			slog.Error("visitor sketch backfill failed", "error", err)
+		}
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.Flush(); err != nil {
+					slog.Error("visitor sketch flush failed", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Flush merges all pending sketches into the database. Sketches that fail
+// to save are kept in memory for the next flush.
+func (s *UniqueVisitorService) Flush() error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[sketchKey]*HyperLogLog)
+	s.mu.Unlock()
+
+	var firstErr error
+	for key, sketch := range pending {
+		if err := saveSketch(key, sketch); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			s.requeue(key, sketch)
+		}
+	}
+	return firstErr
+}
+
+// requeue merges a sketch back into the pending set
+func (s *UniqueVisitorService) requeue(key sketchKey, sketch *HyperLogLog) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.pending[key]; ok {
+		existing.Merge(sketch)
+		return
+	}
+	s.pending[key] = sketch
+}
+
+// saveSketch merges a sketch into its stored row under a row lock
+func saveSketch(key sketchKey, sketch *HyperLogLog) error {
+	day, err := time.Parse(sketchDayFormat, key.day)
+	if err != nil {
+		return err
+	}
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		// Make sure the row exists so it can be locked
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.VisitorSketch{
+			LinkID:    key.linkID,
+			Day:       day,
+			IsBot:     key.isBot,
+			Registers: NewHyperLogLog().Bytes(),
+			UpdatedAt: time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		var stored models.VisitorSketch
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("link_id = ? AND day = ? AND is_bot = ?", key.linkID, day, key.isBot).
+			First(&stored).Error
+		if err != nil {
+			return err
+		}
+
+		merged, err := HyperLogLogFromBytes(stored.Registers)
+		if err != nil {
+			merged = NewHyperLogLog()
+		}
+		merged.Merge(sketch)
+
+		return tx.Model(&stored).Updates(map[string]interface{}{
+			"registers":  merged.Bytes(),
+			"updated_at": time.Now(),
+		}).Error
+	})
+}
+
+// Estimate returns the approximate number of unique visitors of a link
+// between from and to (UTC days, to exclusive; zero values are unbounded).
+// traffic is "all", "human" or "bot".
+func (s *UniqueVisitorService) Estimate(linkID uint, from, to time.Time, traffic string) (uint64, error) {
+	sketch, err := s.merged(linkID, from, to, traffic)
+	if err != nil {
+		return 0, err
+	}
+	return sketch.Estimate(), nil
+}
+
+// merged returns the union of stored and pending sketches matching the filter
+func (s *UniqueVisitorService) merged(linkID uint, from, to time.Time, traffic string) (*HyperLogLog, error) {
+	var fromDay, toDay string
+	query := database.DB.Model(&models.VisitorSketch{}).Where("link_id = ?", linkID)
+	if !from.IsZero() {
+		fromDay = from.UTC().Format(sketchDayFormat)
+		query = query.Where("day >= ?", fromDay)
+	}
+	if !to.IsZero() {
+		toDay = to.UTC().Format(sketchDayFormat)
+		query = query.Where("day < ?", toDay)
+	}
+	switch traffic {
+	case "human":
+		query = query.Where("is_bot = ?", false)
+	case "bot":
+		query = query.Where("is_bot = ?", true)
+	}
+
+	var stored []models.VisitorSketch
+	if err := query.Find(&stored).Error; err != nil {
+		return nil, err
+	}
+
+	result := NewHyperLogLog()
+	for _, row := range stored {
+		if sketch, err := HyperLogLogFromBytes(row.Registers); err == nil {
+			result.Merge(sketch)
+		}
+	}
+
+	// Include clicks that have not been flushed yet
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, sketch := range s.pending {
+		if key.linkID != linkID ||
+			(fromDay != "" && key.day < fromDay) ||
+			(toDay != "" && key.day >= toDay) ||
+			(traffic == "human" && key.isBot) ||
+			(traffic == "bot" && !key.isBot) {
+			continue
+		}
+		result.Merge(sketch)
+	}
+
+	return result, nil
+}
+
+// backfill builds sketches from stored clicks one UTC day at a time, from
+// the latest day back. Progress is saved after each day, so a restart
+// resumes where the last run stopped. Clicks added both live and here are
+// counted once, since sketches ignore repeated visitors.
+func (s *UniqueVisitorService) backfill() error {
+	var state models.RollupState
+	err := database.DB.Where("name = ?", visitorBackfillState).First(&state).Error
+	until := state.RolledUntil
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		// Clicks from now on are added live
+		until = time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+	case err != nil:
+		return err
+	case until.IsZero():
+		return nil
+	}
+
+	for {
+		// Skip to the latest day before until that has clicks
+		var latest models.Click
+		err := database.DB.Select("clicked_at").
+			Where("clicked_at < ? AND ip_address <> ''", until).
+			Order("clicked_at DESC").
+			First(&latest).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return saveState(database.DB, visitorBackfillState, time.Time{})
+		}
+		if err != nil {
+			return err
+		}
+		day := latest.ClickedAt.UTC().Truncate(24 * time.Hour)
+
+		var clicks []models.Click
+		err = database.DB.
+			Select("id, link_id, clicked_at, ip_address, user_agent, is_bot").
+			Where("clicked_at >= ? AND clicked_at < ? AND ip_address <> ''", day, until).
+			FindInBatches(&clicks, 5000, func(tx *gorm.DB, batch int) error {
+				for _, click := range clicks {
+					s.Add(click.LinkID, click.ClickedAt, click.IsBot, VisitorKey(click.IPAddress, click.UserAgent))
+				}
+				return nil
+			}).Error
+		if err != nil {
+			return err
+		}
+		if err := s.Flush(); err != nil {
+			return err
+		}
+
+		if err := saveState(database.DB, visitorBackfillState, day); err != nil {
+			return err
+		}
+		until = day
+	}
+}
+
+// VisitorKey identifies a visitor by the stored IP address and user agent.
+// Live clicks and the backfill both use the stored, possibly anonymized IP,
+// so their keys match in every privacy mode.
+func VisitorKey(ip, userAgent string) string {
+	if ip == "" {
+		return ""
+	}
+	return ip + "|" + userAgent
+}
@@ -0,0 +1,156 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/internal/testdb"
+	"link-shortener/models"
+)
+
+// visitorClick returns a stored click of visitor ip at clickedAt
+func visitorClick(linkID uint, clickedAt time.Time, ip string) models.Click {
+	return models.Click{LinkID: linkID, ClickedAt: clickedAt, IPAddress: ip, UserAgent: "Mozilla/5.0"}
+}
+
+// backfillState returns the stored backfill progress
+func backfillState(t *testing.T) time.Time {
+	t.Helper()
+	var state models.RollupState
+	if err := database.DB.Where("name = ?", visitorBackfillState).First(&state).Error; err != nil {
+		t.Fatal(err)
+	}
+	return state.RolledUntil
+}
+
+func TestUniqueVisitorBackfill(t *testing.T) {
+	testdb.Open(t, &models.Click{}, &models.VisitorSketch{}, &models.RollupState{})
+
+	day1 := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	day3 := day1.AddDate(0, 0, 2)
+	clicks := []models.Click{
+		visitorClick(1, day1.Add(1*time.Hour), "198.51.100.1"),
+		visitorClick(1, day1.Add(2*time.Hour), "198.51.100.2"),
+		visitorClick(1, day2.Add(23*time.Hour), "198.51.100.1"),
+		visitorClick(1, day2.Add(23*time.Hour), "198.51.100.3"),
+		visitorClick(1, day3.Add(5*time.Hour), "198.51.100.4"),
+		// Opted-out clicks have no IP and are not counted
+		visitorClick(1, day3.Add(6*time.Hour), ""),
+	}
+	if err := database.DB.Create(&clicks).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewUniqueVisitorService(time.Hour)
+	if err := s.backfill(); err != nil {
+		t.Fatal(err)
+	}
+	if got := backfillState(t); !got.IsZero() {
+		t.Errorf("backfill state = %s, want the finished marker", got)
+	}
+
+	tests := []struct {
+		from, to time.Time
+		want     uint64
+	}{
+		{day1, day2, 2},
+		{day2, day3, 2},
+		{day3, day3.AddDate(0, 0, 1), 1},
+		{time.Time{}, time.Time{}, 4},
+	}
+	for _, tt := range tests {
+		got, err := s.Estimate(1, tt.from, tt.to, "all")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Estimate(%s, %s) = %d, want %d", tt.from.Format(sketchDayFormat), tt.to.Format(sketchDayFormat), got, tt.want)
+		}
+	}
+
+	// A finished backfill does not run again
+	if err := database.DB.Create(&[]models.Click{visitorClick(1, day1, "198.51.100.9")}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.backfill(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Estimate(1, time.Time{}, time.Time{}, "all"); got != 4 {
+		t.Errorf("estimate after second backfill = %d, want 4", got)
+	}
+}
+
+func TestUniqueVisitorBackfillResumes(t *testing.T) {
+	testdb.Open(t, &models.Click{}, &models.VisitorSketch{}, &models.RollupState{})
+
+	day1 := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	clicks := []models.Click{
+		visitorClick(1, day1.Add(time.Hour), "198.51.100.1"),
+		visitorClick(1, day2.Add(time.Hour), "198.51.100.2"),
+	}
+	if err := database.DB.Create(&clicks).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// An earlier run stopped after saving day 2
+	s := NewUniqueVisitorService(time.Hour)
+	s.Add(1, clicks[1].ClickedAt, false, VisitorKey(clicks[1].IPAddress, clicks[1].UserAgent))
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveState(database.DB, visitorBackfillState, day2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.backfill(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sketches int64
+	database.DB.Model(&models.VisitorSketch{}).Count(&sketches)
+	if sketches != 2 {
+		t.Errorf("got %d sketches, want 2", sketches)
+	}
+	if got, _ := s.Estimate(1, day1, day2, "all"); got != 1 {
+		t.Errorf("day 1 estimate = %d, want 1", got)
+	}
+	if got := backfillState(t); !got.IsZero() {
+		t.Errorf("backfill state = %s, want the finished marker", got)
+	}
+}
+
+func TestUniqueVisitorKeysMatchBackfill(t *testing.T) {
+	for _, mode := range []string{PrivacyModeOff, PrivacyModeTruncate, PrivacyModeHash} {
+		t.Run(mode, func(t *testing.T) {
+			testdb.Open(t, &models.Click{}, &models.VisitorSketch{}, &models.RollupState{}, &models.IPHashSalt{})
+
+			anonymizer, err := NewIPAnonymizer(mode, "test-secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now().UTC()
+
+			// A click tracked live, counted by its stored IP
+			click := visitorClick(1, now, anonymizer.Anonymize("198.51.100.7", now))
+			if err := database.DB.Create(&click).Error; err != nil {
+				t.Fatal(err)
+			}
+			s := NewUniqueVisitorService(time.Hour)
+			s.Add(click.LinkID, click.ClickedAt, false, VisitorKey(click.IPAddress, click.UserAgent))
+			if err := s.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The backfill sees the same click again
+			if err := s.backfill(); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := s.Estimate(1, time.Time{}, time.Time{}, "all"); got != 1 {
+				t.Errorf("estimate = %d, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"link-shortener/database"
+	"link-shortener/internal/testdb"
+	"link-shortener/models"
+)
+
+func TestSignWebhookPayload(t *testing.T) {
+	// echo -n '1700000000.{"id":"evt_1"}' | openssl dgst -sha256 -hmac whsec_test
+	want := "c89214b5b5da833daed6f0b8c5bb6bd58cea9022bd80ccc78230f3942d632925"
+	if got := SignWebhookPayload("whsec_test", "1700000000", []byte(`{"id":"evt_1"}`)); got != want {
+		t.Errorf("SignWebhookPayload = %s, want %s", got, want)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 25; attempt++ {
+		base := webhookMaxBackoff
+		if attempt < 20 && webhookBaseBackoff<<(attempt-1) < webhookMaxBackoff {
+			base = webhookBaseBackoff << (attempt - 1)
+		}
+		for i := 0; i < 20; i++ {
+			if got := webhookBackoff(attempt); got < base || got > base+base/5 {
+				t.Fatalf("webhookBackoff(%d) = %s, want between %s and %s", attempt, got, base, base+base/5)
+			}
+		}
+	}
+}
+
+func TestRefusePrivateAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		private bool
+	}{
+		{"127.0.0.1:80", true},
+		{"10.1.2.3:443", true},
+		{"172.16.0.1:443", true},
+		{"192.168.1.1:443", true},
+		{"169.254.169.254:80", true},
+		{"0.0.0.0:80", true},
+		{"[::1]:80", true},
+		{"[fe80::1]:80", true},
+		{"[fd00::1]:80", true},
+		{"[::ffff:127.0.0.1]:80", true},
+		{"[::ffff:10.0.0.1]:80", true},
+		{"[::ffff:169.254.169.254]:80", true},
+		{"93.184.216.34:443", false},
+		{"[2606:4700::1111]:443", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := refusePrivateAddress("tcp", tt.address, nil)
+			if tt.private && !errors.Is(err, ErrPrivateAddress) {
+				t.Errorf("err = %v, want ErrPrivateAddress", err)
+			}
+			if !tt.private && err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	s := NewWebhookService(time.Second, time.Second, 3, false)
+	ctx := context.Background()
+
+	// localhost resolves to loopback without a DNS server
+	for _, host := range []string{"localhost", "127.0.0.1", "10.0.0.1", "169.254.169.254", "::ffff:192.168.1.1", "::1"} {
+		if err := s.CheckHost(ctx, host); !errors.Is(err, ErrPrivateAddress) {
+			t.Errorf("CheckHost(%q) = %v, want ErrPrivateAddress", host, err)
+		}
+	}
+	if err := s.CheckHost(ctx, "93.184.216.34"); err != nil {
+		t.Errorf("CheckHost(public address) = %v", err)
+	}
+
+	allowed := NewWebhookService(time.Second, time.Second, 3, true)
+	if err := allowed.CheckHost(ctx, "localhost"); err != nil {
+		t.Errorf("CheckHost with private addresses allowed = %v", err)
+	}
+}
+
+// openWebhookTestDB opens a test database with the webhook tables and a
+// subscription to sub's events
+func openWebhookTestDB(t *testing.T, sub *models.WebhookSubscription) {
+	t.Helper()
+	testdb.Open(t, &models.WebhookSubscription{}, &models.WebhookDelivery{}, &models.WebhookQueuedClick{})
+	if err := database.DB.Create(sub).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookDeliverOutcome(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		attempts   int
+		wantStatus string
+	}{
+		{"delivered", http.StatusNoContent, 0, models.DeliveryDelivered},
+		{"retried", http.StatusInternalServerError, 0, models.DeliveryRetrying},
+		{"retried before the last attempt", http.StatusBadGateway, 1, models.DeliveryRetrying},
+		{"dead-lettered after the last attempt", http.StatusInternalServerError, 2, models.DeliveryDead},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var signature string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				signature = r.Header.Get("X-KinterCut-Signature")
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			sub := &models.WebhookSubscription{URL: server.URL, Secret: "whsec_test", Events: models.WebhookLinkCreated, Active: true, ClickSampleRate: 1, ClickBatchSize: 1}
+			openWebhookTestDB(t, sub)
+			s := NewWebhookService(time.Second, time.Second, 3, true)
+
+			d := models.WebhookDelivery{SubscriptionID: sub.ID, Event: models.WebhookLinkCreated, Payload: `{}`,
+				Status: models.DeliveryPending, Attempts: tt.attempts, NextAttemptAt: time.Now()}
+			if err := database.DB.Create(&d).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			before := time.Now()
+			s.deliver(context.Background(), *sub, d)
+
+			var got models.WebhookDelivery
+			if err := database.DB.First(&got, d.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.wantStatus || got.Attempts != tt.attempts+1 || got.ResponseStatus != tt.status {
+				t.Errorf("status %s, attempts %d, response %d; want %s, %d, %d",
+					got.Status, got.Attempts, got.ResponseStatus, tt.wantStatus, tt.attempts+1, tt.status)
+			}
+			if tt.wantStatus == models.DeliveryRetrying && got.NextAttemptAt.Before(before.Add(webhookBackoff(tt.attempts+1)*5/6)) {
+				t.Errorf("retry scheduled at %s, too early", got.NextAttemptAt)
+			}
+			if signature == "" {
+				t.Error("delivery was not signed")
+			}
+		})
+	}
+}
+
+func TestFlushClicksBatching(t *testing.T) {
+	sub := &models.WebhookSubscription{URL: "https://example.com/hook", Secret: "whsec_test", Events: models.WebhookLinkClicked, Active: true, ClickSampleRate: 1, ClickBatchSize: 3}
+	openWebhookTestDB(t, sub)
+	s := NewWebhookService(time.Second, time.Second, 3, false)
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 7; i++ {
+		if err := s.EmitClick(database.DB, models.Click{ID: uint(i), LinkID: 1, ClickedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// batchSizes returns the number of clicks in each delivery
+	batchSizes := func() []int {
+		t.Helper()
+		var deliveries []models.WebhookDelivery
+		if err := database.DB.Order("id").Find(&deliveries).Error; err != nil {
+			t.Fatal(err)
+		}
+		sizes := make([]int, len(deliveries))
+		for i, d := range deliveries {
+			var envelope struct {
+				Data struct {
+					Clicks []json.RawMessage `json:"clicks"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal([]byte(d.Payload), &envelope); err != nil {
+				t.Fatal(err)
+			}
+			sizes[i] = len(envelope.Data.Clicks)
+		}
+		return sizes
+	}
+	queued := func() int64 {
+		t.Helper()
+		var n int64
+		database.DB.Model(&models.WebhookQueuedClick{}).Count(&n)
+		return n
+	}
+
+	if err := s.flushClicks(false); err != nil {
+		t.Fatal(err)
+	}
+	if sizes := batchSizes(); len(sizes) != 2 || sizes[0] != 3 || sizes[1] != 3 {
+		t.Errorf("full batches = %v, want [3 3]", sizes)
+	}
+	if n := queued(); n != 1 {
+		t.Errorf("%d clicks left queued, want 1", n)
+	}
+
+	if err := s.flushClicks(true); err != nil {
+		t.Fatal(err)
+	}
+	if sizes := batchSizes(); len(sizes) != 3 || sizes[2] != 1 {
+		t.Errorf("batches after partial flush = %v, want [3 3 1]", sizes)
+	}
+	if n := queued(); n != 0 {
+		t.Errorf("%d clicks left queued, want 0", n)
+	}
+}
+
+func TestClaimDeliveriesLease(t *testing.T) {
+	sub := &models.WebhookSubscription{URL: "https://example.com/hook", Secret: "whsec_test", Events: models.WebhookLinkCreated, Active: true, ClickSampleRate: 1, ClickBatchSize: 1}
+	openWebhookTestDB(t, sub)
+	inactive := &models.WebhookSubscription{URL: "https://example.com/off", Secret: "whsec_test", Events: models.WebhookLinkCreated, ClickSampleRate: 1, ClickBatchSize: 1}
+	if err := database.DB.Create(inactive).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	const due = 20
+	for i := 0; i < due; i++ {
+		d := models.WebhookDelivery{SubscriptionID: sub.ID, Event: models.WebhookLinkCreated, Payload: `{}`,
+			Status: models.DeliveryPending, NextAttemptAt: time.Now().Add(-time.Second)}
+		if err := database.DB.Create(&d).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []models.WebhookDelivery{
+		{SubscriptionID: sub.ID, Status: models.DeliveryPending, NextAttemptAt: time.Now().Add(time.Hour)},
+		{SubscriptionID: sub.ID, Status: models.DeliveryDelivered, NextAttemptAt: time.Now().Add(-time.Second)},
+		{SubscriptionID: inactive.ID, Status: models.DeliveryPending, NextAttemptAt: time.Now().Add(-time.Second)},
+	} {
+		d.Event, d.Payload = models.WebhookLinkCreated, `{}`
+		if err := database.DB.Create(&d).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		claimed = make(map[uint]int)
+		wg      sync.WaitGroup
+	)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 3; i++ {
+				deliveries, err := claimDeliveries(time.Minute)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				for _, d := range deliveries {
+					claimed[d.ID]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(claimed) != due {
+		t.Errorf("claimed %d deliveries, want %d", len(claimed), due)
+	}
+	for id, n := range claimed {
+		if n > 1 {
+			t.Errorf("delivery %d claimed %d times", id, n)
+		}
+	}
+
+	var leased models.WebhookDelivery
+	database.DB.Where("id IN ?", []uint{1}).First(&leased)
+	if !leased.NextAttemptAt.After(time.Now().Add(time.Minute)) {
+		t.Errorf("claimed delivery due again at %s, want leased", leased.NextAttemptAt)
+	}
+}
@@ -1,6 +1,7 @@
 import { Routes, Route, Navigate } from 'react-router-dom'
 import Home from './pages/Home'
 import AdminLogin from './pages/AdminLogin'
+import SSOCallback from './pages/SSOCallback'
 import AdminDashboard from './pages/AdminDashboard'
 import LinkDetails from './pages/LinkDetails'
 import LinkExpired from './pages/LinkExpired'
@@ -38,6 +39,7 @@ function App() {
                 <Routes>
                     <Route path="/" element={<Home />} />
                     <Route path="/adminek" element={<AdminLogin />} />
+                    <Route path="/adminek/sso" element={<SSOCallback />} />
                     <Route path="/adminek/dashboard" element={
                         <ProtectedRoute>
                             <AdminDashboard />
@@ -9,8 +9,52 @@ const api = axios.create({
     },
 })
 
-// Add token to requests if available
-api.interceptors.request.use((config) => {
+// Session storage (access tokens are short-lived and renewed with the
+// single-use refresh token)
+export const storeSession = (data) => {
+    localStorage.setItem('admin_token', data.token)
+    localStorage.setItem('token_expires_at', data.expires_at.toString())
+    localStorage.setItem('refresh_token', data.refresh_token)
+    localStorage.setItem('refresh_expires_at', data.refresh_expires_at.toString())
+}
+
+export const clearSession = () => {
+    localStorage.removeItem('admin_token')
+    localStorage.removeItem('token_expires_at')
+    localStorage.removeItem('refresh_token')
+    localStorage.removeItem('refresh_expires_at')
+}
+
+// Concurrent requests share one refresh, since each refresh token works once
+let refreshing = null
+
+const refreshSession = () => {
+    if (!refreshing) {
+        const refreshToken = localStorage.getItem('refresh_token')
+        refreshing = axios.post(`${API_BASE_URL}/api/admin/refresh`, { refresh_token: refreshToken })
+            .then((response) => storeSession(response.data))
+            .catch((err) => {
+                // Another tab may have refreshed first and stored new tokens
+                if (localStorage.getItem('refresh_token') === refreshToken) {
+                    throw err
+                }
+            })
+            .finally(() => { refreshing = null })
+    }
+    return refreshing
+}
+
+// Add token to requests if available, renewing it shortly before it expires
+api.interceptors.request.use(async (config) => {
+    const expiresAt = localStorage.getItem('token_expires_at')
+    if (expiresAt && localStorage.getItem('refresh_token') && Date.now() > (parseInt(expiresAt) - 30) * 1000) {
+        try {
+            await refreshSession()
+        } catch {
+            clearSession()
+        }
+    }
+
     const token = localStorage.getItem('admin_token')
     if (token) {
         config.headers.Authorization = `Bearer ${token}`
@@ -18,13 +62,22 @@ api.interceptors.request.use((config) => {
     return config
 })
 
-// Handle auth errors
+// Handle auth errors: renew an expired access token once, otherwise sign out
 api.interceptors.response.use(
     (response) => response,
-    (error) => {
-        if (error.response?.status === 401) {
-            localStorage.removeItem('admin_token')
-            localStorage.removeItem('token_expires_at')
+    async (error) => {
+        const original = error.config
+        if (error.response?.status === 401 && !original.url.startsWith('/api/admin/login')) {
+            if (!original._retried && localStorage.getItem('refresh_token')) {
+                original._retried = true
+                try {
+                    await refreshSession()
+                    return api(original)
+                } catch {
+                    // Fall through to sign out
+                }
+            }
+            clearSession()
             window.location.href = '/adminek'
         }
         return Promise.reject(error)
@@ -47,6 +100,39 @@ export const adminLogin = async (username, password) => {
     return response.data
 }
 
+export const adminLoginTwoFactor = async (preAuthToken, code) => {
+    const response = await api.post('/api/admin/login/2fa', { pre_auth_token: preAuthToken, code })
+    return response.data
+}
+
+// Single sign-on
+export const getSSOStatus = async () => {
+    const response = await api.get('/api/admin/oidc')
+    return response.data
+}
+
+// Single sign-on is bound to this browser by a state cookie, which is also
+// needed when the API is on another origin
+export const startSSOLogin = async () => {
+    const response = await api.post('/api/admin/oidc/start', null, { withCredentials: true })
+    return response.data
+}
+
+export const completeSSOLogin = async (code, state) => {
+    const response = await api.post('/api/admin/login/oidc', { code, state }, { withCredentials: true })
+    return response.data
+}
+
+export const adminLogout = async () => {
+    const response = await api.post('/api/admin/logout')
+    return response.data
+}
+
+export const adminLogoutEverywhere = async () => {
+    const response = await api.post('/api/admin/logout/all')
+    return response.data
+}
+
 export const getMyLinks = async () => {
     const response = await api.get('/api/admin/my')
     return response.data
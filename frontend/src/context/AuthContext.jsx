@@ -1,4 +1,5 @@
 import { createContext, useContext, useState, useEffect } from 'react'
+import { adminLogout, clearSession, storeSession } from '../api/api'
 
 const AuthContext = createContext(null)
 
@@ -7,31 +8,35 @@ export function AuthProvider({ children }) {
     const [loading, setLoading] = useState(true)
 
     useEffect(() => {
-        // Check for existing token on mount
+        // Check for an existing session on mount; an expired access token is
+        // renewed with the refresh token on the first request
         const storedToken = localStorage.getItem('admin_token')
-        const expiresAt = localStorage.getItem('token_expires_at')
+        const refreshExpiresAt = localStorage.getItem('refresh_expires_at')
 
-        if (storedToken && expiresAt) {
-            const isExpired = Date.now() > parseInt(expiresAt) * 1000
+        if (storedToken && refreshExpiresAt) {
+            const isExpired = Date.now() > parseInt(refreshExpiresAt) * 1000
             if (!isExpired) {
                 setToken(storedToken)
             } else {
-                localStorage.removeItem('admin_token')
-                localStorage.removeItem('token_expires_at')
+                clearSession()
             }
         }
         setLoading(false)
     }, [])
 
-    const login = (newToken, expiresAt) => {
-        localStorage.setItem('admin_token', newToken)
-        localStorage.setItem('token_expires_at', expiresAt.toString())
-        setToken(newToken)
+    const login = (session) => {
+        storeSession(session)
+        setToken(session.token)
     }
 
-    const logout = () => {
-        localStorage.removeItem('admin_token')
-        localStorage.removeItem('token_expires_at')
+    const logout = async () => {
+        // Revoke the session server-side; sign out locally even if that fails
+        try {
+            await adminLogout()
+        } catch {
+            // Ignore
+        }
+        clearSession()
         setToken(null)
     }
 
@@ -83,8 +83,8 @@ function AdminDashboard() {
         }
     }
 
-    const handleLogout = () => {
-        logout()
+    const handleLogout = async () => {
+        await logout()
         navigate('/adminek')
     }
 
@@ -1,20 +1,48 @@
-import { useState } from 'react'
+import { useState, useEffect } from 'react'
 import { useNavigate } from 'react-router-dom'
 import { useAuth } from '../context/AuthContext'
-import { adminLogin } from '../api/api'
+import { adminLogin, adminLoginTwoFactor, getSSOStatus, startSSOLogin } from '../api/api'
 
 function AdminLogin() {
     const [username, setUsername] = useState('')
     const [password, setPassword] = useState('')
     const [loading, setLoading] = useState(false)
     const [error, setError] = useState('')
+    const [sso, setSSO] = useState(null)
+    // Set while the account's two-factor code is asked for
+    const [preAuthToken, setPreAuthToken] = useState('')
+    const [code, setCode] = useState('')
     const navigate = useNavigate()
     const { login } = useAuth()
 
+    useEffect(() => {
+        getSSOStatus()
+            .then((status) => setSSO(status.enabled ? status : null))
+            .catch(() => setSSO(null))
+    }, [])
+
+    const handleSSO = async () => {
+        setError('')
+        setLoading(true)
+        try {
+            const data = await startSSOLogin()
+            // Checked when the identity provider redirects back
+            sessionStorage.setItem('oidc_state', data.state)
+            window.location.href = data.authorization_url
+        } catch (err) {
+            setError(err.response?.data?.error || 'Single sign-on is unavailable.')
+            setLoading(false)
+        }
+    }
+
     const handleSubmit = async (e) => {
         e.preventDefault()
         setError('')
 
+        if (preAuthToken) {
+            return handleTwoFactor()
+        }
+
         if (!username.trim() || !password.trim()) {
             setError('Please enter username and password')
             return
@@ -23,7 +51,12 @@ function AdminLogin() {
         setLoading(true)
         try {
             const data = await adminLogin(username, password)
-            login(data.token, data.expires_at)
+            if (data.two_factor_required) {
+                setPreAuthToken(data.pre_auth_token)
+                setPassword('')
+                return
+            }
+            login(data)
             navigate('/adminek/dashboard')
         } catch (err) {
             setError(err.response?.data?.error || 'Login failed. Check your credentials.')
@@ -32,6 +65,30 @@ function AdminLogin() {
         }
     }
 
+    const handleTwoFactor = async () => {
+        if (!code.trim()) {
+            setError('Please enter the code from your authenticator app')
+            return
+        }
+
+        setLoading(true)
+        try {
+            const data = await adminLoginTwoFactor(preAuthToken, code.trim())
+            login(data)
+            navigate('/adminek/dashboard')
+        } catch (err) {
+            setError(err.response?.data?.error || 'Login failed. Check your code.')
+        } finally {
+            setLoading(false)
+        }
+    }
+
+    const startOver = () => {
+        setPreAuthToken('')
+        setCode('')
+        setError('')
+    }
+
     return (
         <div className="min-h-screen flex items-center justify-center px-4">
             <div className="w-full max-w-md">
@@ -46,30 +103,49 @@ function AdminLogin() {
                 </div>
 
                 <form onSubmit={handleSubmit} className="glass-card">
-                    <div className="space-y-4">
+                    {preAuthToken ? (
                         <div>
-                            <label className="block text-sm font-medium text-dark-300 mb-2">Username</label>
+                            <label className="block text-sm font-medium text-dark-300 mb-2">Two-factor code</label>
                             <input
                                 type="text"
-                                value={username}
-                                onChange={(e) => setUsername(e.target.value)}
+                                autoComplete="one-time-code"
+                                autoFocus
+                                value={code}
+                                onChange={(e) => setCode(e.target.value)}
                                 className="input"
-                                placeholder="admin"
+                                placeholder="123456 or recovery code"
                                 disabled={loading}
                             />
+                            <p className="text-dark-500 text-xs mt-2">
+                                Enter the code from your authenticator app, or one of your recovery codes.
+                            </p>
                         </div>
-                        <div>
-                            <label className="block text-sm font-medium text-dark-300 mb-2">Password</label>
-                            <input
-                                type="password"
-                                value={password}
-                                onChange={(e) => setPassword(e.target.value)}
-                                className="input"
-                                placeholder="••••••••"
-                                disabled={loading}
-                            />
+                    ) : (
+                        <div className="space-y-4">
+                            <div>
+                                <label className="block text-sm font-medium text-dark-300 mb-2">Username</label>
+                                <input
+                                    type="text"
+                                    value={username}
+                                    onChange={(e) => setUsername(e.target.value)}
+                                    className="input"
+                                    placeholder="admin"
+                                    disabled={loading}
+                                />
+                            </div>
+                            <div>
+                                <label className="block text-sm font-medium text-dark-300 mb-2">Password</label>
+                                <input
+                                    type="password"
+                                    value={password}
+                                    onChange={(e) => setPassword(e.target.value)}
+                                    className="input"
+                                    placeholder="••••••••"
+                                    disabled={loading}
+                                />
+                            </div>
                         </div>
-                    </div>
+                    )}
 
                     {error && (
                         <div className="mt-4 p-4 bg-red-500/10 border border-red-500/30 rounded-xl text-red-400 text-sm">
@@ -94,6 +170,28 @@ function AdminLogin() {
                             'Sign In'
                         )}
                     </button>
+
+                    {preAuthToken && (
+                        <button
+                            type="button"
+                            onClick={startOver}
+                            disabled={loading}
+                            className="w-full mt-3 btn-secondary py-3 disabled:opacity-50"
+                        >
+                            Start over
+                        </button>
+                    )}
+
+                    {sso && !preAuthToken && (
+                        <button
+                            type="button"
+                            onClick={handleSSO}
+                            disabled={loading}
+                            className="w-full mt-3 btn-secondary py-3 disabled:opacity-50"
+                        >
+                            Sign in with {sso.provider_name}
+                        </button>
+                    )}
                 </form>
 
                 <p className="text-center mt-6 text-dark-500 text-sm">
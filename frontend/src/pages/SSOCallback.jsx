@@ -0,0 +1,66 @@
+import { useState, useEffect, useRef } from 'react'
+import { Link, useNavigate, useSearchParams } from 'react-router-dom'
+import { useAuth } from '../context/AuthContext'
+import { completeSSOLogin } from '../api/api'
+
+function SSOCallback() {
+    const [error, setError] = useState('')
+    const [searchParams] = useSearchParams()
+    const navigate = useNavigate()
+    const { login } = useAuth()
+    // The authorization code works once, so the exchange must not run twice
+    const started = useRef(false)
+
+    useEffect(() => {
+        if (started.current) return
+        started.current = true
+
+        const code = searchParams.get('code')
+        const state = searchParams.get('state')
+        const expectedState = sessionStorage.getItem('oidc_state')
+        sessionStorage.removeItem('oidc_state')
+
+        if (searchParams.get('error')) {
+            setError(searchParams.get('error_description') || 'Sign-in was cancelled.')
+            return
+        }
+        // Only finish logins started in this browser
+        if (!code || !state || state !== expectedState) {
+            setError('Sign-in has expired, please sign in again.')
+            return
+        }
+
+        completeSSOLogin(code, state)
+            .then((data) => {
+                login(data)
+                navigate('/adminek/dashboard', { replace: true })
+            })
+            .catch((err) => {
+                setError(err.response?.data?.error || 'Single sign-on failed.')
+            })
+    }, [searchParams, login, navigate])
+
+    return (
+        <div className="min-h-screen flex items-center justify-center px-4">
+            <div className="w-full max-w-md text-center">
+                {error ? (
+                    <div className="glass-card">
+                        <div className="p-4 bg-red-500/10 border border-red-500/30 rounded-xl text-red-400 text-sm">
+                            {error}
+                        </div>
+                        <Link to="/adminek" className="inline-block mt-6 btn-primary py-3 px-6">
+                            Back to sign in
+                        </Link>
+                    </div>
+                ) : (
+                    <div className="flex flex-col items-center gap-4">
+                        <div className="animate-spin rounded-full h-12 w-12 border-t-2 border-b-2 border-primary-500"></div>
+                        <p className="text-dark-400">Signing in...</p>
+                    </div>
+                )}
+            </div>
+        </div>
+    )
+}
+
+export default SSOCallback